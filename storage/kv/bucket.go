@@ -5,9 +5,22 @@ import (
 	"errors"
 )
 
-var ErrKeyNotFound = errors.New("key not found")
+var (
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrInvalidKey indicates a key that a store cannot use.
+	// The empty key is never valid.
+	ErrInvalidKey = errors.New("invalid key")
+
+	// ErrNotSupported indicates an operation a store does not support.
+	ErrNotSupported = errors.New("operation not supported")
+
+	// ErrUnavailable indicates a store is (temporarily) unavailable.
+	ErrUnavailable = errors.New("store unavailable")
+)
 
 // ROBucket defines simple read-only operations for key-value stores.
+// Errors for specific keys should be returned as a *KeyError.
 type ROBucket interface {
 	// Has checks that key can be found.
 	Has(ctx context.Context, key string) (found bool, err error)
@@ -0,0 +1,18 @@
+package kv
+
+import "context"
+
+// CompareAndSwapper can atomically replace the value of a key.
+type CompareAndSwapper interface {
+	// CompareAndSwap sets key to value only if key currently holds old.
+	// A nil old means that key must not exist. A nil value deletes key.
+	// Swapped reports whether the value was replaced. An error should
+	// not be returned if the swap did not happen because of a mismatch.
+	CompareAndSwap(ctx context.Context, key string, old, value []byte) (swapped bool, err error)
+}
+
+// CASBucket is a key-value store that supports compare-and-swap.
+type CASBucket interface {
+	CRUDBucket
+	CompareAndSwapper
+}
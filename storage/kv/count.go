@@ -0,0 +1,62 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Counter can count keys.
+type Counter interface {
+	// CountPrefix returns the number of keys starting with prefix.
+	// An empty prefix counts all keys.
+	CountPrefix(ctx context.Context, prefix string) (int, error)
+}
+
+// Sizer can total the size of values.
+type Sizer interface {
+	// SizePrefix returns the total size in bytes of the values of keys
+	// starting with prefix. An empty prefix totals all values.
+	SizePrefix(ctx context.Context, prefix string) (int64, error)
+}
+
+// CountPrefix returns the number of keys starting with prefix in b.
+// If b is a Counter then its CountPrefix is used. Otherwise the keys
+// are traversed.
+func CountPrefix(ctx context.Context, b KeysPrefixTraverser, prefix string) (int, error) {
+	if c, ok := b.(Counter); ok {
+		return c.CountPrefix(ctx, prefix)
+	}
+	var n int
+	for range b.KeysPrefix(ctx, prefix, nil) {
+		n++
+	}
+	return n, ctx.Err()
+}
+
+// SizePrefix returns the total size in bytes of the values of keys
+// starting with prefix in b. If b is a Sizer then its SizePrefix is
+// used. Otherwise the keys are traversed and the size of each value is
+// found using Stat (which may read each value).
+func SizePrefix(ctx context.Context, b KeysPrefixTraversingBucket, prefix string) (int64, error) {
+	if s, ok := b.(Sizer); ok {
+		return s.SizePrefix(ctx, prefix)
+	}
+	// collect the keys first to avoid deadlocks with implementations
+	keys := AllKeysPrefix(ctx, b, prefix)
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("finding keys: %w", err)
+	}
+	var size int64
+	for _, k := range keys {
+		info, err := Stat(ctx, b, k)
+		if errors.Is(err, ErrKeyNotFound) {
+			// deleted since traversed
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("stat %s: %w", k, err)
+		}
+		size += info.Size
+	}
+	return size, nil
+}
@@ -0,0 +1,18 @@
+package kv
+
+import "strconv"
+
+// KeyError records an error and the operation and key that caused it.
+type KeyError struct {
+	Op  string
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return e.Op + " " + strconv.Quote(e.Key) + ": " + e.Err.Error()
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
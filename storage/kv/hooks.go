@@ -0,0 +1,33 @@
+package kv
+
+import "context"
+
+// ChangeSet is the set of changes made by a transaction.
+type ChangeSet struct {
+	// Set maps the keys that were set to their values.
+	Set map[string][]byte
+
+	// Deleted are the keys that were deleted.
+	Deleted []string
+}
+
+// Empty reports whether c contains no changes.
+func (c *ChangeSet) Empty() bool {
+	return c == nil || (len(c.Set) < 1 && len(c.Deleted) < 1)
+}
+
+// PreCommitHook is called with the changes of a transaction before it commits.
+// Returning an error aborts the commit.
+type PreCommitHook func(ctx context.Context, changes *ChangeSet) error
+
+// PostCommitHook is called with the changes of a transaction after it successfully commits.
+type PostCommitHook func(ctx context.Context, changes *ChangeSet)
+
+// CommitHooker can register transaction commit hooks.
+type CommitHooker interface {
+	// AddPreCommitHook registers a hook to run before transactions commit.
+	AddPreCommitHook(hook PreCommitHook)
+
+	// AddPostCommitHook registers a hook to run after transactions commit.
+	AddPostCommitHook(hook PostCommitHook)
+}
@@ -0,0 +1,341 @@
+// Package kv2pc coordinates two-phase commit transactions across
+// multiple transactional key-value stores (participants).
+//
+// Committing first prepares the transaction of each participant. If
+// all participants prepared successfully then the commit decision is
+// durably recorded in a decision log before committing each
+// participant. Transactions that were prepared but have no recorded
+// decision are rolled back during recovery (presumed abort).
+//
+// A single participant that cannot prepare (for example an in-memory
+// store) may take part as the last resource. See WithLastResource.
+package kv2pc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// ErrIncomplete indicates that a transaction was decided to be
+// committed but not all participants committed. The remaining
+// participants will be committed by recovery.
+var ErrIncomplete = errors.New("commit incomplete")
+
+// participant is a named transactional store.
+type participant struct {
+	name string
+	b    kv.BucketTxnBeginner
+	last bool // the last resource (its transactions are not prepared)
+}
+
+// Coordinator runs two-phase commit transactions across participants.
+type Coordinator struct {
+	decisions    kv.KeysTraversingBucket
+	participants []participant
+	logger       log.Logger
+}
+
+// Option configures a Coordinator.
+type Option func(*Coordinator)
+
+// WithParticipant adds b as a participant named name.
+// Transactions begun by b must implement kv.TxnPreparer. To be
+// resolved by recovery b should implement kv.PreparedTxnResolver.
+// The name identifies the participant and should not change.
+func WithParticipant(name string, b kv.BucketTxnBeginner) Option {
+	return func(c *Coordinator) {
+		c.participants = append(c.participants, participant{name: name, b: b})
+	}
+}
+
+// WithLastResource adds b as the last resource participant named name.
+// Transactions begun by b need not implement kv.TxnPreparer: once the
+// other participants are prepared the last resource is committed and
+// its commit decides the outcome. If it fails to commit the other
+// participants are rolled back. Note that if the process is
+// interrupted after the last resource commits but before the decision
+// is recorded then recovery rolls back the other participants.
+// At most one last resource may be added.
+func WithLastResource(name string, b kv.BucketTxnBeginner) Option {
+	return func(c *Coordinator) {
+		c.participants = append(c.participants, participant{name: name, b: b, last: true})
+	}
+}
+
+// WithLogger sets the logger.
+func WithLogger(logger log.Logger) Option {
+	return func(c *Coordinator) {
+		c.logger = logger
+	}
+}
+
+// New creates a new two-phase commit coordinator.
+// Commit decisions are stored in decisions keyed by transaction ID.
+// Decisions must be durable for recovery to work.
+func New(decisions kv.KeysTraversingBucket, opts ...Option) *Coordinator {
+	if decisions == nil {
+		panic("nil store")
+	}
+	c := &Coordinator{decisions: decisions, logger: log.NopLogger}
+	for _, opt := range opts {
+		opt(c)
+	}
+	names := make(map[string]struct{})
+	var last bool
+	for _, p := range c.participants {
+		if p.b == nil {
+			panic("nil participant store")
+		}
+		if _, ok := names[p.name]; ok {
+			panic("duplicate participant name: " + p.name)
+		}
+		names[p.name] = struct{}{}
+		if p.last && last {
+			panic("multiple last resources")
+		}
+		last = last || p.last
+	}
+	return c
+}
+
+// decision is a commit decision record.
+type decision struct {
+	Participants []string  `json:"participants"`
+	Time         time.Time `json:"time"`
+}
+
+// Txn is a two-phase commit transaction across the participants of a Coordinator.
+type Txn struct {
+	id     string
+	c      *Coordinator
+	mu     sync.Mutex
+	txns   []kv.BucketTxnCompleter // indexed the same as participants
+	closed bool
+}
+
+// Begin begins a transaction in each participant.
+// An ErrNotSupported error is returned if a participant transaction
+// (other than the last resource) cannot be prepared.
+func (c *Coordinator) Begin(ctx context.Context) (*Txn, error) {
+	t := &Txn{id: kv.NewID(), c: c}
+	for _, p := range c.participants {
+		bt, err := p.b.BeginBucketTxn(ctx)
+		if err != nil {
+			t.rollback(ctx)
+			return nil, fmt.Errorf("beginning participant %s: %w", p.name, err)
+		}
+		t.txns = append(t.txns, bt)
+		if _, ok := bt.(kv.TxnPreparer); !ok && !p.last {
+			t.rollback(ctx)
+			return nil, fmt.Errorf("beginning participant %s: %w", p.name, kv.ErrNotSupported)
+		}
+	}
+	return t, nil
+}
+
+// ID returns the transaction ID.
+func (t *Txn) ID() string {
+	return t.id
+}
+
+// Bucket returns the transaction of the participant named name.
+// Nil is returned if there is no such participant.
+func (t *Txn) Bucket(name string) kv.Bucket {
+	for i, p := range t.c.participants {
+		if p.name == name {
+			return t.txns[i]
+		}
+	}
+	return nil
+}
+
+// rollback rolls back the participant transactions.
+// Errors are logged. t.mu should be locked (or t not shared).
+func (t *Txn) rollback(ctx context.Context) {
+	for i, bt := range t.txns {
+		if err := bt.Rollback(ctx); err != nil {
+			t.c.logger.Info(
+				"msg", "rolling back participant",
+				"txn_id", t.id,
+				"participant", t.c.participants[i].name,
+				"err", err,
+			)
+		}
+	}
+	t.closed = true
+}
+
+// Commit prepares then commits the transaction of each participant.
+// If any participant fails to prepare then all are rolled back.
+// The last resource (if any) is committed after preparing the others
+// and all others are rolled back if it fails to commit.
+// Once decided an ErrIncomplete error is returned if any participant
+// fails to commit.
+func (t *Txn) Commit(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return kv.ErrTxnClosed
+	}
+
+	// phase one: prepare
+	last := -1
+	for i, bt := range t.txns {
+		if t.c.participants[i].last {
+			last = i
+			continue
+		}
+		if err := bt.(kv.TxnPreparer).Prepare(ctx, t.id); err != nil {
+			t.rollback(ctx)
+			return fmt.Errorf("preparing participant %s: %w", t.c.participants[i].name, err)
+		}
+	}
+	if last >= 0 {
+		// the commit of the last resource decides the outcome
+		if err := t.txns[last].Commit(ctx); err != nil {
+			t.rollback(ctx)
+			return fmt.Errorf("committing last resource %s: %w", t.c.participants[last].name, err)
+		}
+	}
+
+	// record the decision
+	d := &decision{Time: time.Now()}
+	for _, p := range t.c.participants {
+		d.Participants = append(d.Participants, p.name)
+	}
+	dBytes, err := json.Marshal(d)
+	if err == nil {
+		err = t.c.decisions.Set(ctx, t.id, dBytes)
+	}
+	if err != nil && last < 0 {
+		t.rollback(ctx)
+		return fmt.Errorf("recording decision: %w", err)
+	} else if err != nil {
+		// already decided by the last resource: commit the others anyway
+		t.c.logger.Info("msg", "recording decision", "txn_id", t.id, "err", err)
+	}
+
+	// phase two: commit
+	t.closed = true
+	var errs int
+	for i, bt := range t.txns {
+		if i == last {
+			continue
+		}
+		if err = bt.Commit(ctx); err != nil {
+			t.c.logger.Info(
+				"msg", "committing participant",
+				"txn_id", t.id,
+				"participant", t.c.participants[i].name,
+				"err", err,
+			)
+			errs++
+		}
+	}
+	if errs > 0 {
+		return fmt.Errorf("%w: %d of %d participants failed", ErrIncomplete, errs, len(t.txns))
+	}
+
+	if err = t.c.decisions.Delete(ctx, t.id); err != nil {
+		// the commit succeeded: leave the decision for recovery to remove
+		t.c.logger.Info("msg", "removing decision", "txn_id", t.id, "err", err)
+	}
+	return nil
+}
+
+// Rollback rolls back the transaction of each participant.
+func (t *Txn) Rollback(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return kv.ErrTxnClosed
+	}
+	t.rollback(ctx)
+	return nil
+}
+
+// Perform calls f within a transaction.
+// It takes care of beginning the transaction, committing it, or
+// rolling it back if f returns an error.
+func (c *Coordinator) Perform(ctx context.Context, f func(context.Context, *Txn) error) error {
+	t, err := c.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("txn begin: %w", err)
+	}
+	if err = f(ctx, t); err != nil {
+		if rbErr := t.Rollback(ctx); rbErr != nil {
+			return fmt.Errorf("txn rollback: %w; while trying to handle error: %v", rbErr, err)
+		}
+		return fmt.Errorf("txn rolled back: %w", err)
+	}
+	if err = t.Commit(ctx); err != nil {
+		return fmt.Errorf("txn commit: %w", err)
+	}
+	return nil
+}
+
+// Recover resolves the prepared transactions of participants.
+// Transactions with a recorded commit decision are committed and all
+// others are rolled back. Once all participants are resolved the
+// remaining decisions are removed. The last resource is never prepared
+// and is not resolved. If any other participant does not implement
+// kv.PreparedTxnResolver then the decisions are kept (its transactions
+// may still need them) and an ErrNotSupported error is returned.
+// Recover should be called before any transactions are begun (for
+// example at startup) as in-progress transactions would be resolved.
+func (c *Coordinator) Recover(ctx context.Context) error {
+	var errs int
+	var unresolved []string
+	for _, p := range c.participants {
+		if p.last {
+			continue
+		}
+		r, ok := p.b.(kv.PreparedTxnResolver)
+		if !ok {
+			unresolved = append(unresolved, p.name)
+			continue
+		}
+		ids, err := r.PreparedTxns(ctx)
+		if err != nil {
+			return fmt.Errorf("prepared transactions of participant %s: %w", p.name, err)
+		}
+		for _, id := range ids {
+			commit, err := c.decisions.Has(ctx, id)
+			if err != nil {
+				return fmt.Errorf("checking decision: %w", err)
+			}
+			action := "rollback"
+			if commit {
+				action = "commit"
+				err = r.CommitPrepared(ctx, id)
+			} else {
+				err = r.RollbackPrepared(ctx, id)
+			}
+			logs := []interface{}{"msg", "resolving prepared transaction", "txn_id", id, "participant", p.name, "action", action}
+			if err != nil {
+				c.logger.Info(append(logs, "err", err)...)
+				errs++
+			} else {
+				c.logger.Debug(logs...)
+			}
+		}
+	}
+	if errs > 0 {
+		return fmt.Errorf("resolving prepared transactions: %d failed", errs)
+	} else if len(unresolved) > 0 {
+		return fmt.Errorf("resolving prepared transactions of participants %v: %w", unresolved, kv.ErrNotSupported)
+	}
+	for _, id := range kv.AllKeys(ctx, c.decisions) {
+		if err := c.decisions.Delete(ctx, id); err != nil {
+			return fmt.Errorf("removing decision: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package kv2pc
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvdiskv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/kvtxn"
+	"github.com/peterbourgon/diskv/v3"
+)
+
+// newStore creates a transactional diskv store in dir.
+func newStore(t *testing.T, dir string) *kvdiskv.KVDiskvTxn {
+	t.Helper()
+	dv := diskv.New(diskv.Options{
+		BasePath:  filepath.Join(dir, "data"),
+		Transform: kvdiskv.FlatTransform,
+	})
+	b, err := kvdiskv.NewTxn(dv, filepath.Join(dir, "txn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// expectFound checks whether key is found in b.
+func expectFound(t *testing.T, b kv.ROBucket, key string, want bool) {
+	t.Helper()
+	found, err := b.Has(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != want {
+		t.Errorf("key %s: have found: %v, want: %v", key, found, want)
+	}
+}
+
+var errPrepare = errors.New("test prepare error")
+
+// failPrepare begins transactions that fail to prepare.
+type failPrepare struct {
+	kv.BucketTxnBeginner
+}
+
+func (b failPrepare) BeginBucketTxn(ctx context.Context) (kv.BucketTxnCompleter, error) {
+	bt, err := b.BucketTxnBeginner.BeginBucketTxn(ctx)
+	return failPrepareTxn{bt}, err
+}
+
+type failPrepareTxn struct {
+	kv.BucketTxnCompleter
+}
+
+func (failPrepareTxn) Prepare(context.Context, string) error {
+	return errPrepare
+}
+
+func TestCommit(t *testing.T) {
+	ctx := context.Background()
+	b1, b2 := newStore(t, t.TempDir()), newStore(t, t.TempDir())
+	decisions := kvmap.New()
+	c := New(decisions, WithParticipant("b1", b1), WithParticipant("b2", b2))
+
+	err := c.Perform(ctx, func(ctx context.Context, t *Txn) error {
+		if err := t.Bucket("b1").Set(ctx, "key_1", []byte("val_1")); err != nil {
+			return err
+		}
+		return t.Bucket("b2").Set(ctx, "key_2", []byte("val_2"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectFound(t, b1, "key_1", true)
+	expectFound(t, b2, "key_2", true)
+	if keys := kv.AllKeys(ctx, decisions); len(keys) > 0 {
+		t.Errorf("expected no decisions, have: %v", keys)
+	}
+}
+
+func TestCommitPrepareError(t *testing.T) {
+	ctx := context.Background()
+	b1, b2 := newStore(t, t.TempDir()), newStore(t, t.TempDir())
+	decisions := kvmap.New()
+	c := New(decisions, WithParticipant("b1", b1), WithParticipant("b2", failPrepare{b2}))
+
+	txn, err := c.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = txn.Bucket("b1").Set(ctx, "key_1", []byte("val_1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = txn.Bucket("b2").Set(ctx, "key_2", []byte("val_2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = txn.Commit(ctx); !errors.Is(err, errPrepare) {
+		t.Fatalf("expected prepare error, have: %v", err)
+	}
+
+	expectFound(t, b1, "key_1", false)
+	expectFound(t, b2, "key_2", false)
+	if ids, err := b1.PreparedTxns(ctx); err != nil || len(ids) > 0 {
+		t.Errorf("expected no prepared transactions, have: %v: %v", ids, err)
+	}
+	if keys := kv.AllKeys(ctx, decisions); len(keys) > 0 {
+		t.Errorf("expected no decisions, have: %v", keys)
+	}
+	if err = txn.Rollback(ctx); !errors.Is(err, kv.ErrTxnClosed) {
+		t.Errorf("expected ErrTxnClosed, have: %v", err)
+	}
+}
+
+func TestBeginNotSupported(t *testing.T) {
+	c := New(kvmap.New(), WithParticipant("b1", newStore(t, t.TempDir())), WithParticipant("b2", kvmap.New()))
+	if _, err := c.Begin(context.Background()); !errors.Is(err, kv.ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, have: %v", err)
+	}
+}
+
+func TestLastResource(t *testing.T) {
+	ctx := context.Background()
+	b1, b2 := newStore(t, t.TempDir()), kvtxn.New(kvmap.New())
+	decisions := kvmap.New()
+	c := New(decisions, WithParticipant("b1", b1), WithLastResource("b2", b2))
+
+	set := func(key string) error {
+		return c.Perform(ctx, func(ctx context.Context, t *Txn) error {
+			if err := t.Bucket("b1").Set(ctx, key, []byte("val")); err != nil {
+				return err
+			}
+			return t.Bucket("b2").Set(ctx, key, []byte("val"))
+		})
+	}
+	if err := set("key_1"); err != nil {
+		t.Fatal(err)
+	}
+	expectFound(t, b1, "key_1", true)
+	expectFound(t, b2, "key_1", true)
+
+	// a failed last resource commit rolls back the others
+	b2.AddPreCommitHook(func(context.Context, *kv.ChangeSet) error { return errPrepare })
+	if err := set("key_2"); !errors.Is(err, errPrepare) {
+		t.Fatalf("expected last resource error, have: %v", err)
+	}
+	expectFound(t, b1, "key_2", false)
+	expectFound(t, b2, "key_2", false)
+	if ids, err := b1.PreparedTxns(ctx); err != nil || len(ids) > 0 {
+		t.Errorf("expected no prepared transactions, have: %v: %v", ids, err)
+	}
+	if keys := kv.AllKeys(ctx, decisions); len(keys) > 0 {
+		t.Errorf("expected no decisions, have: %v", keys)
+	}
+	if err := c.Recover(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecoverNotSupported(t *testing.T) {
+	ctx := context.Background()
+	decisions := kvmap.New()
+	if err := decisions.Set(ctx, "txn_1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	b := newStore(t, t.TempDir())
+	c := New(decisions, WithParticipant("b1", b), WithParticipant("b2", failPrepare{b}))
+	if err := c.Recover(ctx); !errors.Is(err, kv.ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, have: %v", err)
+	}
+	// the decision is kept for the unresolved participant
+	expectFound(t, decisions, "txn_1", true)
+}
+
+func TestRecover(t *testing.T) {
+	ctx := context.Background()
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	b1, b2 := newStore(t, dir1), newStore(t, dir2)
+	decisions := kvmap.New()
+	c := New(decisions, WithParticipant("b1", b1), WithParticipant("b2", b2))
+
+	// prepare transactions as if the process crashed during commit
+	prepare := func(key string, decide bool) {
+		txn, err := c.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, bt := range txn.txns {
+			if err = bt.Set(ctx, key, []byte("val")); err != nil {
+				t.Fatal(err)
+			}
+			if err = bt.(kv.TxnPreparer).Prepare(ctx, txn.ID()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if decide {
+			if err = decisions.Set(ctx, txn.ID(), []byte("{}")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	prepare("key_decided", true)
+	prepare("key_undecided", false)
+
+	// "restart"
+	b1, b2 = newStore(t, dir1), newStore(t, dir2)
+	c = New(decisions, WithParticipant("b1", b1), WithParticipant("b2", b2))
+	if err := c.Recover(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range []*kvdiskv.KVDiskvTxn{b1, b2} {
+		expectFound(t, b, "key_decided", true)
+		expectFound(t, b, "key_undecided", false)
+		if ids, err := b.PreparedTxns(ctx); err != nil || len(ids) > 0 {
+			t.Errorf("expected no prepared transactions, have: %v: %v", ids, err)
+		}
+	}
+	if keys := kv.AllKeys(ctx, decisions); len(keys) > 0 {
+		t.Errorf("expected no decisions, have: %v", keys)
+	}
+}
@@ -3,39 +3,86 @@ package kvdiskv
 import (
 	"context"
 	"errors"
-	"fmt"
 	"os"
+	"strings"
 
 	"github.com/micromdm/nanolib/storage/kv"
 )
 
+// checkKey returns an ErrInvalidKey error for op if key is invalid.
+// Keys are invalid if they are empty or would not map to a single
+// file path within the diskv store.
+func (b *KVDiskv) checkKey(op, key string) error {
+	invalid := key == ""
+	if !invalid {
+		pathKey := b.diskv.AdvancedTransform(key)
+		for _, part := range append(pathKey.Path, pathKey.FileName) {
+			if strings.ContainsAny(part, `/`+string(os.PathSeparator)) || part == "." || part == ".." {
+				invalid = true
+				break
+			}
+		}
+	}
+	if invalid {
+		return &kv.KeyError{Op: op, Key: key, Err: kv.ErrInvalidKey}
+	}
+	return nil
+}
+
 // Get retrieves the value at key in the diskv store.
 // If key is not found then a wrapped ErrKeyNotFound will be returned.
 func (b *KVDiskv) Get(_ context.Context, key string) ([]byte, error) {
+	if err := b.checkKey("get", key); err != nil {
+		return nil, err
+	}
+	b.publish.RLock()
+	defer b.publish.RUnlock()
 	r, err := b.diskv.Read(key)
 	if errors.Is(err, os.ErrNotExist) {
 		// replace error type to comply with interface
-		return r, fmt.Errorf("%w: %s", kv.ErrKeyNotFound, key)
+		return r, &kv.KeyError{Op: "get", Key: key, Err: kv.ErrKeyNotFound}
+	} else if err != nil {
+		return r, &kv.KeyError{Op: "get", Key: key, Err: err}
 	}
-	return r, err
+	return r, nil
 }
 
 // Set sets key to value in the diskv store.
 func (b *KVDiskv) Set(_ context.Context, key string, value []byte) error {
-	return b.diskv.Write(key, value)
+	if err := b.checkKey("set", key); err != nil {
+		return err
+	}
+	b.publish.RLock()
+	defer b.publish.RUnlock()
+	if err := b.diskv.Write(key, value); err != nil {
+		return &kv.KeyError{Op: "set", Key: key, Err: err}
+	}
+	return nil
 }
 
 // Has checks that key is found in the diskv store.
 func (b *KVDiskv) Has(_ context.Context, key string) (bool, error) {
+	if err := b.checkKey("has", key); err != nil {
+		return false, err
+	}
+	b.publish.RLock()
+	defer b.publish.RUnlock()
 	return b.diskv.Has(key), nil
 }
 
 // Delete deletes key in the diskv store.
 func (b *KVDiskv) Delete(_ context.Context, key string) error {
+	if err := b.checkKey("delete", key); err != nil {
+		return err
+	}
+	b.publish.RLock()
+	defer b.publish.RUnlock()
 	err := b.diskv.Erase(key)
 	if errors.Is(err, os.ErrNotExist) {
 		// hide this specific error to comply with interface
 		return nil
+	} else if err != nil {
+		return &kv.KeyError{Op: "delete", Key: key, Err: err}
 	}
-	return err
+	return nil
 }
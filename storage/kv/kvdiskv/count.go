@@ -0,0 +1,79 @@
+package kvdiskv
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// walkPrefix calls f with the file info of each key starting with prefix.
+// Like diskv only the directory of prefix (per the transform) is walked.
+// Values are not read.
+func (b *KVDiskv) walkPrefix(ctx context.Context, prefix string, f func(fs.DirEntry) error) error {
+	root := b.diskv.BasePath
+	if prefix != "" {
+		pathKey := b.diskv.AdvancedTransform(prefix)
+		root = filepath.Join(root, filepath.Join(pathKey.Path...))
+	}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		key, err := b.pathKey(path)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		return f(d)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		// nothing was written for prefix
+		return nil
+	}
+	return err
+}
+
+// CountPrefix returns the number of keys starting with prefix in the
+// diskv store by walking its files.
+func (b *KVDiskv) CountPrefix(ctx context.Context, prefix string) (int, error) {
+	b.publish.RLock()
+	defer b.publish.RUnlock()
+	var n int
+	err := b.walkPrefix(ctx, prefix, func(fs.DirEntry) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// SizePrefix returns the total size of the values of keys starting with
+// prefix in the diskv store by walking its files. Values are not read.
+// Note the size is of the stored (possibly compressed) values.
+func (b *KVDiskv) SizePrefix(ctx context.Context, prefix string) (int64, error) {
+	b.publish.RLock()
+	defer b.publish.RUnlock()
+	var size int64
+	err := b.walkPrefix(ctx, prefix, func(d fs.DirEntry) error {
+		info, err := d.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted since walked
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
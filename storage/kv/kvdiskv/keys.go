@@ -1,10 +1,18 @@
 package kvdiskv
 
-import "context"
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/peterbourgon/diskv/v3"
+)
 
 // Keys returns all keys in the diskv store.
 // The returned keys have no ordering guaratees.
 // The keys channel should be closed if cancel was provided and closed.
+// Unlike other operations, keys of a transaction commit that is being
+// published may be partially observed.
 func (b *KVDiskv) Keys(_ context.Context, cancel <-chan struct{}) <-chan string {
 	return b.diskv.Keys(cancel)
 }
@@ -15,3 +23,18 @@ func (b *KVDiskv) Keys(_ context.Context, cancel <-chan struct{}) <-chan string
 func (b *KVDiskv) KeysPrefix(_ context.Context, prefix string, cancel <-chan struct{}) <-chan string {
 	return b.diskv.KeysPrefix(prefix, cancel)
 }
+
+// pathKey returns the key stored at path (a file in the base path).
+// Like diskv the path is mapped back to the key by the inverse transform.
+func (b *KVDiskv) pathKey(path string) (string, error) {
+	rel, err := filepath.Rel(b.diskv.BasePath, path)
+	if err != nil {
+		return "", err
+	}
+	dir, file := filepath.Split(rel)
+	var parts []string
+	if dir != "" {
+		parts = strings.Split(strings.TrimSuffix(dir, string(filepath.Separator)), string(filepath.Separator))
+	}
+	return b.diskv.InverseTransform(&diskv.PathKey{Path: parts, FileName: file}), nil
+}
@@ -2,6 +2,16 @@
 package kvdiskv
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
 	"github.com/peterbourgon/diskv/v3"
 )
 
@@ -11,13 +21,168 @@ var FlatTransform = func(s string) []string { return []string{} }
 
 // KVDiskv wraps diskv to implement an on-disk key-value store.
 type KVDiskv struct {
-	diskv *diskv.Diskv
+	diskv   *diskv.Diskv
+	publish sync.RWMutex // held exclusively while publishing commits
 }
 
 // New creates a new on-disk key-value store backed by dv.
+// The store does not support transactions. See NewTxn.
 func New(dv *diskv.Diskv) *KVDiskv {
 	if dv == nil {
 		panic("nil diskv")
 	}
 	return &KVDiskv{diskv: dv}
 }
+
+// KVDiskvTxn is an on-disk key-value store that supports transactions.
+type KVDiskvTxn struct {
+	*KVDiskv
+	txnPath string // transaction staging directory
+}
+
+// NewTxn creates a new on-disk key-value store backed by dv that
+// supports transactions. Transaction writes are staged in txnPath and
+// published atomically on commit. txnPath must not be within the diskv
+// base path, should be on the same filesystem (so that staged values
+// can be renamed into place) and must not be shared with other stores.
+// Committed but incompletely published transactions found in txnPath
+// are published and any other transactions are removed.
+func NewTxn(dv *diskv.Diskv, txnPath string) (*KVDiskvTxn, error) {
+	b := &KVDiskvTxn{KVDiskv: New(dv), txnPath: txnPath}
+	if txnPath == "" {
+		return nil, errors.New("empty transaction path")
+	}
+	rel, err := filepath.Rel(dv.BasePath, txnPath)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("transaction path %s within diskv base path", txnPath)
+	}
+	if err = os.MkdirAll(txnPath, 0700); err != nil {
+		return nil, err
+	}
+	return b, b.recover()
+}
+
+// recover publishes committed transactions and removes the others.
+// Prepared transactions are kept to be resolved.
+func (b *KVDiskvTxn) recover() error {
+	entries, err := os.ReadDir(b.txnPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(b.txnPath, entry.Name())
+		m, err := readManifest(dir, manifestFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("recovering transaction %s: %w", entry.Name(), err)
+		} else if err == nil {
+			if err = b.apply(dir, m); err != nil {
+				return fmt.Errorf("recovering transaction %s: %w", entry.Name(), err)
+			}
+		} else if _, err = os.Stat(filepath.Join(dir, preparedFile)); err == nil {
+			continue
+		}
+		if err = os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	// manifestFile is the name of the transaction manifest file.
+	// Its existence marks a transaction as committed.
+	manifestFile = "manifest.json"
+
+	// preparedFile is the name of the prepared transaction manifest file.
+	// Its existence marks a transaction as prepared.
+	preparedFile = "prepared.json"
+)
+
+// manifest is the list of operations of a committed (or prepared) transaction.
+type manifest struct {
+	ID  string       `json:"id,omitempty"` // prepared transaction ID
+	Ops []manifestOp `json:"ops"`
+}
+
+// manifestOp is a committed operation for a key.
+type manifestOp struct {
+	Key  string `json:"key"`
+	File string `json:"file,omitempty"` // staged value file
+	Del  bool   `json:"del,omitempty"`
+}
+
+// readManifest reads the manifest file name in transaction directory dir.
+func readManifest(dir, name string) (*manifest, error) {
+	mBytes, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	m := new(manifest)
+	return m, json.Unmarshal(mBytes, m)
+}
+
+// writeFileSync writes data to a file named name and syncs it to disk.
+func writeFileSync(name string, data []byte, perm os.FileMode) error {
+	return copyFileSync(name, bytes.NewReader(data), perm)
+}
+
+// copyFileSync writes the data read from r to a file named name and syncs it to disk.
+func copyFileSync(name string, r io.Reader, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeManifest durably writes m to the manifest file name in transaction directory dir.
+// The manifest is renamed into place to atomically mark the transaction.
+func writeManifest(dir, name string, m *manifest) error {
+	mBytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, name+".tmp")
+	if err = writeFileSync(tmp, mBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// apply publishes the operations of m staged in transaction directory dir.
+// Staged values are written through diskv (so that its compression and
+// index apply) and then removed. Applying is idempotent: staged values
+// that were already published are skipped.
+func (b *KVDiskv) apply(dir string, m *manifest) error {
+	for _, op := range m.Ops {
+		if op.Del {
+			if err := b.diskv.Erase(op.Key); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("erase %q: %w", op.Key, err)
+			}
+			continue
+		}
+		src := filepath.Join(dir, op.File)
+		f, err := os.Open(src)
+		if errors.Is(err, os.ErrNotExist) {
+			// already applied
+			continue
+		} else if err != nil {
+			return fmt.Errorf("open %q: %w", op.Key, err)
+		}
+		err = b.diskv.WriteStream(op.Key, f, true)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("write %q: %w", op.Key, err)
+		}
+		if err = os.Remove(src); err != nil {
+			return fmt.Errorf("remove staged %q: %w", op.Key, err)
+		}
+	}
+	return nil
+}
@@ -1,9 +1,16 @@
 package kvdiskv
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/micromdm/nanolib/storage/kv"
 	"github.com/micromdm/nanolib/storage/kv/test"
 	"github.com/peterbourgon/diskv/v3"
 )
@@ -17,8 +24,356 @@ func newDV(t *testing.T) *diskv.Diskv {
 
 }
 
+func newTxn(t *testing.T) *KVDiskvTxn {
+	b, err := NewTxn(newDV(t), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
 func TestKVMap(t *testing.T) {
 	ctx := context.Background()
 	test.TestBucketSimple(t, ctx, New(newDV(t)))
+	test.TestErrors(t, ctx, New(newDV(t)))
 	test.TestKeysTraversing(t, ctx, New(newDV(t)))
 }
+
+func TestKVDiskvTxn(t *testing.T) {
+	ctx := context.Background()
+	test.TestBucketSimple(t, ctx, newTxn(t))
+	test.TestKeysTraversing(t, ctx, newTxn(t))
+	test.TestTxnSimple(t, ctx, newTxn(t), test.WithNoReadAfterRollback())
+	test.TestTxnLifecycle(t, ctx, newTxn(t))
+	test.TestTxnReadOnly(t, ctx, newTxn(t))
+	test.TestKVTxnKeys(t, ctx, newTxn(t))
+	t.Run("TestErrorsTxn", func(t *testing.T) {
+		bt, err := newTxn(t).BeginCRUDBucketTxn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.TestErrors(t, ctx, bt)
+		if err = bt.Rollback(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestKVDiskvTxnNotSupported(t *testing.T) {
+	// transaction support is detected by interface
+	var b interface{} = New(newDV(t))
+	if _, ok := b.(kv.TxnBucket); ok {
+		t.Error("expected store without transaction support")
+	}
+	if _, ok := b.(kv.BucketTxnOptionsBeginner); ok {
+		t.Error("expected store without transaction options support")
+	}
+	b = newTxn(t)
+	if _, ok := b.(kv.TxnBucketWithCRUD); !ok {
+		t.Error("expected store with transaction support")
+	}
+
+	dv := newDV(t)
+	if _, err := NewTxn(dv, filepath.Join(dv.BasePath, "txn")); err == nil {
+		t.Error("expected error for transaction path within base path")
+	}
+}
+
+func TestKVDiskvTxnCommit(t *testing.T) {
+	ctx := context.Background()
+	txnPath := t.TempDir()
+	b, err := NewTxn(newDV(t), txnPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Set(ctx, "key_2", []byte("val_2")); err != nil {
+		t.Fatal(err)
+	}
+
+	bt, err := b.BeginBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Set(ctx, "key_1", []byte("val_1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Set(ctx, "key_1", []byte("val_1_new")); err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Delete(ctx, "key_2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is published before commit
+	if found, err := b.Has(ctx, "key_1"); err != nil || found {
+		t.Errorf("expected key_1 to not be found: %v", err)
+	}
+	if found, err := b.Has(ctx, "key_2"); err != nil || !found {
+		t.Errorf("expected key_2 to be found: %v", err)
+	}
+
+	if err = bt.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := b.Get(ctx, "key_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := value, []byte("val_1_new"); !bytes.Equal(have, want) {
+		t.Errorf("have: %s, want: %s", have, want)
+	}
+	if found, err := b.Has(ctx, "key_2"); err != nil || found {
+		t.Errorf("expected key_2 to not be found: %v", err)
+	}
+
+	// the transaction directory is removed
+	entries, err := os.ReadDir(txnPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("expected empty transaction path, have %d entries", len(entries))
+	}
+}
+
+func TestKVDiskvTxnCompression(t *testing.T) {
+	ctx := context.Background()
+	dv := diskv.New(diskv.Options{
+		BasePath:    t.TempDir(),
+		Transform:   FlatTransform,
+		Compression: diskv.NewGzipCompression(),
+		Index:       &diskv.BTreeIndex{},
+		IndexLess:   func(a, b string) bool { return a < b },
+	})
+	b, err := NewTxn(dv, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.PerformBucketTxn(ctx, b, func(ctx context.Context, txn kv.Bucket) error {
+		return txn.Set(ctx, "key_1", []byte("val_1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// committed values are compressed and indexed like any other
+	value, err := b.Get(ctx, "key_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := value, []byte("val_1"); !bytes.Equal(have, want) {
+		t.Errorf("have: %s, want: %s", have, want)
+	}
+	if have := dv.Index.Keys("", 10); len(have) != 1 || have[0] != "key_1" {
+		t.Errorf("expected key_1 to be indexed, have: %v", have)
+	}
+}
+
+func TestKVDiskvTxnRecover(t *testing.T) {
+	ctx := context.Background()
+	dv := newDV(t)
+	txnPath := t.TempDir()
+	b, err := NewTxn(dv, txnPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Set(ctx, "key_2", []byte("val_2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// stage a transaction that is "interrupted" before it was committed
+	bt, err := b.BeginBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Set(ctx, "key_3", []byte("val_3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// and one that is "interrupted" after it was committed (marked)
+	// but before it was published
+	dir := filepath.Join(txnPath, "txn-committed")
+	if err = os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "0"), []byte("val_1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = writeManifest(dir, manifestFile, &manifest{Ops: []manifestOp{
+		{Key: "key_1", File: "0"},
+		{Key: "key_2", Del: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = NewTxn(dv, txnPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := b.Get(ctx, "key_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := value, []byte("val_1"); !bytes.Equal(have, want) {
+		t.Errorf("have: %s, want: %s", have, want)
+	}
+	for _, key := range []string{"key_2", "key_3"} {
+		if found, err := b.Has(ctx, key); err != nil || found {
+			t.Errorf("expected %s to not be found: %v", key, err)
+		}
+	}
+
+	entries, err := os.ReadDir(txnPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("expected empty transaction path, have %d entries", len(entries))
+	}
+}
+
+func TestKVDiskvTxnPrepare(t *testing.T) {
+	ctx := context.Background()
+	dv := newDV(t)
+	txnPath := t.TempDir()
+	b, err := NewTxn(dv, txnPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"txn_commit", "txn_rollback"} {
+		bt, err := b.BeginBucketTxn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = bt.Set(ctx, id, []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+		if err = bt.(kv.TxnPreparer).Prepare(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		// prepared transactions can no longer be written to
+		if err = bt.Set(ctx, id, []byte("val")); !errors.Is(err, kv.ErrReadOnly) {
+			t.Errorf("expected ErrReadOnly, have: %v", err)
+		}
+	}
+
+	// prepared transactions survive a restart
+	b, err = NewTxn(dv, txnPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := b.PreparedTxns(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(ids), 2; have != want {
+		t.Fatalf("have: %d, want: %d prepared transactions", have, want)
+	}
+
+	if err = b.CommitPrepared(ctx, "txn_commit"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.RollbackPrepared(ctx, "txn_rollback"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.RollbackPrepared(ctx, "txn_missing"); err == nil {
+		t.Error("expected error for missing prepared transaction")
+	}
+
+	if found, err := b.Has(ctx, "txn_commit"); err != nil || !found {
+		t.Errorf("expected txn_commit to be found: %v", err)
+	}
+	if found, err := b.Has(ctx, "txn_rollback"); err != nil || found {
+		t.Errorf("expected txn_rollback to not be found: %v", err)
+	}
+	if ids, err = b.PreparedTxns(ctx); err != nil || len(ids) != 0 {
+		t.Errorf("expected no prepared transactions, have: %v: %v", ids, err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+	test.TestStat(t, ctx, New(newDV(t)))
+
+	bt, err := newTxn(t).begin(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.TestStat(t, ctx, bt)
+	if err = bt.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	ctx := context.Background()
+	test.TestStream(t, ctx, New(newDV(t)))
+
+	b := newTxn(t)
+	bt, err := b.begin(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.TestStream(t, ctx, bt)
+	if err = bt.SetReader(ctx, "stream", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	value, err := b.Get(ctx, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(value), "hello"; have != want {
+		t.Errorf("have: %q, want: %q", have, want)
+	}
+}
+
+func TestStreamSlowReader(t *testing.T) {
+	ctx := context.Background()
+	b := newTxn(t)
+	pr, pw := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() { errCh <- b.SetReader(ctx, "slow", pr) }()
+	if _, err := pw.Write([]byte("hello ")); err != nil {
+		t.Fatal(err)
+	}
+
+	// commits are not blocked while the value is being read
+	committed := make(chan error, 1)
+	go func() {
+		committed <- kv.PerformBucketTxn(ctx, b, func(ctx context.Context, txn kv.Bucket) error {
+			return txn.Set(ctx, "fast", []byte("fast"))
+		})
+	}()
+	select {
+	case err := <-committed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out: commit blocked by reader")
+	}
+
+	if _, err := pw.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	value, err := b.Get(ctx, "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(value), "hello world"; have != want {
+		t.Errorf("have: %q, want: %q", have, want)
+	}
+}
@@ -0,0 +1,102 @@
+package kvdiskv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// prefixDir returns the directory that would hold the keys starting
+// with prefix if the transform places them in their own directory.
+// An empty string is returned if the directory cannot be removed as a
+// whole: keys in it would be cached or indexed by diskv, or it is the
+// base path.
+func (b *KVDiskv) prefixDir(prefix string) string {
+	if prefix == "" || b.diskv.CacheSizeMax > 0 || b.diskv.Index != nil {
+		return ""
+	}
+	pathKey := b.diskv.AdvancedTransform(prefix)
+	if len(pathKey.Path) < 1 {
+		return ""
+	}
+	return filepath.Join(b.diskv.BasePath, filepath.Join(pathKey.Path...))
+}
+
+// errOtherKey stops walking a directory that holds other keys.
+var errOtherKey = errors.New("other key")
+
+// holdsOnly reports whether dir holds exactly keys. That is every file
+// in dir maps back (by the inverse transform) to one of keys and every
+// one of keys is stored in dir.
+func (b *KVDiskv) holdsOnly(dir string, keys []string) (bool, error) {
+	remaining := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		pathKey := b.diskv.AdvancedTransform(key)
+		keyDir := filepath.Join(b.diskv.BasePath, filepath.Join(pathKey.Path...))
+		if keyDir != dir && !strings.HasPrefix(keyDir, dir+string(filepath.Separator)) {
+			return false, nil
+		}
+		remaining[key] = struct{}{}
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		key, err := b.pathKey(path)
+		if err != nil {
+			return err
+		}
+		if _, ok := remaining[key]; !ok {
+			return errOtherKey
+		}
+		delete(remaining, key)
+		return nil
+	})
+	if errors.Is(err, errOtherKey) {
+		return false, nil
+	}
+	return len(remaining) < 1, err
+}
+
+// DeletePrefix deletes all keys starting with prefix in the diskv store.
+// Other operations on the store wait for the deletion to complete.
+// If the transform places the keys starting with prefix (and no others)
+// in their own directory then that directory is removed as a whole.
+// Every file in the directory is first checked to map back to a key
+// starting with prefix (transforms need not preserve prefixes).
+// Otherwise the keys are erased one at a time.
+func (b *KVDiskv) DeletePrefix(_ context.Context, prefix string) error {
+	b.publish.Lock()
+	defer b.publish.Unlock()
+	var keys []string
+	for k := range b.diskv.KeysPrefix(prefix, nil) {
+		keys = append(keys, k)
+	}
+	if len(keys) < 1 {
+		return nil
+	}
+
+	if dir := b.prefixDir(prefix); dir != "" {
+		only, err := b.holdsOnly(dir, keys)
+		if err != nil {
+			return &kv.KeyError{Op: "delete prefix", Key: prefix, Err: err}
+		}
+		if only {
+			if err = os.RemoveAll(dir); err != nil {
+				return &kv.KeyError{Op: "delete prefix", Key: prefix, Err: err}
+			}
+			return nil
+		}
+	}
+
+	for _, key := range keys {
+		if err := b.diskv.Erase(key); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return &kv.KeyError{Op: "delete prefix", Key: key, Err: err}
+		}
+	}
+	return nil
+}
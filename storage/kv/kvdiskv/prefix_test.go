@@ -0,0 +1,177 @@
+package kvdiskv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/test"
+	"github.com/peterbourgon/diskv/v3"
+)
+
+// dotTransform places keys in directories split by dots.
+func dotTransform(key string) *diskv.PathKey {
+	parts := strings.Split(key, ".")
+	return &diskv.PathKey{
+		Path:     append([]string{}, parts[:len(parts)-1]...),
+		FileName: parts[len(parts)-1],
+	}
+}
+
+// dotInverseTransform is the inverse of dotTransform.
+func dotInverseTransform(pathKey *diskv.PathKey) string {
+	return strings.Join(append(append([]string{}, pathKey.Path...), pathKey.FileName), ".")
+}
+
+func TestDeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	test.TestDeletePrefix(t, ctx, New(newDV(t)))
+	test.TestDeletePrefix(t, ctx, newTxn(t))
+
+	dv := diskv.New(diskv.Options{
+		BasePath:          t.TempDir(),
+		AdvancedTransform: dotTransform,
+		InverseTransform:  dotInverseTransform,
+	})
+	b := New(dv)
+	test.TestDeletePrefix(t, ctx, b)
+
+	err := kv.SetMap(ctx, b, map[string][]byte{
+		"dir.a":   []byte("a"),
+		"dir.b":   []byte("b"),
+		"dir.c.d": []byte("d"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the prefix shares a directory with other keys
+	if err = b.DeletePrefix(ctx, "dir.c"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(kv.AllKeysPrefix(ctx, b, "dir.")), 2; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// the prefix has its own directory
+	if err = b.DeletePrefix(ctx, "dir."); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dv.BasePath, "dir")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected directory to be removed, have: %v", err)
+	}
+	if have := kv.AllKeysPrefix(ctx, b, "dir."); len(have) > 0 {
+		t.Errorf("expected no keys, have: %v", have)
+	}
+}
+
+// lastCharTransform places keys in directories named by their last
+// character. It does not preserve prefixes.
+func lastCharTransform(key string) *diskv.PathKey {
+	return &diskv.PathKey{Path: []string{key[len(key)-1:]}, FileName: key}
+}
+
+func TestDeletePrefixTransform(t *testing.T) {
+	ctx := context.Background()
+	b := New(diskv.New(diskv.Options{
+		BasePath:          t.TempDir(),
+		AdvancedTransform: lastCharTransform,
+		InverseTransform:  func(pathKey *diskv.PathKey) string { return pathKey.FileName },
+	}))
+	err := kv.SetMap(ctx, b, map[string][]byte{
+		"p":  []byte("p"),
+		"xp": []byte("xp"),
+		"pa": []byte("pa"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the directory of the prefix holds an unrelated key
+	if err = b.DeletePrefix(ctx, "p"); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"p": false, "xp": true} {
+		if found, err := b.Has(ctx, key); err != nil || found != want {
+			t.Errorf("key %s: have found: %v, want: %v: %v", key, found, want, err)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	ctx := context.Background()
+	test.TestRename(t, ctx, New(newDV(t)))
+	test.TestRename(t, ctx, newTxn(t))
+}
+
+func TestCountSize(t *testing.T) {
+	ctx := context.Background()
+	test.TestCountSize(t, ctx, New(newDV(t)))
+	test.TestCountSize(t, ctx, New(diskv.New(diskv.Options{
+		BasePath:          t.TempDir(),
+		AdvancedTransform: dotTransform,
+		InverseTransform:  dotInverseTransform,
+	})))
+}
+
+func TestCountSizeTxn(t *testing.T) {
+	ctx := context.Background()
+	b := newTxn(t)
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 50; i++ {
+			err := kv.PerformBucketTxn(ctx, b, func(ctx context.Context, txn kv.Bucket) error {
+				return kv.SetMap(ctx, txn, map[string][]byte{
+					fmt.Sprintf("c_%d_a", i): []byte("a"),
+					fmt.Sprintf("c_%d_b", i): []byte("b"),
+				})
+			})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// commits are never partially counted
+	for {
+		n, err := b.CountPrefix(ctx, "c_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n%2 != 0 {
+			t.Fatalf("expected even count, have: %d", n)
+		}
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+	}
+}
+
+func TestPathKey(t *testing.T) {
+	b := New(diskv.New(diskv.Options{
+		BasePath:          t.TempDir(),
+		AdvancedTransform: dotTransform,
+		InverseTransform:  dotInverseTransform,
+	}))
+	for _, key := range []string{"a", "a.b", "a.b.c"} {
+		have, err := b.pathKey(b.filename(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != key {
+			t.Errorf("have: %q, want: %q", have, key)
+		}
+	}
+}
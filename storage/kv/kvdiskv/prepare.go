@@ -0,0 +1,112 @@
+package kvdiskv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// Prepare durably prepares the transaction to be committed as id.
+// The staged operations are recorded in a prepared manifest which
+// survives restarts until resolved (see PreparedTxns).
+// Writes to prepared transactions will return an ErrReadOnly error.
+func (t *txn) Prepare(_ context.Context, id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return kv.ErrTxnClosed
+	}
+	if t.prepared {
+		return errors.New("transaction already prepared")
+	}
+	if len(t.ops) > 0 {
+		if err := writeManifest(t.dir, preparedFile, t.manifest(id)); err != nil {
+			return fmt.Errorf("writing prepared manifest: %w", err)
+		}
+	}
+	t.prepared = true
+	return nil
+}
+
+// preparedDirs returns the directories of prepared transactions by ID.
+func (b *KVDiskvTxn) preparedDirs() (map[string]string, error) {
+	entries, err := os.ReadDir(b.txnPath)
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]string)
+	for _, entry := range entries {
+		dir := filepath.Join(b.txnPath, entry.Name())
+		m, err := readManifest(dir, preparedFile)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("reading prepared transaction %s: %w", entry.Name(), err)
+		}
+		dirs[m.ID] = dir
+	}
+	return dirs, nil
+}
+
+// preparedDir returns the directory of the prepared transaction id.
+func (b *KVDiskvTxn) preparedDir(id string) (string, error) {
+	dirs, err := b.preparedDirs()
+	if err != nil {
+		return "", err
+	}
+	dir, ok := dirs[id]
+	if !ok {
+		return "", fmt.Errorf("prepared transaction not found: %s", id)
+	}
+	return dir, nil
+}
+
+// PreparedTxns returns the IDs of prepared transactions.
+// Note that this includes prepared transactions that are in progress.
+func (b *KVDiskvTxn) PreparedTxns(context.Context) ([]string, error) {
+	dirs, err := b.preparedDirs()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(dirs))
+	for id := range dirs {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// CommitPrepared atomically publishes the prepared transaction id.
+func (b *KVDiskvTxn) CommitPrepared(_ context.Context, id string) error {
+	dir, err := b.preparedDir(id)
+	if err != nil {
+		return err
+	}
+	// mark the prepared manifest as committed
+	if err = os.Rename(filepath.Join(dir, preparedFile), filepath.Join(dir, manifestFile)); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	m, err := readManifest(dir, manifestFile)
+	if err != nil {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+	b.publish.Lock()
+	err = b.apply(dir, m)
+	b.publish.Unlock()
+	if err != nil {
+		return fmt.Errorf("publishing commit: %w", err)
+	}
+	return os.RemoveAll(dir)
+}
+
+// RollbackPrepared discards the prepared transaction id.
+func (b *KVDiskvTxn) RollbackPrepared(_ context.Context, id string) error {
+	dir, err := b.preparedDir(id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,39 @@
+package kvdiskv
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// Rename atomically moves the value of key from to key to in the diskv
+// store by renaming its file. Any value at to is replaced.
+func (b *KVDiskv) Rename(_ context.Context, from, to string) error {
+	if err := b.checkKey("rename", from); err != nil {
+		return err
+	}
+	if err := b.checkKey("rename", to); err != nil {
+		return err
+	}
+	b.publish.Lock()
+	defer b.publish.Unlock()
+	src := b.filename(from)
+	if _, err := os.Stat(src); errors.Is(err, os.ErrNotExist) {
+		return &kv.KeyError{Op: "rename", Key: from, Err: kv.ErrKeyNotFound}
+	} else if err != nil {
+		return &kv.KeyError{Op: "rename", Key: from, Err: err}
+	}
+	if from == to {
+		return nil
+	}
+	if err := b.diskv.Import(src, to, true); err != nil {
+		return &kv.KeyError{Op: "rename", Key: from, Err: err}
+	}
+	// the file was moved: erasing only busts any cached value of from
+	if err := b.diskv.Erase(from); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return &kv.KeyError{Op: "rename", Key: from, Err: err}
+	}
+	return nil
+}
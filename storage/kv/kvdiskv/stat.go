@@ -0,0 +1,57 @@
+package kvdiskv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// filename returns the path of the file holding the value of key.
+func (b *KVDiskv) filename(key string) string {
+	pathKey := b.diskv.AdvancedTransform(key)
+	return filepath.Join(b.diskv.BasePath, filepath.Join(pathKey.Path...), pathKey.FileName)
+}
+
+// statFile returns metadata for key from the file name.
+func statFile(op, key, name string) (*kv.KeyInfo, error) {
+	fi, err := os.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &kv.KeyError{Op: op, Key: key, Err: kv.ErrKeyNotFound}
+	} else if err != nil {
+		return nil, &kv.KeyError{Op: op, Key: key, Err: err}
+	} else if fi.IsDir() {
+		return nil, &kv.KeyError{Op: op, Key: key, Err: kv.ErrKeyNotFound}
+	}
+	return &kv.KeyInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Stat returns metadata about the value of key from its file.
+// The hash of the value is not computed.
+func (b *KVDiskv) Stat(_ context.Context, key string) (*kv.KeyInfo, error) {
+	if err := b.checkKey("stat", key); err != nil {
+		return nil, err
+	}
+	b.publish.RLock()
+	defer b.publish.RUnlock()
+	return statFile("stat", key, b.filename(key))
+}
+
+// Stat returns metadata about the value of key.
+// A previously staged value is considered.
+func (t *txn) Stat(ctx context.Context, key string) (*kv.KeyInfo, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.checkOp("stat", key, false); err != nil {
+		return nil, err
+	}
+	op, ok := t.ops[key]
+	if !ok {
+		return t.b.Stat(ctx, key)
+	} else if op.del {
+		return nil, &kv.KeyError{Op: "stat", Key: key, Err: kv.ErrKeyNotFound}
+	}
+	return statFile("stat", key, filepath.Join(t.dir, op.file))
+}
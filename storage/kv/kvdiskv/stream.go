@@ -0,0 +1,122 @@
+package kvdiskv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// openValue opens a reader of the value at key in the diskv store.
+// Uncompressed values are read directly from their file so that
+// closing the reader closes the file. Otherwise diskv's ReadStream is
+// used which only closes the file once the value is read to EOF.
+func (b *KVDiskv) openValue(key string) (io.ReadCloser, error) {
+	if b.diskv.Compression == nil {
+		f, err := os.Open(b.filename(key))
+		if err != nil {
+			return nil, err
+		}
+		if fi, err := f.Stat(); err != nil {
+			f.Close()
+			return nil, err
+		} else if fi.IsDir() {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		return f, nil
+	}
+	return b.diskv.ReadStream(key, false)
+}
+
+// GetReader returns a reader of the value at key in the diskv store.
+// The reader should be closed when done.
+// If key is not found then a wrapped ErrKeyNotFound will be returned.
+func (b *KVDiskv) GetReader(_ context.Context, key string) (io.ReadCloser, error) {
+	if err := b.checkKey("get", key); err != nil {
+		return nil, err
+	}
+	b.publish.RLock()
+	defer b.publish.RUnlock()
+	r, err := b.openValue(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &kv.KeyError{Op: "get", Key: key, Err: kv.ErrKeyNotFound}
+	} else if err != nil {
+		return nil, &kv.KeyError{Op: "get", Key: key, Err: err}
+	}
+	return r, nil
+}
+
+// SetReader sets key to the value read from r in the diskv store.
+// The value is first read into a temporary file (in diskv's TempDir if
+// configured) so that slow readers do not block transaction commits.
+// It is then written using diskv's WriteStream. Unless diskv is
+// configured with a TempDir a partially written value may be observed
+// (or left on error).
+func (b *KVDiskv) SetReader(_ context.Context, key string, r io.Reader) error {
+	if err := b.checkKey("set", key); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(b.diskv.TempDir, "kvdiskv-")
+	if err != nil {
+		return &kv.KeyError{Op: "set", Key: key, Err: err}
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = io.Copy(f, r); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return &kv.KeyError{Op: "set", Key: key, Err: err}
+	}
+	b.publish.RLock()
+	defer b.publish.RUnlock()
+	if err = b.diskv.WriteStream(key, f, false); err != nil {
+		return &kv.KeyError{Op: "set", Key: key, Err: err}
+	}
+	return nil
+}
+
+// GetReader returns a reader of the value at key.
+// A previously staged value may be returned.
+func (t *txn) GetReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.checkOp("get", key, false); err != nil {
+		return nil, err
+	}
+	op, ok := t.ops[key]
+	if !ok {
+		return t.b.GetReader(ctx, key)
+	} else if op.del {
+		return nil, &kv.KeyError{Op: "get", Key: key, Err: kv.ErrKeyNotFound}
+	}
+	f, err := os.Open(filepath.Join(t.dir, op.file))
+	if err != nil {
+		return nil, &kv.KeyError{Op: "get", Key: key, Err: err}
+	}
+	return f, nil
+}
+
+// SetReader stages key to be set to the value read from r.
+func (t *txn) SetReader(_ context.Context, key string, r io.Reader) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOp("set", key, true); err != nil {
+		return err
+	}
+	file := strconv.Itoa(t.files)
+	if err := copyFileSync(filepath.Join(t.dir, file), r, t.b.diskv.FilePerm); err != nil {
+		return &kv.KeyError{Op: "set", Key: key, Err: err}
+	}
+	t.files++
+	if err := t.unstage(key); err != nil {
+		return &kv.KeyError{Op: "set", Key: key, Err: err}
+	}
+	t.ops[key] = stagedOp{file: file}
+	return nil
+}
@@ -0,0 +1,303 @@
+package kvdiskv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// Commit does nothing: operations on the store itself are auto-committed.
+func (b *KVDiskvTxn) Commit(context.Context) error {
+	return nil
+}
+
+// Rollback does nothing: operations on the store itself are auto-committed.
+func (b *KVDiskvTxn) Rollback(context.Context) error {
+	return nil
+}
+
+// begin starts a new transaction staged in a new transaction directory.
+func (b *KVDiskvTxn) begin(opts *kv.TxnOptions) (*txn, error) {
+	t := &txn{b: b.KVDiskv, ops: make(map[string]stagedOp)}
+	if opts != nil && opts.ReadOnly {
+		t.readOnly = true
+		return t, nil
+	}
+	var err error
+	if t.dir, err = os.MkdirTemp(b.txnPath, "txn-"); err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	return t, nil
+}
+
+// BeginBucketTxn starts a new transaction.
+// Writes are staged on disk and atomically published to the store on
+// commit. Transactions are not isolated from each other: reads see
+// the latest published values and the last commit wins.
+func (b *KVDiskvTxn) BeginBucketTxn(context.Context) (kv.BucketTxnCompleter, error) {
+	return b.begin(nil)
+}
+
+// BeginCRUDBucketTxn starts a new transaction.
+// See BeginBucketTxn.
+func (b *KVDiskvTxn) BeginCRUDBucketTxn(context.Context) (kv.CRUDBucketTxnCompleter, error) {
+	return b.begin(nil)
+}
+
+// BeginKeysPrefixTraversingBucketTxn starts a new transaction.
+// See BeginBucketTxn.
+func (b *KVDiskvTxn) BeginKeysPrefixTraversingBucketTxn(context.Context) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
+	return b.begin(nil)
+}
+
+// BeginBucketTxnWithOptions is like BeginBucketTxn but configures the transaction with opts.
+// Writes to read-only transactions will return an ErrReadOnly error.
+// The isolation level hint and timeout are not used.
+func (b *KVDiskvTxn) BeginBucketTxnWithOptions(_ context.Context, opts *kv.TxnOptions) (kv.BucketTxnCompleter, error) {
+	return b.begin(opts)
+}
+
+// BeginCRUDBucketTxnWithOptions is like BeginCRUDBucketTxn but configures the transaction with opts.
+// See BeginBucketTxnWithOptions.
+func (b *KVDiskvTxn) BeginCRUDBucketTxnWithOptions(_ context.Context, opts *kv.TxnOptions) (kv.CRUDBucketTxnCompleter, error) {
+	return b.begin(opts)
+}
+
+// BeginKeysPrefixTraversingBucketTxnWithOptions is like BeginKeysPrefixTraversingBucketTxn but configures the transaction with opts.
+// See BeginBucketTxnWithOptions.
+func (b *KVDiskvTxn) BeginKeysPrefixTraversingBucketTxnWithOptions(_ context.Context, opts *kv.TxnOptions) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
+	return b.begin(opts)
+}
+
+// stagedOp is a staged operation for a key.
+type stagedOp struct {
+	file string // staged value file name within the transaction directory
+	del  bool   // if true this operation signifies a deletion (of a key)
+}
+
+// txn is a transaction of a KVDiskv.
+// Values are staged as files in the transaction directory.
+type txn struct {
+	b        *KVDiskv
+	dir      string
+	mu       sync.RWMutex
+	ops      map[string]stagedOp
+	files    int // number of staged value files written
+	readOnly bool
+	prepared bool
+	closed   bool
+}
+
+// checkOp returns an error for op on key if key is invalid or t is closed.
+// Write operations are also rejected for read-only or prepared transactions.
+// t.mu should be locked.
+func (t *txn) checkOp(op, key string, write bool) error {
+	if err := t.b.checkKey(op, key); err != nil {
+		return err
+	}
+	var err error
+	if t.closed {
+		err = kv.ErrTxnClosed
+	} else if write && (t.readOnly || t.prepared) {
+		err = kv.ErrReadOnly
+	}
+	if err != nil {
+		return &kv.KeyError{Op: op, Key: key, Err: err}
+	}
+	return nil
+}
+
+// Get retrieves the value at key.
+// A previously staged value may be returned.
+func (t *txn) Get(ctx context.Context, key string) ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.checkOp("get", key, false); err != nil {
+		return nil, err
+	}
+	op, ok := t.ops[key]
+	if !ok {
+		return t.b.Get(ctx, key)
+	} else if op.del {
+		return nil, &kv.KeyError{Op: "get", Key: key, Err: kv.ErrKeyNotFound}
+	}
+	value, err := os.ReadFile(filepath.Join(t.dir, op.file))
+	if err != nil {
+		return nil, &kv.KeyError{Op: "get", Key: key, Err: err}
+	}
+	return value, nil
+}
+
+// Has checks that key can be found.
+// Previously staged operations are considered.
+func (t *txn) Has(ctx context.Context, key string) (bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.checkOp("has", key, false); err != nil {
+		return false, err
+	}
+	if op, ok := t.ops[key]; ok {
+		return !op.del, nil
+	}
+	return t.b.Has(ctx, key)
+}
+
+// unstage removes the staged value file for key, if any.
+// t.mu should be locked.
+func (t *txn) unstage(key string) error {
+	if op, ok := t.ops[key]; ok && !op.del {
+		if err := os.Remove(filepath.Join(t.dir, op.file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set stages key to be set to value.
+func (t *txn) Set(ctx context.Context, key string, value []byte) error {
+	return t.SetReader(ctx, key, bytes.NewReader(value))
+}
+
+// Delete stages key to be deleted.
+func (t *txn) Delete(_ context.Context, key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOp("delete", key, true); err != nil {
+		return err
+	}
+	if err := t.unstage(key); err != nil {
+		return &kv.KeyError{Op: "delete", Key: key, Err: err}
+	}
+	t.ops[key] = stagedOp{del: true}
+	return nil
+}
+
+// Keys returns all keys in the diskv store including staged keys.
+// See KeysPrefix.
+func (t *txn) Keys(ctx context.Context, cancel <-chan struct{}) <-chan string {
+	return t.KeysPrefix(ctx, "", cancel)
+}
+
+// KeysPrefix returns all keys starting with prefix in the diskv store
+// including staged keys (and excluding staged deletes).
+// The returned keys have no ordering guaratees.
+// The keys channel will be closed if cancel was provided and closed.
+func (t *txn) KeysPrefix(ctx context.Context, prefix string, cancel <-chan struct{}) <-chan string {
+	r := make(chan string)
+	t.mu.RLock()
+	if t.closed {
+		t.mu.RUnlock()
+		close(r)
+		return r
+	}
+	// copy the staged operations so we don't hold the lock while sending
+	ops := make(map[string]stagedOp)
+	for k, op := range t.ops {
+		if strings.HasPrefix(k, prefix) {
+			ops[k] = op
+		}
+	}
+	t.mu.RUnlock()
+	go func() {
+		defer close(r)
+		send := func(k string) bool {
+			select {
+			case <-cancel:
+				return false
+			case r <- k:
+				return true
+			}
+		}
+		for k := range t.b.KeysPrefix(ctx, prefix, cancel) {
+			if _, ok := ops[k]; ok {
+				continue
+			}
+			if !send(k) {
+				return
+			}
+		}
+		for k, op := range ops {
+			if !op.del && !send(k) {
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// manifest builds the manifest of the staged operations.
+// t.mu should be locked.
+func (t *txn) manifest(id string) *manifest {
+	m := &manifest{ID: id, Ops: make([]manifestOp, 0, len(t.ops))}
+	for k, op := range t.ops {
+		m.Ops = append(m.Ops, manifestOp{Key: k, File: op.file, Del: op.del})
+	}
+	sort.Slice(m.Ops, func(i, j int) bool { return m.Ops[i].Key < m.Ops[j].Key })
+	return m
+}
+
+// Commit atomically publishes the staged operations to the store.
+// The transaction is marked committed by writing its manifest. Once
+// marked, the operations are published even if publishing is
+// interrupted: incomplete commits are published by NewTxn.
+// Once committed a transaction is closed and can no longer be used.
+func (t *txn) Commit(context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return kv.ErrTxnClosed
+	}
+	if len(t.ops) < 1 {
+		return t.close()
+	}
+
+	m := t.manifest("")
+	if t.prepared {
+		// mark the prepared manifest as committed
+		err := os.Rename(filepath.Join(t.dir, preparedFile), filepath.Join(t.dir, manifestFile))
+		if err != nil {
+			return fmt.Errorf("writing manifest: %w", err)
+		}
+	} else if err := writeManifest(t.dir, manifestFile, m); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+
+	t.b.publish.Lock()
+	err := t.b.apply(t.dir, m)
+	t.b.publish.Unlock()
+	if err != nil {
+		// keep the transaction directory for recovery
+		t.closed = true
+		return fmt.Errorf("publishing commit: %w", err)
+	}
+	return t.close()
+}
+
+// Rollback discards the staged operations.
+// Once rolled back a transaction is closed and can no longer be used.
+func (t *txn) Rollback(context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return kv.ErrTxnClosed
+	}
+	return t.close()
+}
+
+// close closes t and removes the transaction directory.
+// t.mu should be locked.
+func (t *txn) close() error {
+	t.closed = true
+	t.ops = nil
+	if t.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(t.dir)
+}
@@ -0,0 +1,224 @@
+// Package kvhook runs commit hooks for transactional key-value stores.
+package kvhook
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// KVHook wraps a transactional key-value store to run commit hooks.
+// Changes are tracked from the Set and Delete calls of transactions
+// begun from KVHook. Set and Delete calls to KVHook itself auto-commit
+// and run hooks with the single changed key.
+type KVHook struct {
+	kv.TxnBucket
+	mu        sync.RWMutex
+	preHooks  []kv.PreCommitHook
+	postHooks []kv.PostCommitHook
+}
+
+// New creates a new commit hook store wrapping b.
+func New(b kv.TxnBucket) *KVHook {
+	if b == nil {
+		panic("nil store")
+	}
+	return &KVHook{TxnBucket: b}
+}
+
+// AddPreCommitHook registers hook to run before transactions commit.
+// A hook error aborts (rolls back) the commit.
+func (b *KVHook) AddPreCommitHook(hook kv.PreCommitHook) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.preHooks = append(b.preHooks, hook)
+}
+
+// AddPostCommitHook registers hook to run after transactions successfully commit.
+func (b *KVHook) AddPostCommitHook(hook kv.PostCommitHook) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.postHooks = append(b.postHooks, hook)
+}
+
+// hooks returns a copy of the registered hooks.
+func (b *KVHook) hooks() (pre []kv.PreCommitHook, post []kv.PostCommitHook) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	pre = append(pre, b.preHooks...)
+	post = append(post, b.postHooks...)
+	return
+}
+
+// autoCommit runs f surrounded by the hooks for changes.
+func (b *KVHook) autoCommit(ctx context.Context, changes *kv.ChangeSet, f func() error) error {
+	pre, post := b.hooks()
+	if err := runPreCommitHooks(ctx, pre, changes); err != nil {
+		return err
+	}
+	if err := f(); err != nil {
+		return err
+	}
+	runPostCommitHooks(ctx, post, changes)
+	return nil
+}
+
+// Set sets key to value in the wrapped store running the commit hooks.
+func (b *KVHook) Set(ctx context.Context, key string, value []byte) error {
+	changes := &kv.ChangeSet{Set: map[string][]byte{key: value}}
+	return b.autoCommit(ctx, changes, func() error {
+		return b.TxnBucket.Set(ctx, key, value)
+	})
+}
+
+// Delete deletes key in the wrapped store running the commit hooks.
+func (b *KVHook) Delete(ctx context.Context, key string) error {
+	changes := &kv.ChangeSet{Set: make(map[string][]byte), Deleted: []string{key}}
+	return b.autoCommit(ctx, changes, func() error {
+		return b.TxnBucket.Delete(ctx, key)
+	})
+}
+
+// BeginBucketTxn begins a transaction in the wrapped store.
+// The transaction runs the hooks registered when it began.
+func (b *KVHook) BeginBucketTxn(ctx context.Context) (kv.BucketTxnCompleter, error) {
+	bt, err := b.TxnBucket.BeginBucketTxn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pre, post := b.hooks()
+	return &txn{
+		BucketTxnCompleter: bt,
+		ops:                make(map[string]keyOp),
+		preHooks:           pre,
+		postHooks:          post,
+	}, nil
+}
+
+// BeginCRUDBucketTxn begins a transaction in the wrapped store.
+// The transaction runs the hooks registered when it began.
+func (b *KVHook) BeginCRUDBucketTxn(ctx context.Context) (kv.CRUDBucketTxnCompleter, error) {
+	return b.BeginBucketTxn(ctx)
+}
+
+// BeginKeysPrefixTraversingBucketTxn begins a transaction in the wrapped store.
+// The transaction runs the hooks registered when it began.
+func (b *KVHook) BeginKeysPrefixTraversingBucketTxn(ctx context.Context) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
+	return b.BeginBucketTxn(ctx)
+}
+
+// runPreCommitHooks runs hooks for changes stopping at the first error.
+func runPreCommitHooks(ctx context.Context, hooks []kv.PreCommitHook, changes *kv.ChangeSet) error {
+	for _, hook := range hooks {
+		if err := hook(ctx, changes); err != nil {
+			return fmt.Errorf("pre-commit hook: %w", err)
+		}
+	}
+	return nil
+}
+
+// runPostCommitHooks runs hooks for changes.
+func runPostCommitHooks(ctx context.Context, hooks []kv.PostCommitHook, changes *kv.ChangeSet) {
+	for _, hook := range hooks {
+		hook(ctx, changes)
+	}
+}
+
+type keyOp struct {
+	value []byte
+	del   bool
+}
+
+// txn tracks the changes of a wrapped transaction to run commit hooks.
+type txn struct {
+	kv.BucketTxnCompleter
+	mu        sync.Mutex
+	ops       map[string]keyOp
+	preHooks  []kv.PreCommitHook
+	postHooks []kv.PostCommitHook
+}
+
+// TxnID returns the ID of the wrapped transaction, if it has one.
+func (t *txn) TxnID() string {
+	if ider, ok := t.BucketTxnCompleter.(kv.TxnIDer); ok {
+		return ider.TxnID()
+	}
+	return ""
+}
+
+// Set sets key to value in the wrapped transaction and tracks the change.
+func (t *txn) Set(ctx context.Context, key string, value []byte) error {
+	if err := t.BucketTxnCompleter.Set(ctx, key, value); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ops[key] = keyOp{value: value}
+	return nil
+}
+
+// Delete deletes key in the wrapped transaction and tracks the change.
+func (t *txn) Delete(ctx context.Context, key string) error {
+	if err := t.BucketTxnCompleter.Delete(ctx, key); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ops[key] = keyOp{del: true}
+	return nil
+}
+
+// changeSet builds the change set of the tracked changes.
+func (t *txn) changeSet() *kv.ChangeSet {
+	changes := &kv.ChangeSet{Set: make(map[string][]byte)}
+	for key, op := range t.ops {
+		if op.del {
+			changes.Deleted = append(changes.Deleted, key)
+		} else {
+			changes.Set[key] = op.value
+		}
+	}
+	sort.Strings(changes.Deleted)
+	return changes
+}
+
+// Commit runs the pre-commit hooks then commits the wrapped transaction.
+// A pre-commit hook error rolls back the wrapped transaction.
+// The post-commit hooks are run if the commit succeeds.
+func (t *txn) Commit(ctx context.Context) error {
+	t.mu.Lock()
+	changes := t.changeSet()
+	t.mu.Unlock()
+	if !changes.Empty() {
+		if err := runPreCommitHooks(ctx, t.preHooks, changes); err != nil {
+			if rbErr := t.Rollback(ctx); rbErr != nil {
+				return fmt.Errorf("txn rollback: %w; while trying to handle error: %v", rbErr, err)
+			}
+			return err
+		}
+	}
+	if err := t.BucketTxnCompleter.Commit(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.ops = make(map[string]keyOp)
+	t.mu.Unlock()
+	if !changes.Empty() {
+		runPostCommitHooks(ctx, t.postHooks, changes)
+	}
+	return nil
+}
+
+// Rollback rolls back the wrapped transaction and discards the tracked changes.
+func (t *txn) Rollback(ctx context.Context) error {
+	if err := t.BucketTxnCompleter.Rollback(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ops = make(map[string]keyOp)
+	return nil
+}
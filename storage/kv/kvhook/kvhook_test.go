@@ -0,0 +1,19 @@
+package kvhook
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/kvtxn"
+	"github.com/micromdm/nanolib/storage/kv/test"
+)
+
+func TestKVHook(t *testing.T) {
+	b := New(kvtxn.New(kvmap.New()))
+	ctx := context.Background()
+	test.TestBucketSimple(t, ctx, b)
+	test.TestKeysTraversing(t, ctx, b)
+	test.TestTxnSimple(t, ctx, b, test.WithNoReadAfterRollback())
+	test.TestCommitHooks(t, ctx, b)
+}
@@ -2,44 +2,68 @@ package kvmap
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/micromdm/nanolib/storage/kv"
 )
 
+// checkKey returns an ErrInvalidKey error for op if key is invalid.
+func checkKey(op, key string) error {
+	if key == "" {
+		return &kv.KeyError{Op: op, Key: key, Err: kv.ErrInvalidKey}
+	}
+	return nil
+}
+
 // Get retrieves the value at key in the Go map.
 // If key is not found then a wrapped ErrKeyNotFound will be returned.
 func (s *KVMap) Get(_ context.Context, key string) ([]byte, error) {
+	if err := checkKey("get", key); err != nil {
+		return nil, err
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	v, ok := s.m[key]
-	if !ok {
+	v, ok := s.latest(key)
+	if !ok || v.del {
 		// generate specific error type to comply with interface
-		return nil, fmt.Errorf("%w: %s", kv.ErrKeyNotFound, key)
+		return nil, &kv.KeyError{Op: "get", Key: key, Err: kv.ErrKeyNotFound}
 	}
-	return v, nil
+	return v.value, nil
 }
 
 // Set sets key to value in the Go map.
 func (s *KVMap) Set(_ context.Context, key string, value []byte) error {
+	if err := checkKey("set", key); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.m[key] = value
+	s.ts++
+	s.write(key, s.ts, value, false)
 	return nil
 }
 
 // Has checks that key is found in the Go map.
 func (s *KVMap) Has(_ context.Context, key string) (bool, error) {
+	if err := checkKey("has", key); err != nil {
+		return false, err
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	_, ok := s.m[key]
-	return ok, nil
+	v, ok := s.latest(key)
+	return ok && !v.del, nil
 }
 
 // Delete deletes key in the Go map.
 func (s *KVMap) Delete(_ context.Context, key string) error {
+	if err := checkKey("delete", key); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.m, key)
+	if v, ok := s.latest(key); !ok || v.del {
+		return nil
+	}
+	s.ts++
+	s.write(key, s.ts, nil, true)
 	return nil
 }
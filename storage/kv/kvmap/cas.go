@@ -0,0 +1,27 @@
+package kvmap
+
+import (
+	"bytes"
+	"context"
+)
+
+// CompareAndSwap sets key to value in the Go map only if key currently holds old.
+// A nil old means that key must not exist. A nil value deletes key.
+func (s *KVMap) CompareAndSwap(_ context.Context, key string, old, value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.latest(key)
+	ok = ok && !v.del
+	cur := v.value
+	if old == nil && ok {
+		return false, nil
+	} else if old != nil && (!ok || !bytes.Equal(cur, old)) {
+		return false, nil
+	}
+	if value == nil && !ok {
+		return true, nil
+	}
+	s.ts++
+	s.write(key, s.ts, value, value == nil)
+	return true, nil
+}
@@ -0,0 +1,48 @@
+package kvmap
+
+import (
+	"context"
+	"strings"
+)
+
+// CountPrefix returns the number of keys starting with prefix in the Go map.
+// The count of all keys (an empty prefix) and of counted prefixes (see
+// WithCountedPrefixes) is maintained as keys are written. Otherwise the
+// keys of the map are iterated.
+func (s *KVMap) CountPrefix(_ context.Context, prefix string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if prefix == "" {
+		return s.count, nil
+	} else if u, ok := s.prefixes[prefix]; ok {
+		return u.count, nil
+	}
+	var n int
+	for k := range s.m {
+		if v, ok := s.latest(k); ok && !v.del && strings.HasPrefix(k, prefix) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// SizePrefix returns the total size of the values of keys starting
+// with prefix in the Go map. The size of all values (an empty prefix)
+// and of counted prefixes (see WithCountedPrefixes) is maintained as
+// keys are written. Otherwise the keys of the map are iterated.
+func (s *KVMap) SizePrefix(_ context.Context, prefix string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if prefix == "" {
+		return s.size, nil
+	} else if u, ok := s.prefixes[prefix]; ok {
+		return u.size, nil
+	}
+	var size int64
+	for k := range s.m {
+		if v, ok := s.latest(k); ok && !v.del && strings.HasPrefix(k, prefix) {
+			size += int64(len(v.value))
+		}
+	}
+	return size, nil
+}
@@ -29,6 +29,9 @@ func (b *KVMap) KeysPrefix(_ context.Context, prefix string, cancel <-chan struc
 			if prefix != "" && !strings.HasPrefix(k, prefix) {
 				continue
 			}
+			if v, _ := b.latest(k); v.del {
+				continue
+			}
 			select {
 			case <-cancel:
 				return
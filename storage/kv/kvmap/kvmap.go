@@ -2,16 +2,161 @@
 package kvmap
 
 import (
+	"strings"
 	"sync"
+	"time"
 )
 
+// version is a committed value of a key.
+type version struct {
+	ts    uint64 // commit timestamp
+	value []byte
+	del   bool      // if true this version signifies a deletion (of a key)
+	mod   time.Time // when the value was written
+}
+
 // KVMap is an in-memory key-value store backed by a Go map.
+// Multiple versions of keys are kept to support snapshot transactions.
+// Versions no longer visible to any transaction are garbage collected.
 type KVMap struct {
-	mu sync.RWMutex
-	m  map[string][]byte
+	mu        sync.RWMutex
+	m         map[string][]version // versions of each key, oldest first
+	ts        uint64               // latest commit timestamp
+	snapshots map[uint64]int       // number of active transactions by snapshot timestamp
+	active    []uint64             // sorted snapshot timestamps of active transactions
+	count     int                  // number of (latest, undeleted) keys
+	size      int64                // total size of the latest values
+	prefixes  map[string]*usage    // usage of keys starting with counted prefixes
+}
+
+// usage is the number of keys and the total size of their values.
+type usage struct {
+	count int
+	size  int64
+}
+
+// Option configures a KVMap.
+type Option func(*KVMap)
+
+// WithCountedPrefixes maintains the number of keys and total size of
+// values of keys starting with each of prefixes as keys are written.
+// CountPrefix and SizePrefix of these prefixes then do not iterate the
+// keys of the map. Each write is accounted to every matching prefix.
+func WithCountedPrefixes(prefixes ...string) Option {
+	return func(s *KVMap) {
+		for _, prefix := range prefixes {
+			if prefix != "" {
+				s.prefixes[prefix] = &usage{}
+			}
+		}
+	}
 }
 
 // New creates a new in-memory key-value store.
-func New() *KVMap {
-	return &KVMap{m: make(map[string][]byte)}
+func New(opts ...Option) *KVMap {
+	s := &KVMap{
+		m:         make(map[string][]version),
+		snapshots: make(map[uint64]int),
+		prefixes:  make(map[string]*usage),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// latest returns the latest version of key.
+// s.mu should be locked.
+func (s *KVMap) latest(key string) (version, bool) {
+	vs := s.m[key]
+	if len(vs) < 1 {
+		return version{}, false
+	}
+	return vs[len(vs)-1], true
+}
+
+// read returns the value of key visible at snapshot timestamp ts.
+// s.mu should be locked.
+func (s *KVMap) read(key string, ts uint64) ([]byte, bool) {
+	v, ok := s.readVersion(key, ts)
+	return v.value, ok
+}
+
+// readVersion returns the version of key visible at snapshot timestamp ts.
+// False is returned if key is not found (or deleted) at ts.
+// s.mu should be locked.
+func (s *KVMap) readVersion(key string, ts uint64) (version, bool) {
+	vs := s.m[key]
+	for i := len(vs) - 1; i >= 0; i-- {
+		if vs[i].ts <= ts {
+			return vs[i], !vs[i].del
+		}
+	}
+	return version{}, false
+}
+
+// account adds n keys with values totaling size to the usage of key.
+// s.mu should be locked.
+func (s *KVMap) account(key string, n int, size int64) {
+	s.count += n
+	s.size += size
+	for prefix, u := range s.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			u.count += n
+			u.size += size
+		}
+	}
+}
+
+// write adds a new version of key at timestamp ts.
+// s.mu should be locked.
+func (s *KVMap) write(key string, ts uint64, value []byte, del bool) {
+	if v, ok := s.latest(key); ok && !v.del {
+		s.account(key, -1, -int64(len(v.value)))
+	}
+	if !del {
+		s.account(key, 1, int64(len(value)))
+	}
+	s.m[key] = append(s.m[key], version{ts: ts, value: value, del: del, mod: time.Now()})
+	s.gcKey(key, s.active)
+}
+
+// gcKey removes versions of key that are not visible to any of the
+// sorted snapshots. The latest version is always kept unless it is
+// a deletion that no snapshot needs for conflict detection.
+// s.mu should be locked.
+func (s *KVMap) gcKey(key string, snapshots []uint64) {
+	vs := s.m[key]
+	var kept []version
+	j := 0
+	for i, v := range vs {
+		if i == len(vs)-1 {
+			kept = append(kept, v)
+			break
+		}
+		// keep v if a snapshot is before the next version
+		for j < len(snapshots) && snapshots[j] < v.ts {
+			j++
+		}
+		if j < len(snapshots) && snapshots[j] < vs[i+1].ts {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == 1 && kept[0].del && (len(snapshots) < 1 || snapshots[0] >= kept[0].ts) {
+		delete(s.m, key)
+		return
+	}
+	if len(kept) < len(vs) {
+		s.m[key] = kept
+	}
+}
+
+// GC removes the versions of all keys that are no longer visible to
+// any transaction. Versions are also collected as keys are written.
+func (s *KVMap) GC() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.m {
+		s.gcKey(key, s.active)
+	}
 }
@@ -1,14 +1,250 @@
 package kvmap
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"testing"
 
+	"github.com/micromdm/nanolib/storage/kv"
 	"github.com/micromdm/nanolib/storage/kv/test"
 )
 
 func TestKVMap(t *testing.T) {
 	ctx := context.Background()
 	test.TestBucketSimple(t, ctx, New())
+	test.TestErrors(t, ctx, New())
 	test.TestKeysTraversing(t, ctx, New())
+	test.TestCompareAndSwap(t, ctx, New())
+	test.TestTxnSimple(t, ctx, New(), test.WithNoReadAfterRollback())
+	test.TestTxnLifecycle(t, ctx, New())
+	test.TestTxnReadOnly(t, ctx, New())
+	test.TestKVTxnKeys(t, ctx, New())
+	t.Run("TestErrorsTxn", func(t *testing.T) {
+		bt, err := New().BeginCRUDBucketTxn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.TestErrors(t, ctx, bt)
+	})
+}
+
+func TestKVMapSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	err := kv.SetMap(ctx, s, map[string][]byte{
+		"key_1": []byte("val_1"),
+		"key_2": []byte("val_2"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bt, err := s.BeginBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// change the store after the transaction began
+	if err = s.Set(ctx, "key_1", []byte("val_1_new")); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Delete(ctx, "key_2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Set(ctx, "key_3", []byte("val_3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the transaction still sees its snapshot
+	value, err := bt.Get(ctx, "key_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := value, []byte("val_1"); !bytes.Equal(have, want) {
+		t.Errorf("have: %s, want: %s", have, want)
+	}
+	if found, err := bt.Has(ctx, "key_2"); err != nil || !found {
+		t.Errorf("expected key_2 to be found: %v", err)
+	}
+	if found, err := bt.Has(ctx, "key_3"); err != nil || found {
+		t.Errorf("expected key_3 to not be found: %v", err)
+	}
+	if have, want := kv.AllKeys(ctx, bt), []string{"key_1", "key_2"}; !equalKeys(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// and the store sees the latest values
+	if have, want := kv.AllKeys(ctx, s), []string{"key_1", "key_3"}; !equalKeys(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	if err = bt.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func equalKeys(a, b []string) bool {
+	m := make(map[string]int)
+	for _, k := range a {
+		m[k]++
+	}
+	for _, k := range b {
+		m[k]--
+	}
+	for _, n := range m {
+		if n != 0 {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+func TestKVMapConflict(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	bt1, _ := s.BeginBucketTxn(ctx)
+	bt2, _ := s.BeginBucketTxn(ctx)
+
+	if err := bt1.Set(ctx, "key", []byte("val_1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt1.Set(ctx, "other_key", []byte("val_1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt2.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt2.Set(ctx, "key", []byte("val_2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first committer wins
+	if err := bt2.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err := bt1.Commit(ctx)
+	if !errors.Is(err, kv.ErrConflict) {
+		t.Fatalf("expected conflict error, have: %v", err)
+	}
+	var keyErr *kv.KeyError
+	if !errors.As(err, &keyErr) || keyErr.Key != "key" {
+		t.Errorf("expected KeyError for key, have: %v", err)
+	}
+
+	// nothing from the conflicting transaction was applied
+	value, err := s.Get(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := value, []byte("val_2"); !bytes.Equal(have, want) {
+		t.Errorf("have: %s, want: %s", have, want)
+	}
+	if found, err := s.Has(ctx, "other_key"); err != nil || found {
+		t.Errorf("expected other_key to not be found: %v", err)
+	}
+
+	// reading a key changed by another commit is not a conflict
+	bt1, _ = s.BeginBucketTxn(ctx)
+	if _, err = bt1.Get(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Set(ctx, "key", []byte("val_3")); err != nil {
+		t.Fatal(err)
+	}
+	if err = bt1.Set(ctx, "other_key", []byte("val_1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = bt1.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKVMapGC(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	versions := func(key string) int {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return len(s.m[key])
+	}
+
+	for _, v := range []string{"val_1", "val_2", "val_3"} {
+		if err := s.Set(ctx, "key", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// without transactions only the latest version is kept
+	if have, want := versions("key"), 1; have != want {
+		t.Errorf("have: %d, want: %d versions", have, want)
+	}
+
+	bt, _ := s.BeginBucketTxn(ctx)
+	for _, v := range []string{"val_4", "val_5"} {
+		if err := s.Set(ctx, "key", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	// the version visible to the transaction is kept
+	if have, want := versions("key"), 2; have != want {
+		t.Errorf("have: %d, want: %d versions", have, want)
+	}
+	value, err := bt.Get(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := value, []byte("val_3"); !bytes.Equal(have, want) {
+		t.Errorf("have: %s, want: %s", have, want)
+	}
+
+	if err = bt.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.GC()
+	// deleted keys are removed once no longer visible
+	if have, want := versions("key"), 0; have != want {
+		t.Errorf("have: %d, want: %d versions", have, want)
+	}
+	if have, want := len(s.snapshots), 0; have != want {
+		t.Errorf("have: %d, want: %d snapshots", have, want)
+	}
+	if have, want := len(s.active), 0; have != want {
+		t.Errorf("have: %d, want: %d active snapshots", have, want)
+	}
+}
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	test.TestStat(t, ctx, s)
+
+	bt := s.begin(nil)
+	test.TestStat(t, ctx, bt)
+	if err := bt.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCountSize(t *testing.T) {
+	ctx := context.Background()
+	test.TestCountSize(t, ctx, New())
+
+	s := New(WithCountedPrefixes("test_count.", "test_count.c.", "test_none."))
+	test.TestCountSize(t, ctx, s)
+	bt := s.begin(nil)
+	if err := bt.Set(ctx, "test_count.c.e", []byte("eeeee")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if u := s.prefixes["test_count.c."]; u.count != 1 || u.size != 5 {
+		t.Errorf("have: %d keys of %d bytes, want: 1 key of 5 bytes", u.count, u.size)
+	}
 }
@@ -0,0 +1,65 @@
+package kvmap
+
+import (
+	"context"
+	"strings"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// DeletePrefix deletes all keys starting with prefix in the Go map.
+// The keys are deleted atomically.
+func (s *KVMap) DeletePrefix(_ context.Context, prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.m {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if v, ok := s.latest(k); ok && !v.del {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) < 1 {
+		return nil
+	}
+	s.ts++
+	for _, k := range keys {
+		s.write(k, s.ts, nil, true)
+	}
+	return nil
+}
+
+// DeletePrefix deletes all keys starting with prefix in the transaction.
+// Keys are deleted as of the transaction snapshot and are subject to
+// conflict detection at commit like any other deleted key.
+func (t *txn) DeletePrefix(_ context.Context, prefix string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var err error
+	if t.closed {
+		err = kv.ErrTxnClosed
+	} else if t.readOnly {
+		err = kv.ErrReadOnly
+	}
+	if err != nil {
+		return &kv.KeyError{Op: "delete prefix", Key: prefix, Err: err}
+	}
+	t.s.mu.RLock()
+	for k := range t.s.m {
+		if _, written := t.writes[k]; written || !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if _, ok := t.s.read(k, t.ts); ok {
+			t.writes[k] = version{del: true}
+		}
+	}
+	t.s.mu.RUnlock()
+	for k, v := range t.writes {
+		if !v.del && strings.HasPrefix(k, prefix) {
+			t.writes[k] = version{del: true}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package kvmap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/test"
+)
+
+func TestDeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	test.TestDeletePrefix(t, ctx, s)
+
+	err := kv.SetMap(ctx, s, map[string][]byte{
+		"dp.1": []byte("1"),
+		"dp.2": []byte("2"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, commit := range []bool{false, true} {
+		bt := s.begin(nil)
+		if err = bt.Set(ctx, "dp.3", []byte("3")); err != nil {
+			t.Fatal(err)
+		}
+		if err = bt.DeletePrefix(ctx, "dp."); err != nil {
+			t.Fatal(err)
+		}
+		if have := kv.AllKeysPrefix(ctx, bt, "dp."); len(have) > 0 {
+			t.Errorf("expected no keys in transaction, have: %v", have)
+		}
+		// not yet visible outside of the transaction
+		if have, want := len(kv.AllKeysPrefix(ctx, s, "dp.")), 2; have != want {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+		if commit {
+			err = bt.Commit(ctx)
+		} else {
+			err = bt.Rollback(ctx)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if have := kv.AllKeysPrefix(ctx, s, "dp."); len(have) > 0 {
+		t.Errorf("expected no keys, have: %v", have)
+	}
+}
+
+func TestRename(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	test.TestRename(t, ctx, s)
+
+	bt := s.begin(nil)
+	test.TestRename(t, ctx, bt)
+	if err := bt.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,125 @@
+package kvmap
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// Rename atomically moves the value of key from to key to in the Go map.
+// Any value at to is replaced.
+func (s *KVMap) Rename(_ context.Context, from, to string) error {
+	if err := checkKey("rename", from); err != nil {
+		return err
+	}
+	if err := checkKey("rename", to); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.latest(from)
+	if !ok || v.del {
+		return &kv.KeyError{Op: "rename", Key: from, Err: kv.ErrKeyNotFound}
+	}
+	if from == to {
+		return nil
+	}
+	s.ts++
+	s.write(to, s.ts, v.value, false)
+	s.write(from, s.ts, nil, true)
+	return nil
+}
+
+// Rename moves the value of key from to key to in the transaction.
+// Any value at to is replaced.
+func (t *txn) Rename(_ context.Context, from, to string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOp("rename", from, true); err != nil {
+		return err
+	}
+	if err := t.checkOp("rename", to, true); err != nil {
+		return err
+	}
+	value, ok := t.get(from)
+	if !ok {
+		return &kv.KeyError{Op: "rename", Key: from, Err: kv.ErrKeyNotFound}
+	}
+	if from != to {
+		t.writes[to] = version{value: value, mod: time.Now()}
+		t.writes[from] = version{del: true}
+	}
+	return nil
+}
+
+// RenamePrefix atomically moves the values of all keys starting with
+// from to keys starting with to instead in the Go map.
+// The prefixes must not overlap (one being the prefix of the other).
+func (s *KVMap) RenamePrefix(_ context.Context, from, to string) error {
+	if strings.HasPrefix(from, to) || strings.HasPrefix(to, from) {
+		return &kv.KeyError{Op: "rename prefix", Key: to, Err: kv.ErrInvalidKey}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	moves := make(map[string][]byte)
+	for k := range s.m {
+		if !strings.HasPrefix(k, from) {
+			continue
+		}
+		if v, ok := s.latest(k); ok && !v.del {
+			moves[k] = v.value
+		}
+	}
+	if len(moves) < 1 {
+		return nil
+	}
+	s.ts++
+	for k, value := range moves {
+		s.write(to+k[len(from):], s.ts, value, false)
+		s.write(k, s.ts, nil, true)
+	}
+	return nil
+}
+
+// RenamePrefix moves the values of all keys starting with from to keys
+// starting with to instead in the transaction.
+// The prefixes must not overlap (one being the prefix of the other).
+func (t *txn) RenamePrefix(_ context.Context, from, to string) error {
+	if strings.HasPrefix(from, to) || strings.HasPrefix(to, from) {
+		return &kv.KeyError{Op: "rename prefix", Key: to, Err: kv.ErrInvalidKey}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var err error
+	if t.closed {
+		err = kv.ErrTxnClosed
+	} else if t.readOnly {
+		err = kv.ErrReadOnly
+	}
+	if err != nil {
+		return &kv.KeyError{Op: "rename prefix", Key: from, Err: err}
+	}
+	moves := make(map[string][]byte)
+	t.s.mu.RLock()
+	for k := range t.s.m {
+		if _, written := t.writes[k]; written || !strings.HasPrefix(k, from) {
+			continue
+		}
+		if value, ok := t.s.read(k, t.ts); ok {
+			moves[k] = value
+		}
+	}
+	t.s.mu.RUnlock()
+	for k, v := range t.writes {
+		if !v.del && strings.HasPrefix(k, from) {
+			moves[k] = v.value
+		}
+	}
+	for k, value := range moves {
+		t.writes[to+k[len(from):]] = version{value: value, mod: time.Now()}
+		t.writes[k] = version{del: true}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package kvmap
+
+import (
+	"context"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// Stat returns metadata about the value of key in the Go map.
+// The modification time is the time the value was committed.
+func (s *KVMap) Stat(_ context.Context, key string) (*kv.KeyInfo, error) {
+	if err := checkKey("stat", key); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.latest(key)
+	if !ok || v.del {
+		return nil, &kv.KeyError{Op: "stat", Key: key, Err: kv.ErrKeyNotFound}
+	}
+	return kv.NewKeyInfo(key, v.value, v.mod), nil
+}
+
+// Stat returns metadata about the value of key as of the transaction snapshot.
+// Values written in the transaction are considered: their modification
+// time is the time they were written in the transaction.
+func (t *txn) Stat(_ context.Context, key string) (*kv.KeyInfo, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.checkOp("stat", key, false); err != nil {
+		return nil, err
+	}
+	v, ok := t.writes[key]
+	if !ok {
+		t.s.mu.RLock()
+		v, ok = t.s.readVersion(key, t.ts)
+		t.s.mu.RUnlock()
+	} else {
+		ok = !v.del
+	}
+	if !ok {
+		return nil, &kv.KeyError{Op: "stat", Key: key, Err: kv.ErrKeyNotFound}
+	}
+	return kv.NewKeyInfo(key, v.value, v.mod), nil
+}
@@ -0,0 +1,281 @@
+package kvmap
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// Commit does nothing: operations on the store itself are auto-committed.
+func (s *KVMap) Commit(context.Context) error {
+	return nil
+}
+
+// Rollback does nothing: operations on the store itself are auto-committed.
+func (s *KVMap) Rollback(context.Context) error {
+	return nil
+}
+
+// begin starts a new snapshot transaction.
+func (s *KVMap) begin(opts *kv.TxnOptions) *txn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshots[s.ts]++; s.snapshots[s.ts] == 1 {
+		// the timestamp only increases so the snapshots stay sorted
+		s.active = append(s.active, s.ts)
+	}
+	t := &txn{
+		s:      s,
+		ts:     s.ts,
+		writes: make(map[string]version),
+	}
+	if opts != nil {
+		t.readOnly = opts.ReadOnly
+	}
+	return t
+}
+
+// BeginBucketTxn starts a new snapshot transaction.
+// Reads in the transaction see the store as of when it began. Commit
+// returns an ErrConflict error if a key written in the transaction was
+// committed by another transaction after it began (first-committer-wins).
+func (s *KVMap) BeginBucketTxn(context.Context) (kv.BucketTxnCompleter, error) {
+	return s.begin(nil), nil
+}
+
+// BeginCRUDBucketTxn starts a new snapshot transaction.
+// See BeginBucketTxn.
+func (s *KVMap) BeginCRUDBucketTxn(context.Context) (kv.CRUDBucketTxnCompleter, error) {
+	return s.begin(nil), nil
+}
+
+// BeginKeysPrefixTraversingBucketTxn starts a new snapshot transaction.
+// See BeginBucketTxn.
+func (s *KVMap) BeginKeysPrefixTraversingBucketTxn(context.Context) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
+	return s.begin(nil), nil
+}
+
+// BeginBucketTxnWithOptions is like BeginBucketTxn but configures the transaction with opts.
+// Writes to read-only transactions will return an ErrReadOnly error.
+// The isolation level hint and timeout are not used.
+func (s *KVMap) BeginBucketTxnWithOptions(_ context.Context, opts *kv.TxnOptions) (kv.BucketTxnCompleter, error) {
+	return s.begin(opts), nil
+}
+
+// BeginCRUDBucketTxnWithOptions is like BeginCRUDBucketTxn but configures the transaction with opts.
+// See BeginBucketTxnWithOptions.
+func (s *KVMap) BeginCRUDBucketTxnWithOptions(_ context.Context, opts *kv.TxnOptions) (kv.CRUDBucketTxnCompleter, error) {
+	return s.begin(opts), nil
+}
+
+// BeginKeysPrefixTraversingBucketTxnWithOptions is like BeginKeysPrefixTraversingBucketTxn but configures the transaction with opts.
+// See BeginBucketTxnWithOptions.
+func (s *KVMap) BeginKeysPrefixTraversingBucketTxnWithOptions(_ context.Context, opts *kv.TxnOptions) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
+	return s.begin(opts), nil
+}
+
+// txn is a snapshot transaction of a KVMap.
+// Writes are buffered in the transaction until commit.
+type txn struct {
+	s        *KVMap
+	ts       uint64 // snapshot timestamp
+	mu       sync.RWMutex
+	writes   map[string]version
+	readOnly bool
+	closed   bool
+}
+
+// checkOp returns an error for op on key if key is invalid or t is closed.
+// Write operations are also rejected for read-only transactions.
+// t.mu should be locked.
+func (t *txn) checkOp(op, key string, write bool) error {
+	var err error
+	if key == "" {
+		err = kv.ErrInvalidKey
+	} else if t.closed {
+		err = kv.ErrTxnClosed
+	} else if write && t.readOnly {
+		err = kv.ErrReadOnly
+	}
+	if err != nil {
+		return &kv.KeyError{Op: op, Key: key, Err: err}
+	}
+	return nil
+}
+
+// get returns the value of key as seen by t.
+// t.mu should be locked.
+func (t *txn) get(key string) ([]byte, bool) {
+	if v, ok := t.writes[key]; ok {
+		return v.value, !v.del
+	}
+	t.s.mu.RLock()
+	defer t.s.mu.RUnlock()
+	return t.s.read(key, t.ts)
+}
+
+// Get retrieves the value at key as of the transaction snapshot.
+// Values written in the transaction are returned.
+func (t *txn) Get(_ context.Context, key string) ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.checkOp("get", key, false); err != nil {
+		return nil, err
+	}
+	value, ok := t.get(key)
+	if !ok {
+		return nil, &kv.KeyError{Op: "get", Key: key, Err: kv.ErrKeyNotFound}
+	}
+	return value, nil
+}
+
+// Has checks that key is found as of the transaction snapshot.
+// Values written in the transaction are considered.
+func (t *txn) Has(_ context.Context, key string) (bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.checkOp("has", key, false); err != nil {
+		return false, err
+	}
+	_, ok := t.get(key)
+	return ok, nil
+}
+
+// Set sets key to value in the transaction.
+func (t *txn) Set(_ context.Context, key string, value []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOp("set", key, true); err != nil {
+		return err
+	}
+	t.writes[key] = version{value: value, mod: time.Now()}
+	return nil
+}
+
+// Delete deletes key in the transaction.
+func (t *txn) Delete(_ context.Context, key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOp("delete", key, true); err != nil {
+		return err
+	}
+	t.writes[key] = version{del: true}
+	return nil
+}
+
+// Keys returns all keys as of the transaction snapshot.
+// See KeysPrefix.
+func (t *txn) Keys(ctx context.Context, cancel <-chan struct{}) <-chan string {
+	return t.KeysPrefix(ctx, "", cancel)
+}
+
+// KeysPrefix returns all keys starting with prefix as of the transaction snapshot.
+// Keys written in the transaction are considered.
+// The returned keys have no ordering guaratees.
+// The keys channel will be closed if cancel was provided and closed.
+// Unlike the store itself, no locks are held while sending keys.
+func (t *txn) KeysPrefix(_ context.Context, prefix string, cancel <-chan struct{}) <-chan string {
+	var keys []string
+	t.mu.RLock()
+	if !t.closed {
+		t.s.mu.RLock()
+		for k := range t.s.m {
+			if _, written := t.writes[k]; written || !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			if _, ok := t.s.read(k, t.ts); ok {
+				keys = append(keys, k)
+			}
+		}
+		t.s.mu.RUnlock()
+		for k, v := range t.writes {
+			if !v.del && strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	t.mu.RUnlock()
+
+	r := make(chan string)
+	go func() {
+		defer close(r)
+		for _, k := range keys {
+			select {
+			case <-cancel:
+				return
+			case r <- k:
+			}
+		}
+	}()
+	return r
+}
+
+// close releases the transaction snapshot.
+// t.mu and t.s.mu should be locked.
+func (t *txn) close() {
+	t.closed = true
+	t.writes = nil
+	if t.s.snapshots[t.ts]--; t.s.snapshots[t.ts] < 1 {
+		delete(t.s.snapshots, t.ts)
+		for i, ts := range t.s.active {
+			if ts == t.ts {
+				t.s.active = append(t.s.active[:i], t.s.active[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Commit atomically applies the transaction writes to the store.
+// If any written key was committed after the transaction began then
+// nothing is applied and an ErrConflict error is returned.
+// Either way the transaction is closed.
+func (t *txn) Commit(context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return kv.ErrTxnClosed
+	}
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+
+	keys := make([]string, 0, len(t.writes))
+	for k := range t.writes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if v, ok := t.s.latest(k); ok && v.ts > t.ts {
+			t.close()
+			return &kv.KeyError{Op: "commit", Key: k, Err: kv.ErrConflict}
+		}
+	}
+
+	writes := t.writes
+	t.close()
+	if len(keys) > 0 {
+		t.s.ts++
+		for _, k := range keys {
+			t.s.write(k, t.s.ts, writes[k].value, writes[k].del)
+		}
+	}
+	return nil
+}
+
+// Rollback discards the transaction writes and closes the transaction.
+func (t *txn) Rollback(context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return kv.ErrTxnClosed
+	}
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	t.close()
+	return nil
+}
@@ -2,28 +2,62 @@ package kvprefix
 
 import (
 	"context"
+	"strings"
+
+	"github.com/micromdm/nanolib/storage/kv"
 )
 
+// checkKey returns an ErrInvalidKey error for op if key is invalid.
+// An empty key would refer to the prefix itself and is invalid.
+func checkKey(op, key string) error {
+	if key == "" {
+		return &kv.KeyError{Op: op, Key: key, Err: kv.ErrInvalidKey}
+	}
+	return nil
+}
+
+// unprefixErr removes the prefix from the key of a *kv.KeyError.
+func (b *KVPrefix) unprefixErr(err error) error {
+	if keyErr, ok := err.(*kv.KeyError); ok && strings.HasPrefix(keyErr.Key, b.prefix) {
+		return &kv.KeyError{Op: keyErr.Op, Key: keyErr.Key[len(b.prefix):], Err: keyErr.Err}
+	}
+	return err
+}
+
 // Get retrieves the value at key in the underlying store.
 // The key is preprended with the prefix.
 func (b *KVPrefix) Get(ctx context.Context, key string) ([]byte, error) {
-	return b.store.Get(ctx, b.prefix+key)
+	if err := checkKey("get", key); err != nil {
+		return nil, err
+	}
+	value, err := b.store.Get(ctx, b.prefix+key)
+	return value, b.unprefixErr(err)
 }
 
 // Set sets key to value in the underlying store.
 // The key is preprended with the prefix.
 func (b *KVPrefix) Set(ctx context.Context, key string, value []byte) error {
-	return b.store.Set(ctx, b.prefix+key, value)
+	if err := checkKey("set", key); err != nil {
+		return err
+	}
+	return b.unprefixErr(b.store.Set(ctx, b.prefix+key, value))
 }
 
 // Has checks that key is found the underlying store.
 // The key is preprended with the prefix.
 func (b *KVPrefix) Has(ctx context.Context, key string) (bool, error) {
-	return b.store.Has(ctx, b.prefix+key)
+	if err := checkKey("has", key); err != nil {
+		return false, err
+	}
+	found, err := b.store.Has(ctx, b.prefix+key)
+	return found, b.unprefixErr(err)
 }
 
 // Delete deletes key the underlying store.
 // The key is preprended with the prefix.
 func (b *KVPrefix) Delete(ctx context.Context, key string) error {
-	return b.store.Delete(ctx, b.prefix+key)
+	if err := checkKey("delete", key); err != nil {
+		return err
+	}
+	return b.unprefixErr(b.store.Delete(ctx, b.prefix+key))
 }
@@ -0,0 +1,21 @@
+package kvprefix
+
+import (
+	"context"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// CountPrefix returns the number of keys starting with prefix in the underlying store.
+// The prefix is preprended with the prefix of b.
+// See kv.CountPrefix for how the keys are counted.
+func (b *KVPrefix) CountPrefix(ctx context.Context, prefix string) (int, error) {
+	return kv.CountPrefix(ctx, b.store, b.prefix+prefix)
+}
+
+// SizePrefix returns the total size of the values of keys starting with prefix in the underlying store.
+// The prefix is preprended with the prefix of b.
+// See kv.SizePrefix for how the size is found.
+func (b *KVPrefix) SizePrefix(ctx context.Context, prefix string) (int64, error) {
+	return kv.SizePrefix(ctx, b.store, b.prefix+prefix)
+}
@@ -12,6 +12,9 @@ type KVPrefix struct {
 }
 
 // New creates a new prefix store.
+// If b is a transaction then the prefix store participates in it: many
+// prefix stores can share the same transaction which is completed in b.
+// See NewTxn for stores that support transactions.
 func New(prefix string, b kv.KeysPrefixTraversingBucket) *KVPrefix {
 	return &KVPrefix{prefix: prefix, store: b}
 }
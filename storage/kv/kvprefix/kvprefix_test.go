@@ -4,7 +4,9 @@ import (
 	"context"
 	"testing"
 
+	"github.com/micromdm/nanolib/storage/kv"
 	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/kvtxn"
 	"github.com/micromdm/nanolib/storage/kv/test"
 )
 
@@ -15,6 +17,7 @@ func TestKVPrefix(t *testing.T) {
 
 	// run the standard kv tests
 	test.TestBucketSimple(t, ctx, prefixBucket1)
+	test.TestErrors(t, ctx, prefixBucket1)
 	test.TestKeysTraversing(t, ctx, New("kvprefix2.", b))
 
 	// set a value in our prefixed store
@@ -32,3 +35,115 @@ func TestKVPrefix(t *testing.T) {
 		t.Errorf("have = %q, want = %q", have, want)
 	}
 }
+
+func TestKVPrefixTxn(t *testing.T) {
+	ctx := context.Background()
+	b := NewTxn("kvprefix.", kvtxn.New(kvmap.New()))
+	test.TestTxnSimple(t, ctx, b, test.WithNoReadAfterRollback())
+	test.TestTxnLifecycle(t, ctx, b)
+	test.TestTxnReadOnly(t, ctx, b)
+	t.Run("TestKVTxnKeys", func(t *testing.T) {
+		test.TestKVTxnKeys(t, ctx, NewTxn("kvprefix.keys.", kvtxn.New(kvmap.New())))
+	})
+
+	// transaction support is detected by interface
+	var plain interface{} = New("kvprefix.", kvtxn.New(kvmap.New()))
+	if _, ok := plain.(kv.BucketTxnBeginner); ok {
+		t.Error("expected store without transaction support")
+	}
+	if _, ok := plain.(kv.TxnCompleter); ok {
+		t.Error("expected store without transaction support")
+	}
+
+	// transactions that cannot begin transactions are prefixed as such
+	bt, err := NewTxn("kvprefix.", kvmap.New()).BeginBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bt.(kv.BucketTxnBeginner); ok {
+		t.Error("expected transaction to not begin transactions")
+	}
+	if err = bt.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKVPrefixTxnNamespaces(t *testing.T) {
+	ctx := context.Background()
+	b := kvmap.New()
+
+	for _, commit := range []bool{false, true} {
+		bt, err := b.BeginBucketTxn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, prefix := range []string{"ns1.", "ns2."} {
+			if err = New(prefix, bt).Set(ctx, "hello", []byte(prefix)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if commit {
+			err = bt.Commit(ctx)
+		} else {
+			err = bt.Rollback(ctx)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, prefix := range []string{"ns1.", "ns2."} {
+			found, err := b.Has(ctx, prefix+"hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != commit {
+				t.Errorf("%s: have: %v, want: %v", prefix, found, commit)
+			}
+		}
+	}
+}
+
+func TestKVPrefixDeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	b := kvmap.New()
+	test.TestDeletePrefix(t, ctx, New("kvprefix1.", b))
+
+	if err := b.Set(ctx, "kvprefix2.test_dp.a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := New("kvprefix1.", b).DeletePrefix(ctx, "test_dp."); err != nil {
+		t.Fatal(err)
+	}
+	found, err := b.Has(ctx, "kvprefix2.test_dp.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("expected key to be found")
+	}
+}
+
+func TestKVPrefixRename(t *testing.T) {
+	ctx := context.Background()
+	test.TestRename(t, ctx, New("kvprefix1.", kvmap.New()))
+	test.TestRename(t, ctx, New("kvprefix1.", struct{ kv.KeysPrefixTraversingBucket }{kvmap.New()}))
+}
+
+func TestKVPrefixStat(t *testing.T) {
+	ctx := context.Background()
+	test.TestStat(t, ctx, New("kvprefix1.", kvmap.New()))
+}
+
+func TestKVPrefixStream(t *testing.T) {
+	ctx := context.Background()
+	test.TestStream(t, ctx, New("kvprefix1.", kvmap.New()))
+}
+
+func TestKVPrefixCountSize(t *testing.T) {
+	ctx := context.Background()
+	b := kvmap.New()
+	if err := b.Set(ctx, "kvprefix2.test_count.a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	test.TestCountSize(t, ctx, New("kvprefix1.", b))
+	test.TestCountSize(t, ctx, New("kvprefix1.", struct{ kv.KeysPrefixTraversingBucket }{kvmap.New()}))
+}
@@ -0,0 +1,176 @@
+package kvprefix
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// DefaultSeparator is the default namespace separator.
+const DefaultSeparator = '/'
+
+// escapeChar starts escape sequences in namespace names.
+const escapeChar = '%'
+
+// Namespace is a hierarchical prefix store.
+// Each namespace has a name (within its parent) and holds keys and
+// child namespaces. Names are escaped and keys are stored distinctly
+// from child namespaces so that the keys of different namespaces never
+// collide. For example with the default separator the key "k" in the
+// namespace "device" of the namespace "tenant" is stored at
+// "tenant/device//k".
+type Namespace struct {
+	*KVPrefix
+	root   kv.KeysPrefixTraversingBucket
+	sep    byte
+	prefix string // the namespace prefix (child namespaces start here)
+	path   []string
+}
+
+type namespaceConfig struct {
+	sep byte
+}
+
+// NamespaceOption configures a Namespace.
+type NamespaceOption func(*namespaceConfig)
+
+// WithSeparator sets the namespace separator to sep.
+// The separator cannot be a byte of escape sequences: the escape
+// character '%' or an uppercase hex digit (0-9 and A-F).
+func WithSeparator(sep byte) NamespaceOption {
+	return func(c *namespaceConfig) {
+		c.sep = sep
+	}
+}
+
+// NewNamespace creates a new root namespace over b.
+// Unless otherwise configured DefaultSeparator is used.
+func NewNamespace(b kv.KeysPrefixTraversingBucket, opts ...NamespaceOption) *Namespace {
+	if b == nil {
+		panic("nil store")
+	}
+	config := &namespaceConfig{sep: DefaultSeparator}
+	for _, opt := range opts {
+		opt(config)
+	}
+	if inEscape(config.sep) {
+		panic("invalid separator")
+	}
+	return newNamespace(b, config.sep, "", nil)
+}
+
+// newNamespace creates a namespace with prefix in root.
+func newNamespace(root kv.KeysPrefixTraversingBucket, sep byte, prefix string, path []string) *Namespace {
+	return &Namespace{
+		KVPrefix: New(prefix+string(sep), root),
+		root:     root,
+		sep:      sep,
+		prefix:   prefix,
+		path:     path,
+	}
+}
+
+// inEscape reports whether c can appear in an escape sequence.
+func inEscape(c byte) bool {
+	return c == escapeChar || ('0' <= c && c <= '9') || ('A' <= c && c <= 'F')
+}
+
+// escape escapes the escape character and the separator in name.
+func (ns *Namespace) escape(name string) string {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c == escapeChar || c == ns.sep {
+			fmt.Fprintf(&sb, "%c%02X", escapeChar, c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// unescape reverses escape.
+func unescape(name string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != escapeChar {
+			sb.WriteByte(name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", fmt.Errorf("invalid escape in name: %s", name)
+		}
+		c, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in name: %s: %w", name, err)
+		}
+		sb.WriteByte(byte(c))
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// Namespace returns the child namespace name of ns.
+// Panics if name is empty.
+func (ns *Namespace) Namespace(name string) *Namespace {
+	if name == "" {
+		panic("empty namespace name")
+	}
+	path := make([]string, len(ns.path), len(ns.path)+1)
+	copy(path, ns.path)
+	return newNamespace(
+		ns.root,
+		ns.sep,
+		ns.prefix+ns.escape(name)+string(ns.sep),
+		append(path, name),
+	)
+}
+
+// Path returns the names of ns and its parents starting at the root.
+// The root namespace has an empty path.
+func (ns *Namespace) Path() []string {
+	path := make([]string, len(ns.path))
+	copy(path, ns.path)
+	return path
+}
+
+// Children returns the sorted names of the immediate child namespaces of ns.
+// Namespaces only exist while they (or their children) contain keys.
+func (ns *Namespace) Children(ctx context.Context) ([]string, error) {
+	cancel := make(chan struct{})
+	defer close(cancel)
+	seen := make(map[string]struct{})
+	var names []string
+	for k := range ns.root.KeysPrefix(ctx, ns.prefix, cancel) {
+		rest := k[len(ns.prefix):]
+		i := strings.IndexByte(rest, ns.sep)
+		if i < 1 {
+			// a key of this namespace (or a key outside of any namespace)
+			continue
+		}
+		if _, ok := seen[rest[:i]]; ok {
+			continue
+		}
+		seen[rest[:i]] = struct{}{}
+		name, err := unescape(rest[:i])
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DeleteNamespace deletes all keys of ns and of all of its child namespaces.
+// Note that deleting the root namespace deletes all keys of the
+// underlying store.
+func (ns *Namespace) DeleteNamespace(ctx context.Context) error {
+	return kv.DeletePrefix(ctx, ns.root, ns.prefix)
+}
@@ -0,0 +1,123 @@
+package kvprefix
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/test"
+)
+
+// expectValue checks that the value of key in b is value.
+func expectValue(t *testing.T, ctx context.Context, b kv.ROBucket, key string, value []byte) {
+	t.Helper()
+	have, err := b.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, value) {
+		t.Errorf("have: %q, want: %q", have, value)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	ctx := context.Background()
+	root := NewNamespace(kvmap.New())
+
+	// run the standard kv tests
+	test.TestBucketSimple(t, ctx, root.Namespace("simple"))
+	test.TestKeysTraversing(t, ctx, root.Namespace("keys"))
+	if err := root.Namespace("simple").DeleteNamespace(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Namespace("keys").DeleteNamespace(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tenant := root.Namespace("tenant")
+	if have, want := tenant.Namespace("device").Path(), []string{"tenant", "device"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// these would all collide with naive prefixing
+	for _, b := range []*KVPrefix{
+		tenant.KVPrefix,
+		tenant.Namespace("device").KVPrefix,
+		tenant.Namespace("device/a").KVPrefix,
+		tenant.Namespace("device%2Fa").KVPrefix,
+		root.Namespace("tenant/device").KVPrefix,
+	} {
+		if err := b.Set(ctx, "a/k", []byte(b.prefix)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tenant.Set(ctx, "device/a/k", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, ctx, tenant.Namespace("device"), "a/k", []byte("tenant/device//"))
+	expectValue(t, ctx, tenant.Namespace("device/a"), "a/k", []byte("tenant/device%2Fa//"))
+
+	names, err := root.Children(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := names, []string{"tenant", "tenant/device"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	names, err = tenant.Children(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := names, []string{"device", "device%2Fa", "device/a"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	if err = tenant.Namespace("device").DeleteNamespace(ctx); err != nil {
+		t.Fatal(err)
+	}
+	names, err = tenant.Children(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := names, []string{"device%2Fa", "device/a"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	expectValue(t, ctx, tenant, "device/a/k", []byte("key"))
+	expectValue(t, ctx, root.Namespace("tenant/device"), "a/k", []byte("tenant%2Fdevice//"))
+
+	// deleting a namespace deletes its children
+	if err = tenant.DeleteNamespace(ctx); err != nil {
+		t.Fatal(err)
+	}
+	names, err = root.Children(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := names, []string{"tenant/device"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
+
+func TestNamespaceSeparator(t *testing.T) {
+	ctx := context.Background()
+	b := kvmap.New()
+	ns := NewNamespace(b, WithSeparator('.')).Namespace("a.b").Namespace("c")
+	if err := ns.Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, ctx, b, "a%2Eb.c..k", []byte("v"))
+
+	for _, sep := range []byte{'%', '0', '9', 'A', 'F'} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic for separator %q", sep)
+				}
+			}()
+			NewNamespace(b, WithSeparator(sep))
+		}()
+	}
+}
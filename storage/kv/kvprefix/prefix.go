@@ -0,0 +1,14 @@
+package kvprefix
+
+import (
+	"context"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// DeletePrefix deletes all keys starting with prefix in the underlying store.
+// The prefix is preprended with the prefix of b.
+// See kv.DeletePrefix for how the keys are deleted.
+func (b *KVPrefix) DeletePrefix(ctx context.Context, prefix string) error {
+	return b.unprefixErr(kv.DeletePrefix(ctx, b.store, b.prefix+prefix))
+}
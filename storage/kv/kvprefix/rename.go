@@ -0,0 +1,28 @@
+package kvprefix
+
+import (
+	"context"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// Rename moves the value of key from to key to in the underlying store.
+// The keys are preprended with the prefix.
+// See kv.Rename for how the key is moved.
+func (b *KVPrefix) Rename(ctx context.Context, from, to string) error {
+	if err := checkKey("rename", from); err != nil {
+		return err
+	}
+	if err := checkKey("rename", to); err != nil {
+		return err
+	}
+	return b.unprefixErr(kv.Rename(ctx, b.store, b.prefix+from, b.prefix+to))
+}
+
+// RenamePrefix moves the values of all keys starting with from to keys
+// starting with to instead in the underlying store.
+// The prefixes are preprended with the prefix of b.
+// See kv.RenamePrefix for how the keys are moved.
+func (b *KVPrefix) RenamePrefix(ctx context.Context, from, to string) error {
+	return b.unprefixErr(kv.RenamePrefix(ctx, b.store, b.prefix+from, b.prefix+to))
+}
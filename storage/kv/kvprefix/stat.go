@@ -0,0 +1,22 @@
+package kvprefix
+
+import (
+	"context"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// Stat returns metadata about the value of key in the underlying store.
+// The key is preprended with the prefix.
+// See kv.Stat for how the metadata is determined.
+func (b *KVPrefix) Stat(ctx context.Context, key string) (*kv.KeyInfo, error) {
+	if err := checkKey("stat", key); err != nil {
+		return nil, err
+	}
+	info, err := kv.Stat(ctx, b.store, b.prefix+key)
+	if err != nil {
+		return nil, b.unprefixErr(err)
+	}
+	info.Key = key
+	return info, nil
+}
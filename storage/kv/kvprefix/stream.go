@@ -0,0 +1,29 @@
+package kvprefix
+
+import (
+	"context"
+	"io"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// GetReader returns a reader of the value at key in the underlying store.
+// The key is preprended with the prefix.
+// See kv.GetReader for how the value is read.
+func (b *KVPrefix) GetReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := checkKey("get", key); err != nil {
+		return nil, err
+	}
+	r, err := kv.GetReader(ctx, b.store, b.prefix+key)
+	return r, b.unprefixErr(err)
+}
+
+// SetReader sets key to the value read from r in the underlying store.
+// The key is preprended with the prefix.
+// See kv.SetReader for how the value is written.
+func (b *KVPrefix) SetReader(ctx context.Context, key string, r io.Reader) error {
+	if err := checkKey("set", key); err != nil {
+		return err
+	}
+	return b.unprefixErr(kv.SetReader(ctx, b.store, b.prefix+key, r))
+}
@@ -0,0 +1,104 @@
+package kvprefix
+
+import (
+	"context"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// KVPrefixTxn is a KVPrefix over a store that supports transactions.
+type KVPrefixTxn struct {
+	*KVPrefix
+	txnStore kv.TxnBucket
+}
+
+// NewTxn creates a new prefix store that begins transactions in b.
+func NewTxn(prefix string, b kv.TxnBucket) *KVPrefixTxn {
+	return &KVPrefixTxn{KVPrefix: New(prefix, b), txnStore: b}
+}
+
+// TxnID returns the transaction ID of the underlying store, if any.
+func (b *KVPrefix) TxnID() string {
+	if ider, ok := b.store.(kv.TxnIDer); ok {
+		return ider.TxnID()
+	}
+	return ""
+}
+
+// txn is a prefixed transaction that cannot begin transactions.
+type txn struct {
+	*KVPrefix
+	tc kv.TxnCompleter
+}
+
+// Commit commits the underlying transaction.
+func (b *txn) Commit(ctx context.Context) error {
+	return b.unprefixErr(b.tc.Commit(ctx))
+}
+
+// Rollback rolls back the underlying transaction.
+func (b *txn) Rollback(ctx context.Context) error {
+	return b.unprefixErr(b.tc.Rollback(ctx))
+}
+
+// Commit commits the underlying store.
+func (b *KVPrefixTxn) Commit(ctx context.Context) error {
+	return b.unprefixErr(b.txnStore.Commit(ctx))
+}
+
+// Rollback rolls back the underlying store.
+func (b *KVPrefixTxn) Rollback(ctx context.Context) error {
+	return b.unprefixErr(b.txnStore.Rollback(ctx))
+}
+
+// begin begins a transaction in the underlying store and returns it prefixed.
+// The transaction is configured with opts if supported by the underlying store.
+func (b *KVPrefixTxn) begin(ctx context.Context, opts *kv.TxnOptions) (kv.BucketTxnCompleter, error) {
+	bt, err := kv.BeginBucketTxnWithOptions(ctx, b.txnStore, opts)
+	if err != nil {
+		return nil, err
+	}
+	if tb, ok := bt.(kv.TxnBucket); ok {
+		return NewTxn(b.prefix, tb), nil
+	}
+	return &txn{KVPrefix: New(b.prefix, bt), tc: bt}, nil
+}
+
+// BeginBucketTxn begins a transaction in the underlying store.
+// The returned transaction uses the same prefix.
+// To use multiple prefixes within one transaction begin it in the
+// underlying store, wrap it using New for each prefix, and complete
+// it in the underlying store.
+func (b *KVPrefixTxn) BeginBucketTxn(ctx context.Context) (kv.BucketTxnCompleter, error) {
+	return b.begin(ctx, nil)
+}
+
+// BeginCRUDBucketTxn begins a transaction in the underlying store.
+// See BeginBucketTxn.
+func (b *KVPrefixTxn) BeginCRUDBucketTxn(ctx context.Context) (kv.CRUDBucketTxnCompleter, error) {
+	return b.begin(ctx, nil)
+}
+
+// BeginKeysPrefixTraversingBucketTxn begins a transaction in the underlying store.
+// See BeginBucketTxn.
+func (b *KVPrefixTxn) BeginKeysPrefixTraversingBucketTxn(ctx context.Context) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
+	return b.begin(ctx, nil)
+}
+
+// BeginBucketTxnWithOptions is like BeginBucketTxn but configures the transaction with opts.
+// See kv.BeginBucketTxnWithOptions for stores that do not support options.
+func (b *KVPrefixTxn) BeginBucketTxnWithOptions(ctx context.Context, opts *kv.TxnOptions) (kv.BucketTxnCompleter, error) {
+	return b.begin(ctx, opts)
+}
+
+// BeginCRUDBucketTxnWithOptions is like BeginCRUDBucketTxn but configures the transaction with opts.
+// See BeginBucketTxnWithOptions.
+func (b *KVPrefixTxn) BeginCRUDBucketTxnWithOptions(ctx context.Context, opts *kv.TxnOptions) (kv.CRUDBucketTxnCompleter, error) {
+	return b.begin(ctx, opts)
+}
+
+// BeginKeysPrefixTraversingBucketTxnWithOptions is like BeginKeysPrefixTraversingBucketTxn but configures the transaction with opts.
+// See BeginBucketTxnWithOptions.
+func (b *KVPrefixTxn) BeginKeysPrefixTraversingBucketTxnWithOptions(ctx context.Context, opts *kv.TxnOptions) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
+	return b.begin(ctx, opts)
+}
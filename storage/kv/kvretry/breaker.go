@@ -0,0 +1,178 @@
+package kvretry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// state is the state of a circuit breaker.
+type state int
+
+const (
+	stateClosed   state = iota // operations are allowed
+	stateOpen                  // operations are rejected
+	stateHalfOpen              // a single trial operation is allowed
+)
+
+func (s state) String() string {
+	switch s {
+	case stateClosed:
+		return "closed"
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("unknown state %d", int(s))
+	}
+}
+
+// UnavailableError is returned for operations rejected by an open circuit.
+// It wraps kv.ErrUnavailable.
+type UnavailableError struct {
+	// Failures is the number of consecutive failures.
+	Failures int
+
+	// Until is when the next trial operation is allowed.
+	Until time.Time
+
+	// Err is the last failure.
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	msg := fmt.Sprintf("%v: circuit open after %d failures until %s", kv.ErrUnavailable, e.Failures, e.Until.Format(time.RFC3339Nano))
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return kv.ErrUnavailable
+}
+
+// breaker is a circuit breaker.
+// After threshold consecutive failures the circuit opens and rejects
+// operations. Once cooldown passes a single trial operation is allowed
+// (half-open) which either closes the circuit or opens it again.
+type breaker struct {
+	threshold int // disabled if less than 1
+	cooldown  time.Duration
+	logger    log.Logger
+
+	mu       sync.Mutex
+	state    state
+	failures int
+	until    time.Time
+	lastErr  error
+	trial    bool // a half-open trial operation is in progress
+}
+
+// unavailable returns the error for rejected operations.
+// b.mu should be locked.
+func (b *breaker) unavailable() error {
+	return &UnavailableError{Failures: b.failures, Until: b.until, Err: b.lastErr}
+}
+
+// setState changes the state of the circuit logging the change.
+// b.mu should be locked.
+func (b *breaker) setState(ctx context.Context, to state) {
+	if b.state == to {
+		return
+	}
+	logs := []interface{}{
+		"msg", "circuit state changed",
+		"from", b.state.String(),
+		"to", to.String(),
+		"failures", b.failures,
+	}
+	if to == stateOpen {
+		b.until = time.Now().Add(b.cooldown)
+		logs = append(logs, "cooldown", b.cooldown)
+	}
+	if b.lastErr != nil && to != stateClosed {
+		logs = append(logs, "err", b.lastErr)
+	}
+	b.state = to
+	ctxlog.Logger(ctx, b.logger).Info(logs...)
+}
+
+// allow returns an error if an operation is not allowed.
+// If allowed the result of the operation must be recorded with record.
+func (b *breaker) allow(ctx context.Context) error {
+	if b.threshold < 1 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case stateOpen:
+		if time.Now().Before(b.until) {
+			return b.unavailable()
+		}
+		b.setState(ctx, stateHalfOpen)
+	case stateHalfOpen:
+		if b.trial {
+			return b.unavailable()
+		}
+	default:
+		return nil
+	}
+	b.trial = true
+	return nil
+}
+
+// openUntil returns when the cooldown of an open circuit passes.
+// False is returned if the circuit is not open or its cooldown has
+// already passed. Unlike allow no trial operation is started.
+func (b *breaker) openUntil() (time.Time, bool) {
+	if b.threshold < 1 {
+		return time.Time{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != stateOpen || !time.Now().Before(b.until) {
+		return time.Time{}, false
+	}
+	return b.until, true
+}
+
+// release ends an allowed operation without recording a result.
+// Used when the operation did not complete (e.g. it was canceled).
+func (b *breaker) release() {
+	if b.threshold < 1 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// record records the result of an allowed operation.
+// Failure indicates err is a failure of the store.
+func (b *breaker) record(ctx context.Context, err error, failure bool) {
+	if b.threshold < 1 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if !failure {
+		b.failures = 0
+		b.lastErr = nil
+		b.setState(ctx, stateClosed)
+		return
+	}
+	b.failures++
+	b.lastErr = err
+	if b.state == stateHalfOpen || b.failures >= b.threshold {
+		b.setState(ctx, stateOpen)
+	}
+}
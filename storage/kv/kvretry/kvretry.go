@@ -0,0 +1,398 @@
+// Package kvretry retries failed operations of key-value stores and
+// stops sending operations to stores that keep failing.
+package kvretry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// IsTransient reports whether err is a transient failure of a store.
+// Only network errors and I/O errors that may succeed when repeated
+// (such as connection resets and unexpected EOFs) are transient. Answers
+// from the store (such as kv.ErrKeyNotFound), conflicts (such as
+// kv.ErrConflict), context errors, and kv.ErrUnavailable are not.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, target := range []error{
+		kv.ErrUnavailable,
+		context.Canceled,
+		context.DeadlineExceeded,
+	} {
+		if errors.Is(err, target) {
+			return false
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	for _, target := range []error{
+		io.ErrUnexpectedEOF,
+		os.ErrDeadlineExceeded,
+		syscall.ECONNREFUSED,
+		syscall.ECONNRESET,
+		syscall.ECONNABORTED,
+		syscall.EPIPE,
+		syscall.ETIMEDOUT,
+		syscall.EIO,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+type config struct {
+	maxAttempts int
+	backoff     kv.Backoff
+	retryWrites bool
+	retryable   func(error) bool
+	threshold   int
+	cooldown    time.Duration
+	logger      log.Logger
+}
+
+// Option configures a KVRetry.
+type Option func(*config)
+
+// WithMaxAttempts sets the maximum number of attempts (including the first).
+func WithMaxAttempts(n int) Option {
+	return func(c *config) {
+		c.maxAttempts = n
+	}
+}
+
+// WithBackoff sets the backoff used to delay retries.
+func WithBackoff(b kv.Backoff) Option {
+	return func(c *config) {
+		c.backoff = b
+	}
+}
+
+// WithRetryWrites turns on retrying writes (e.g. Set and Delete).
+// Only use with stores whose writes are safe to repeat.
+func WithRetryWrites() Option {
+	return func(c *config) {
+		c.retryWrites = true
+	}
+}
+
+// WithRetryable sets the function that classifies errors as failures
+// of the store. Failures are retried and counted by the circuit breaker.
+// By default IsTransient is used. Take care not to classify conflicts
+// (see kv.IsRetryable) as failures as they would open the circuit.
+func WithRetryable(f func(error) bool) Option {
+	return func(c *config) {
+		c.retryable = f
+	}
+}
+
+// WithCircuitBreaker opens the circuit after threshold consecutive
+// failures. Operations are rejected with an *UnavailableError until
+// cooldown passes. Then a single trial operation is allowed which
+// either closes the circuit or opens it again.
+// A threshold less than 1 turns off the circuit breaker.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(c *config) {
+		c.threshold = threshold
+		c.cooldown = cooldown
+	}
+}
+
+// WithLogger sets the logger.
+// Circuit state changes are logged at the info level and retries at
+// the debug level.
+func WithLogger(logger log.Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+// KVRetry wraps a key-value store to retry failed operations.
+// Reads (such as Get and Has) are retried with backoff. Writes (such as
+// Set and Delete) are only retried if configured.
+// Key traversal cannot report failures so Keys and KeysPrefix are not
+// retried and do not count towards the circuit breaker: while the
+// circuit is open they wait for its cooldown before traversing.
+// See KVRetryTxn for stores that support transactions.
+type KVRetry struct {
+	kv.Wrapper
+	config  *config
+	breaker *breaker // shared with transactions
+}
+
+// KVRetryTxn is a KVRetry that supports transactions.
+// Transactions begun from KVRetryTxn are wrapped the same way.
+// Commits are never retried.
+type KVRetryTxn struct {
+	*KVRetry
+	txn kv.TxnWrapper
+}
+
+// New creates a new retrying key-value store that wraps b.
+// By default up to 3 attempts are made using kv.DefaultBackoff and the
+// circuit opens after 5 consecutive failures for 10 seconds.
+func New(b kv.Bucket, opts ...Option) *KVRetry {
+	if b == nil {
+		panic("nil store")
+	}
+	config := &config{
+		maxAttempts: 3,
+		backoff:     kv.DefaultBackoff,
+		retryable:   IsTransient,
+		threshold:   5,
+		cooldown:    10 * time.Second,
+		logger:      log.NopLogger,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return &KVRetry{
+		Wrapper: kv.Wrapper{Next: b},
+		config:  config,
+		breaker: &breaker{
+			threshold: config.threshold,
+			cooldown:  config.cooldown,
+			logger:    config.logger,
+		},
+	}
+}
+
+// NewTxn creates a new retrying key-value store that wraps b and its transactions.
+// See New for the defaults.
+func NewTxn(b kv.TxnBucket, opts ...Option) *KVRetryTxn {
+	r := New(b, opts...)
+	return &KVRetryTxn{KVRetry: r, txn: kv.TxnWrapper{Next: b, WrapTxn: r.wrap}}
+}
+
+// Middleware returns a middleware that wraps buckets with New.
+// Buckets that support transactions are wrapped with NewTxn.
+func Middleware(opts ...Option) kv.Middleware {
+	return func(b kv.Bucket) kv.Bucket {
+		if tb, ok := b.(kv.TxnBucket); ok {
+			return NewTxn(tb, opts...)
+		}
+		return New(b, opts...)
+	}
+}
+
+// wrap wraps the transaction txn sharing the configuration and circuit of r.
+func (r *KVRetry) wrap(txn kv.Bucket) kv.Bucket {
+	w := &KVRetry{Wrapper: kv.Wrapper{Next: txn}, config: r.config, breaker: r.breaker}
+	return &KVRetryTxn{KVRetry: w, txn: kv.TxnWrapper{Next: txn, WrapTxn: w.wrap}}
+}
+
+// writeAttempts returns the maximum attempts for writes.
+func (r *KVRetry) writeAttempts() int {
+	if r.config.retryWrites {
+		return r.config.maxAttempts
+	}
+	return 1
+}
+
+// do calls f until it succeeds, returns an error that is not a
+// failure, runs out of attempts, or ctx is done. Each attempt must be
+// allowed by the circuit breaker.
+func (r *KVRetry) do(ctx context.Context, maxAttempts int, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := r.breaker.allow(ctx); err != nil {
+			return err
+		}
+		err := f()
+		failure := err != nil && r.config.retryable(err)
+		if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			r.breaker.release()
+		} else {
+			r.breaker.record(ctx, err, failure)
+		}
+		if !failure || attempt >= maxAttempts {
+			return err
+		}
+		delay := r.config.backoff.Delay(attempt)
+		ctxlog.Logger(ctx, r.config.logger).Debug(
+			"msg", "retrying operation",
+			"attempt", attempt,
+			"delay", delay,
+			"err", err,
+		)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("retry: %w; after error: %v", ctx.Err(), err)
+		case <-t.C:
+		}
+	}
+}
+
+// Get retrieves the value at key retrying failures.
+func (r *KVRetry) Get(ctx context.Context, key string) (value []byte, err error) {
+	err = r.do(ctx, r.config.maxAttempts, func() error {
+		value, err = r.Next.Get(ctx, key)
+		return err
+	})
+	return
+}
+
+// Has checks that key can be found retrying failures.
+func (r *KVRetry) Has(ctx context.Context, key string) (found bool, err error) {
+	err = r.do(ctx, r.config.maxAttempts, func() error {
+		found, err = r.Next.Has(ctx, key)
+		return err
+	})
+	return
+}
+
+// Set sets key to value.
+// Failures are only retried if configured with WithRetryWrites.
+func (r *KVRetry) Set(ctx context.Context, key string, value []byte) error {
+	return r.do(ctx, r.writeAttempts(), func() error {
+		return r.Next.Set(ctx, key, value)
+	})
+}
+
+// Delete deletes key.
+// Failures are only retried if configured with WithRetryWrites.
+func (r *KVRetry) Delete(ctx context.Context, key string) error {
+	return r.do(ctx, r.writeAttempts(), func() error {
+		return r.Next.Delete(ctx, key)
+	})
+}
+
+// keys returns the keys traversed by f once the circuit is not open.
+// Traversal is neither retried nor takes (or reports the result of) a
+// half-open trial operation as it cannot report failures.
+// No keys are returned if ctx or cancel is done while waiting.
+func (r *KVRetry) keys(ctx context.Context, cancel <-chan struct{}, f func() <-chan string) <-chan string {
+	until, open := r.breaker.openUntil()
+	if !open {
+		return f()
+	}
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for open {
+			t := time.NewTimer(time.Until(until))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-cancel:
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			until, open = r.breaker.openUntil()
+		}
+		for key := range f() {
+			select {
+			case out <- key:
+			case <-cancel:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Keys returns all keys.
+// It is not retried. While the circuit is open it waits before traversing.
+func (r *KVRetry) Keys(ctx context.Context, cancel <-chan struct{}) <-chan string {
+	return r.keys(ctx, cancel, func() <-chan string {
+		return r.Next.Keys(ctx, cancel)
+	})
+}
+
+// KeysPrefix returns all keys starting with prefix.
+// It is not retried. While the circuit is open it waits before traversing.
+func (r *KVRetry) KeysPrefix(ctx context.Context, prefix string, cancel <-chan struct{}) <-chan string {
+	return r.keys(ctx, cancel, func() <-chan string {
+		return r.Next.KeysPrefix(ctx, prefix, cancel)
+	})
+}
+
+// Commit commits the wrapped transaction.
+// Commits are not retried.
+func (r *KVRetryTxn) Commit(ctx context.Context) error {
+	return r.do(ctx, 1, func() error {
+		return r.txn.Commit(ctx)
+	})
+}
+
+// Rollback rolls back the wrapped transaction.
+func (r *KVRetryTxn) Rollback(ctx context.Context) error {
+	return r.txn.Rollback(ctx)
+}
+
+// TxnID returns the transaction ID of the wrapped transaction, if any.
+func (r *KVRetryTxn) TxnID() string {
+	return r.txn.TxnID()
+}
+
+// BeginBucketTxn begins a transaction retrying failures.
+func (r *KVRetryTxn) BeginBucketTxn(ctx context.Context) (bt kv.BucketTxnCompleter, err error) {
+	err = r.do(ctx, r.config.maxAttempts, func() error {
+		bt, err = r.txn.BeginBucketTxn(ctx)
+		return err
+	})
+	return
+}
+
+// BeginCRUDBucketTxn begins a transaction retrying failures.
+func (r *KVRetryTxn) BeginCRUDBucketTxn(ctx context.Context) (bt kv.CRUDBucketTxnCompleter, err error) {
+	err = r.do(ctx, r.config.maxAttempts, func() error {
+		bt, err = r.txn.BeginCRUDBucketTxn(ctx)
+		return err
+	})
+	return
+}
+
+// BeginKeysPrefixTraversingBucketTxn begins a transaction retrying failures.
+func (r *KVRetryTxn) BeginKeysPrefixTraversingBucketTxn(ctx context.Context) (bt kv.KeysPrefixTraversingBucketTxnCompleter, err error) {
+	err = r.do(ctx, r.config.maxAttempts, func() error {
+		bt, err = r.txn.BeginKeysPrefixTraversingBucketTxn(ctx)
+		return err
+	})
+	return
+}
+
+// BeginBucketTxnWithOptions is like BeginBucketTxn but configures the transaction with opts.
+func (r *KVRetryTxn) BeginBucketTxnWithOptions(ctx context.Context, opts *kv.TxnOptions) (bt kv.BucketTxnCompleter, err error) {
+	err = r.do(ctx, r.config.maxAttempts, func() error {
+		bt, err = r.txn.BeginBucketTxnWithOptions(ctx, opts)
+		return err
+	})
+	return
+}
+
+// BeginCRUDBucketTxnWithOptions is like BeginCRUDBucketTxn but configures the transaction with opts.
+func (r *KVRetryTxn) BeginCRUDBucketTxnWithOptions(ctx context.Context, opts *kv.TxnOptions) (bt kv.CRUDBucketTxnCompleter, err error) {
+	err = r.do(ctx, r.config.maxAttempts, func() error {
+		bt, err = r.txn.BeginCRUDBucketTxnWithOptions(ctx, opts)
+		return err
+	})
+	return
+}
+
+// BeginKeysPrefixTraversingBucketTxnWithOptions is like BeginKeysPrefixTraversingBucketTxn but configures the transaction with opts.
+func (r *KVRetryTxn) BeginKeysPrefixTraversingBucketTxnWithOptions(ctx context.Context, opts *kv.TxnOptions) (bt kv.KeysPrefixTraversingBucketTxnCompleter, err error) {
+	err = r.do(ctx, r.config.maxAttempts, func() error {
+		bt, err = r.txn.BeginKeysPrefixTraversingBucketTxnWithOptions(ctx, opts)
+		return err
+	})
+	return
+}
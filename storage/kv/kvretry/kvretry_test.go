@@ -0,0 +1,275 @@
+package kvretry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	logtest "github.com/micromdm/nanolib/log/test"
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/kvtxn"
+	"github.com/micromdm/nanolib/storage/kv/test"
+)
+
+var errFlaky = fmt.Errorf("flaky: %w", syscall.ECONNRESET)
+
+// flaky fails the next failures Gets and Sets.
+type flaky struct {
+	kv.Wrapper
+	failures int
+	calls    int
+	err      error // errFlaky if nil
+}
+
+func (f *flaky) fail() error {
+	f.calls++
+	if f.failures > 0 {
+		f.failures--
+		if f.err != nil {
+			return f.err
+		}
+		return errFlaky
+	}
+	return nil
+}
+
+func (f *flaky) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.Next.Get(ctx, key)
+}
+
+func (f *flaky) Set(ctx context.Context, key string, value []byte) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.Next.Set(ctx, key, value)
+}
+
+var testBackoff = kv.Backoff{Initial: time.Millisecond}
+
+func TestKVRetry(t *testing.T) {
+	ctx := context.Background()
+	b := NewTxn(kvtxn.New(kvmap.New()))
+	test.TestBucketSimple(t, ctx, b)
+	test.TestKeysTraversing(t, ctx, b)
+	test.TestErrors(t, ctx, b)
+	test.TestTxnSimple(t, ctx, b, test.WithNoReadAfterRollback())
+	test.TestTxnReadOnly(t, ctx, b)
+}
+
+func TestMiddleware(t *testing.T) {
+	// transaction support is detected by interface
+	mw := Middleware()
+	if _, ok := mw(&flaky{Wrapper: kv.Wrapper{Next: kvmap.New()}}).(kv.TxnBucket); ok {
+		t.Error("expected store without transaction support")
+	}
+	if _, ok := mw(kvtxn.New(kvmap.New())).(kv.TxnBucket); !ok {
+		t.Error("expected store with transaction support")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("unknown"), false},
+		{kv.ErrKeyNotFound, false},
+		{kv.ErrConflict, false},
+		{kv.ErrDeadlock, false},
+		{kvtxn.ErrStageLimit, false},
+		{context.DeadlineExceeded, false},
+		{&kv.KeyError{Op: "get", Key: "a", Err: io.ErrUnexpectedEOF}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: context.Canceled}, false},
+		{errFlaky, true},
+	} {
+		if have := IsTransient(tc.err); have != tc.want {
+			t.Errorf("%v: have: %v, want: %v", tc.err, have, tc.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	f := &flaky{Wrapper: kv.Wrapper{Next: kvmap.New()}}
+	b := New(f, WithBackoff(testBackoff), WithCircuitBreaker(0, 0))
+
+	// writes are not retried by default
+	f.failures = 1
+	if err := b.Set(ctx, "hello", []byte("world")); !errors.Is(err, errFlaky) {
+		t.Fatalf("expected flaky error, have: %v", err)
+	}
+	if err := b.Set(ctx, "hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	f.failures, f.calls = 2, 0
+	if _, err := b.Get(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := f.calls, 3; have != want {
+		t.Errorf("have: %d, want: %d calls", have, want)
+	}
+
+	f.failures, f.calls = 3, 0
+	if _, err := b.Get(ctx, "hello"); !errors.Is(err, errFlaky) {
+		t.Errorf("expected flaky error, have: %v", err)
+	}
+	if have, want := f.calls, 3; have != want {
+		t.Errorf("have: %d, want: %d calls", have, want)
+	}
+
+	// answers from the store are not retried
+	f.calls = 0
+	if _, err := b.Get(ctx, "missing"); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, have: %v", err)
+	}
+	if have, want := f.calls, 1; have != want {
+		t.Errorf("have: %d, want: %d calls", have, want)
+	}
+
+	b = New(f, WithBackoff(testBackoff), WithRetryWrites())
+	f.failures = 2
+	if err := b.Set(ctx, "hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	logger := &logtest.Logger{KeepLastWith: true}
+	f := &flaky{Wrapper: kv.Wrapper{Next: kvmap.New()}}
+	cooldown := 50 * time.Millisecond
+	b := New(f,
+		WithMaxAttempts(1),
+		WithCircuitBreaker(2, cooldown),
+		WithLogger(logger),
+	)
+	if err := b.Set(ctx, "hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	f.failures = 10
+	for i := 0; i < 2; i++ {
+		if _, err := b.Get(ctx, "hello"); !errors.Is(err, errFlaky) {
+			t.Fatalf("expected flaky error, have: %v", err)
+		}
+	}
+	logtest.TestLastLogKeyValueMatches(t, logger, "to", "open")
+
+	// the open circuit rejects operations without calling the store
+	f.calls = 0
+	_, err := b.Get(ctx, "hello")
+	if !errors.Is(err, kv.ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, have: %v", err)
+	}
+	var unavailableErr *UnavailableError
+	if !errors.As(err, &unavailableErr) {
+		t.Fatal("expected UnavailableError")
+	}
+	if !errors.Is(unavailableErr.Err, errFlaky) {
+		t.Errorf("expected last error to be flaky, have: %v", unavailableErr.Err)
+	}
+	if f.calls != 0 {
+		t.Errorf("expected no calls, have: %d", f.calls)
+	}
+
+	// key traversal waits for the circuit
+	timeoutCtx, cancel := context.WithTimeout(ctx, cooldown/5)
+	for range b.Keys(timeoutCtx, nil) {
+		t.Error("expected no keys")
+	}
+	if timeoutCtx.Err() == nil {
+		t.Error("expected context to be done")
+	}
+	cancel()
+
+	// a failed trial opens the circuit again
+	time.Sleep(cooldown)
+	if _, err = b.Get(ctx, "hello"); !errors.Is(err, errFlaky) {
+		t.Fatalf("expected flaky error, have: %v", err)
+	}
+	logtest.TestLastLogKeyValueMatches(t, logger, "from", "half-open")
+	logtest.TestLastLogKeyValueMatches(t, logger, "to", "open")
+	if _, err = b.Get(ctx, "hello"); !errors.Is(err, kv.ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, have: %v", err)
+	}
+
+	// key traversal waits for the cooldown without taking the trial
+	f.failures = 0
+	if keys := kv.AllKeys(ctx, b); len(keys) != 1 || keys[0] != "hello" {
+		t.Errorf("expected hello key, have: %v", keys)
+	}
+	if have, want := b.breaker.state, stateOpen; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// a successful trial closes the circuit
+	if _, err = b.Get(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	logtest.TestLastLogKeyValueMatches(t, logger, "from", "half-open")
+	logtest.TestLastLogKeyValueMatches(t, logger, "to", "closed")
+	if _, err = b.Get(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCircuitBreakerConflicts(t *testing.T) {
+	ctx := context.Background()
+	f := &flaky{Wrapper: kv.Wrapper{Next: kvmap.New()}}
+	b := New(f, WithBackoff(testBackoff), WithCircuitBreaker(1, time.Minute))
+
+	// conflicts and stage limits are neither retried nor failures
+	for _, err := range []error{kv.ErrConflict, kvtxn.ErrStageLimit} {
+		f.err, f.failures, f.calls = err, 1, 0
+		if have := b.Set(ctx, "hello", []byte("world")); !errors.Is(have, err) {
+			t.Fatalf("have: %v, want: %v", have, err)
+		}
+		if f.calls != 1 {
+			t.Errorf("expected 1 call, have: %d", f.calls)
+		}
+	}
+	if err := b.Set(ctx, "hello", []byte("world")); err != nil {
+		t.Errorf("expected closed circuit, have: %v", err)
+	}
+}
+
+func TestCircuitBreakerTxn(t *testing.T) {
+	ctx := context.Background()
+	f := &flaky{Wrapper: kv.Wrapper{Next: kvmap.New()}}
+	b := NewTxn(kvtxn.New(f), WithMaxAttempts(1), WithCircuitBreaker(1, time.Minute))
+
+	bt, err := b.BeginBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Set(ctx, "hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the commit failure opens the circuit shared with b
+	f.failures = 1
+	if err = bt.Commit(ctx); !errors.Is(err, errFlaky) {
+		t.Fatalf("expected flaky error, have: %v", err)
+	}
+	if err = bt.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.BeginBucketTxn(ctx); !errors.Is(err, kv.ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable, have: %v", err)
+	}
+	if _, err = b.Get(ctx, "hello"); !errors.Is(err, kv.ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable, have: %v", err)
+	}
+}
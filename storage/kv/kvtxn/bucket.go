@@ -2,76 +2,174 @@ package kvtxn
 
 import (
 	"context"
+	"errors"
 
 	"github.com/micromdm/nanolib/storage/kv"
 )
 
+// checkOp returns an error for op on key if key is invalid or b is closed.
+// Write operations are also rejected for read-only transactions and
+// while running pre-commit hooks.
+func (b *KVTxn) checkOp(op, key string, write bool) error {
+	var err error
+	if key == "" {
+		err = kv.ErrInvalidKey
+	} else if b.closed() {
+		err = kv.ErrTxnClosed
+	} else if write && (b.readOnly || b.committing()) {
+		err = kv.ErrReadOnly
+	}
+	if err != nil {
+		return &kv.KeyError{Op: op, Key: key, Err: err}
+	}
+	return nil
+}
+
 // Get retrieves value at key.
 // A previously staged key may be returned.
+// An ErrTxnClosed error is returned for completed transactions.
 func (b *KVTxn) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := b.checkOp("get", key, false); err != nil {
+		return nil, err
+	}
 	if !b.hasOp(key) {
-		b.keyLock.RLock(key)
-		defer b.keyLock.RUnlock(key)
+		if err := b.keyLock.RLockTxn(b.id, key); err != nil {
+			return nil, &kv.KeyError{Op: "get", Key: key, Err: err}
+		}
+		defer b.keyLock.RUnlockTxn(b.id, key)
 	}
 	if !b.autoCommit {
 		b.stageLock.RLock()
-		defer b.stageLock.RUnlock()
-		if value, del, found := b.stageGet(key); found {
+		value, del, found, err := b.stageGet(ctx, key)
+		b.stageLock.RUnlock()
+		if err != nil {
+			return nil, &kv.KeyError{Op: "get", Key: key, Err: err}
+		} else if found {
 			if del {
 				// found a stage operation that deleted this key
-				return nil, kv.ErrKeyNotFound
+				return nil, &kv.KeyError{Op: "get", Key: key, Err: kv.ErrKeyNotFound}
 			}
 			return value, nil
 		}
 	}
 	// fallback to underlying store
-	return b.store.Get(ctx, key)
+	value, err := b.store.Get(ctx, key)
+	if b.tracking() {
+		b.observe(key, value, err)
+	}
+	return value, err
 }
 
 // Set sets key to value in the staged operations.
 // This change may be auto-commited.
+// An ErrReadOnly error is returned for read-only transactions and an
+// ErrTxnClosed error for completed transactions.
 func (b *KVTxn) Set(ctx context.Context, key string, value []byte) error {
-	if !b.hasOp(key) {
-		b.keyLock.Lock(key)
+	if err := b.checkOp("set", key, true); err != nil {
+		return err
+	}
+	if b.autoCommit {
+		return b.perform(ctx, func(txn *KVTxn) error {
+			return txn.Set(ctx, key, value)
+		})
+	}
+	locked := !b.hasOp(key)
+	if locked {
+		if err := b.keyLock.LockTxn(b.id, key); err != nil {
+			return &kv.KeyError{Op: "set", Key: key, Err: err}
+		}
+	}
+	if b.tracking() {
+		if err := b.observeWrite(ctx, key); err != nil {
+			return err
+		}
 	}
 	b.stageLock.Lock()
 	defer b.stageLock.Unlock()
-	b.stageSet(key, value)
-	if b.autoCommit {
-		return b.stageCommit(ctx)
+	err := b.checkLimits(key, len(value))
+	if err == nil {
+		err = b.stageSet(ctx, key, value)
+	}
+	if err != nil {
+		if _, staged := b.stageKeyOps[key]; locked && !staged {
+			// release the key lock we took for this operation
+			b.keyLock.UnlockTxn(b.id, key)
+		}
+		return &kv.KeyError{Op: "set", Key: key, Err: err}
 	}
 	return nil
 }
 
 // Has checks that key can be found.
 // A previously staged key may be returned.
+// An ErrTxnClosed error is returned for completed transactions.
 func (b *KVTxn) Has(ctx context.Context, key string) (bool, error) {
+	if err := b.checkOp("has", key, false); err != nil {
+		return false, err
+	}
 	if !b.hasOp(key) {
-		b.keyLock.RLock(key)
-		defer b.keyLock.RUnlock(key)
+		if err := b.keyLock.RLockTxn(b.id, key); err != nil {
+			return false, &kv.KeyError{Op: "has", Key: key, Err: err}
+		}
+		defer b.keyLock.RUnlockTxn(b.id, key)
 	}
 	if !b.autoCommit {
 		b.stageLock.RLock()
-		defer b.stageLock.RUnlock()
-		if has, found := b.stageHas(key); found {
+		has, found := b.stageHas(key)
+		b.stageLock.RUnlock()
+		if found {
 			return has, nil
 		}
 	}
+	if b.tracking() {
+		// read the value to record its version
+		value, err := b.store.Get(ctx, key)
+		b.observe(key, value, err)
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	}
 	// fallback to underlying store
 	return b.store.Has(ctx, key)
 }
 
 // Delete deletes key in the staged operations.
 // This change may be auto-commited.
+// An ErrReadOnly error is returned for read-only transactions and an
+// ErrTxnClosed error for completed transactions.
 func (b *KVTxn) Delete(ctx context.Context, key string) error {
-	if !b.hasOp(key) {
-		b.keyLock.Lock(key)
+	if err := b.checkOp("delete", key, true); err != nil {
+		return err
+	}
+	if b.autoCommit {
+		return b.perform(ctx, func(txn *KVTxn) error {
+			return txn.Delete(ctx, key)
+		})
+	}
+	locked := !b.hasOp(key)
+	if locked {
+		if err := b.keyLock.LockTxn(b.id, key); err != nil {
+			return &kv.KeyError{Op: "delete", Key: key, Err: err}
+		}
+	}
+	if b.tracking() {
+		if err := b.observeWrite(ctx, key); err != nil {
+			return err
+		}
 	}
 	b.stageLock.Lock()
 	defer b.stageLock.Unlock()
-	b.stageDelete(key)
-	if b.autoCommit {
-		return b.stageCommit(ctx)
+	err := b.checkLimits(key, 0)
+	if err == nil {
+		err = b.stageDelete(ctx, key)
+	}
+	if err != nil {
+		if _, staged := b.stageKeyOps[key]; locked && !staged {
+			// release the key lock we took for this operation
+			b.keyLock.UnlockTxn(b.id, key)
+		}
+		return &kv.KeyError{Op: "delete", Key: key, Err: err}
 	}
 	return nil
 }
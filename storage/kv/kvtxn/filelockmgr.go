@@ -0,0 +1,386 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package kvtxn
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+const lockFileExt = ".lock"
+
+// fileLockBackoff is the backoff for retrying locked lock files.
+var fileLockBackoff = kv.Backoff{
+	Initial: time.Millisecond,
+	Max:     50 * time.Millisecond,
+	Jitter:  0.5,
+}
+
+// txnFile is the lock file for a key held by a transaction.
+type txnFile struct {
+	f      *os.File
+	excl   int // exclusive locks held
+	shared int // shared locks held
+}
+
+// heldFiles are the open (and locked) lock files for a key.
+type heldFiles struct {
+	shared []*os.File          // anonymous shared locks
+	excl   *os.File            // anonymous exclusive lock
+	txns   map[string]*txnFile // locks held by transactions
+}
+
+// FileLockManager is a lock manager that supports locking on keys (strings).
+// Advisory file locks (flock) are used so that locks are shared
+// between all processes using the same lock directory. Each key is
+// hashed to a single lock file in the lock directory.
+//
+// FileLockManager is a TxnKeyLockManager so that errors with the lock
+// files (such as I/O or permission errors) can be returned from lock
+// acquisition. Use it with WithTxnKeyLockManager.
+//
+// Locked lock files are retried until the lock timeout passes and
+// ErrLockTimeout is returned. Deadlocks between processes cannot be
+// detected so transactions that lock keys in different orders wait
+// for the timeout (and should be rolled back, as kv.PerformBucketTxn
+// does).
+//
+// Locks are re-entrant for the same (non-empty) transaction ID in a
+// process: a transaction may lock a key it already holds. A shared
+// lock taken while holding an exclusive lock keeps the key exclusively
+// locked until both are released. Upgrading a held shared lock to an
+// exclusive lock is refused with ErrDeadlock. Anonymous (empty
+// transaction ID) locks are not re-entrant and wait like locks of
+// other processes.
+//
+// Note that advisory file locks may not be supported (or may be
+// unreliable) on some network filesystems.
+type FileLockManager struct {
+	dir     string
+	timeout time.Duration
+	files   map[string]*heldFiles
+	m       sync.Mutex
+}
+
+// FileLockOption configures a FileLockManager.
+type FileLockOption func(*FileLockManager)
+
+// WithFileLockTimeout sets how long to wait for a lock.
+// A timeout less than 1 waits without a timeout.
+func WithFileLockTimeout(d time.Duration) FileLockOption {
+	return func(klm *FileLockManager) {
+		klm.timeout = d
+	}
+}
+
+// NewFileLockManager creates a new key lock manager using dir for lock files.
+// The directory is created if it does not exist.
+// Unless otherwise configured locks wait for up to DefaultLockTimeout.
+func NewFileLockManager(dir string, opts ...FileLockOption) (*FileLockManager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating lock directory: %w", err)
+	}
+	klm := &FileLockManager{
+		dir:     dir,
+		timeout: DefaultLockTimeout,
+		files:   make(map[string]*heldFiles),
+	}
+	for _, opt := range opts {
+		opt(klm)
+	}
+	return klm, nil
+}
+
+// lockPath returns the lock file path for key.
+func (klm *FileLockManager) lockPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(klm.dir, hex.EncodeToString(sum[:])+lockFileExt)
+}
+
+// flock applies or removes an advisory lock on f.
+func flock(f *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// wait applies the lock how on f retrying until deadline.
+// A zero deadline retries forever.
+func wait(f *os.File, how int, deadline time.Time) error {
+	for attempt := 1; ; attempt++ {
+		err := flock(f, how|syscall.LOCK_NB)
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return err
+		}
+		delay := fileLockBackoff.Delay(attempt)
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return ErrLockTimeout
+			} else if delay > remaining {
+				delay = remaining
+			}
+		}
+		time.Sleep(delay)
+	}
+}
+
+// acquire opens and locks the lock file for key using how.
+// ErrLockTimeout is returned if the lock is not acquired in time.
+func (klm *FileLockManager) acquire(key string, how int) (*os.File, error) {
+	name := klm.lockPath(key)
+	var deadline time.Time
+	if klm.timeout > 0 {
+		deadline = time.Now().Add(klm.timeout)
+	}
+	for {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err = wait(f, how, deadline); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// the lock file may have been removed (by Clean) between
+		// opening and locking it. make sure the file we hold the lock
+		// on is still the one in the lock directory.
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		pi, err := os.Stat(name)
+		if err == nil && os.SameFile(fi, pi) {
+			return f, nil
+		}
+		// closing the file releases the lock
+		f.Close()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+}
+
+// held returns the held lock files for key.
+// klm.m should be locked.
+func (klm *FileLockManager) held(key string) *heldFiles {
+	h, ok := klm.files[key]
+	if !ok || h == nil {
+		h = &heldFiles{txns: make(map[string]*txnFile)}
+		klm.files[key] = h
+	}
+	return h
+}
+
+// release removes the held lock files for key if none remain.
+// klm.m should be locked.
+func (klm *FileLockManager) release(key string, h *heldFiles) {
+	if h.excl == nil && len(h.shared) < 1 && len(h.txns) < 1 {
+		delete(klm.files, key)
+	}
+}
+
+// reenter takes another lock on key for txnID if it already holds one.
+// Handled reports whether txnID already held a lock.
+// ErrDeadlock is returned for upgrading a shared lock.
+func (klm *FileLockManager) reenter(txnID, key string, exclusive bool) (handled bool, err error) {
+	klm.m.Lock()
+	defer klm.m.Unlock()
+
+	h, ok := klm.files[key]
+	if !ok || h == nil {
+		return false, nil
+	}
+	tf, ok := h.txns[txnID]
+	if !ok {
+		return false, nil
+	}
+	if exclusive && tf.excl < 1 {
+		return true, fmt.Errorf("%w: txn %s upgrading shared lock", ErrDeadlock, txnID)
+	}
+	if exclusive {
+		tf.excl++
+	} else {
+		tf.shared++
+	}
+	return true, nil
+}
+
+// lock locks key for txnID.
+// Transaction locks are re-entrant (see reenter).
+func (klm *FileLockManager) lock(txnID, key string, exclusive bool) error {
+	if txnID != "" {
+		if handled, err := klm.reenter(txnID, key, exclusive); handled {
+			return err
+		}
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	f, err := klm.acquire(key, how)
+	if err != nil {
+		return err
+	}
+
+	klm.m.Lock()
+	defer klm.m.Unlock()
+
+	h := klm.held(key)
+	switch {
+	case txnID != "" && exclusive:
+		h.txns[txnID] = &txnFile{f: f, excl: 1}
+	case txnID != "":
+		h.txns[txnID] = &txnFile{f: f, shared: 1}
+	case exclusive:
+		h.excl = f
+	default:
+		h.shared = append(h.shared, f)
+	}
+	return nil
+}
+
+// unlock unlocks a single lock on key for txnID.
+func (klm *FileLockManager) unlock(txnID, key string, exclusive bool) {
+	klm.m.Lock()
+	defer klm.m.Unlock()
+
+	h, ok := klm.files[key]
+	if !ok || h == nil {
+		// no lock present
+		return
+	}
+
+	var f *os.File
+	if txnID != "" {
+		tf, ok := h.txns[txnID]
+		if !ok {
+			return
+		}
+		if exclusive && tf.excl > 0 {
+			tf.excl--
+		} else if !exclusive && tf.shared > 0 {
+			tf.shared--
+		} else {
+			return
+		}
+		if tf.excl > 0 || tf.shared > 0 {
+			// still held by the transaction
+			return
+		}
+		delete(h.txns, txnID)
+		f = tf.f
+	} else if exclusive {
+		if h.excl == nil {
+			return
+		}
+		f, h.excl = h.excl, nil
+	} else {
+		if len(h.shared) < 1 {
+			return
+		}
+		f = h.shared[len(h.shared)-1]
+		h.shared = h.shared[:len(h.shared)-1]
+	}
+	klm.release(key, h)
+
+	// closing the file releases the lock
+	f.Close()
+}
+
+// RLockTxn locks key in klm for reading by txnID.
+// A shared lock is obtained on the key's lock file.
+func (klm *FileLockManager) RLockTxn(txnID, key string) error {
+	if err := klm.lock(txnID, key, false); err != nil {
+		return fmt.Errorf("shared lock on key %s: %w", key, err)
+	}
+	return nil
+}
+
+// RUnlockTxn undoes a single RLockTxn call for key by txnID.
+func (klm *FileLockManager) RUnlockTxn(txnID, key string) {
+	klm.unlock(txnID, key, false)
+}
+
+// LockTxn locks key for writing in klm by txnID.
+// An exclusive lock is obtained on the key's lock file.
+func (klm *FileLockManager) LockTxn(txnID, key string) error {
+	if err := klm.lock(txnID, key, true); err != nil {
+		return fmt.Errorf("exclusive lock on key %s: %w", key, err)
+	}
+	return nil
+}
+
+// UnlockTxn unlocks key for writing in klm by txnID.
+func (klm *FileLockManager) UnlockTxn(txnID, key string) {
+	klm.unlock(txnID, key, true)
+}
+
+// Clean removes stale lock files from the lock directory.
+// Lock files are considered stale if they are not locked by any process.
+// Clean is safe to run concurrently with other processes using the
+// same lock directory.
+func (klm *FileLockManager) Clean() error {
+	entries, err := os.ReadDir(klm.dir)
+	if err != nil {
+		return fmt.Errorf("reading lock directory: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), lockFileExt) {
+			continue
+		}
+		if err = klm.removeUnlocked(filepath.Join(klm.dir, e.Name())); err != nil {
+			return fmt.Errorf("removing lock file %s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+// removeUnlocked removes the lock file name if no process holds a lock on it.
+func (klm *FileLockManager) removeUnlocked(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// closing the file releases any lock we obtain
+	defer f.Close()
+	if err = flock(f, syscall.LOCK_EX|syscall.LOCK_NB); errors.Is(err, syscall.EWOULDBLOCK) {
+		// locked by someone else; not stale
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// only remove the file if it is the same one we hold a lock on.
+	// processes waiting on this file will notice it is gone and retry.
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	pi, err := os.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !os.SameFile(fi, pi) {
+		return nil
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,345 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package kvtxn
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/test"
+)
+
+// TestFileLockManagerHelperProcess is not a real test. It is used as a
+// separate process by the other tests to lock keys in the lock directory.
+func TestFileLockManagerHelperProcess(t *testing.T) {
+	dir := os.Getenv("KVTXN_HELPER_LOCK_DIR")
+	if dir == "" {
+		return
+	}
+	klm, err := NewFileLockManager(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	key := os.Getenv("KVTXN_HELPER_LOCK_KEY")
+	switch os.Getenv("KVTXN_HELPER_LOCK_MODE") {
+	case "lock":
+		if err = klm.LockTxn("", key); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("locked")
+		klm.UnlockTxn("", key)
+	case "rlock":
+		if err = klm.RLockTxn("", key); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("locked")
+		klm.RUnlockTxn("", key)
+	default:
+		fmt.Fprintln(os.Stderr, "invalid lock mode")
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// startLockHelper starts a helper process that locks key in dir using mode.
+// The returned channel is closed once the helper reports holding the lock.
+func startLockHelper(t *testing.T, dir, mode, key string) (*exec.Cmd, <-chan struct{}) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFileLockManagerHelperProcess$")
+	cmd.Env = append(os.Environ(),
+		"KVTXN_HELPER_LOCK_DIR="+dir,
+		"KVTXN_HELPER_LOCK_MODE="+mode,
+		"KVTXN_HELPER_LOCK_KEY="+key,
+	)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan struct{})
+	go func() {
+		s := bufio.NewScanner(stdout)
+		for s.Scan() {
+			if s.Text() == "locked" {
+				close(ch)
+				break
+			}
+		}
+		// drain the remaining output
+		for s.Scan() {
+		}
+	}()
+	return cmd, ch
+}
+
+// testKeyLocks adapts a TxnKeyLockManager to a KeyLockManager for
+// tests. Lock errors fail the test.
+type testKeyLocks struct {
+	t *testing.T
+	TxnKeyLockManager
+}
+
+func (l testKeyLocks) RLock(key string) {
+	if err := l.RLockTxn("", key); err != nil {
+		l.t.Error(err)
+	}
+}
+
+func (l testKeyLocks) RUnlock(key string) {
+	l.RUnlockTxn("", key)
+}
+
+func (l testKeyLocks) Lock(key string) {
+	if err := l.LockTxn("", key); err != nil {
+		l.t.Error(err)
+	}
+}
+
+func (l testKeyLocks) Unlock(key string) {
+	l.UnlockTxn("", key)
+}
+
+func TestFileLockManager(t *testing.T) {
+	klm, err := NewFileLockManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	timedKeyLockManagerTest(t, testKeyLocks{t, klm})
+}
+
+func TestFileLockManagerErrors(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "locks")
+	klm, err := NewFileLockManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lock files can no longer be created
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = klm.LockTxn("", "lock_key"); err == nil {
+		t.Error("expected lock error")
+	}
+	if err = klm.RLockTxn("", "lock_key"); err == nil {
+		t.Error("expected lock error")
+	}
+
+	// the error is returned from the transaction
+	b := New(kvmap.New(), WithTxnKeyLockManager(klm))
+	if err = b.Set(context.Background(), "lock_key", []byte("val")); err == nil {
+		t.Error("expected set error")
+	}
+}
+
+func TestFileLockManagerProcesses(t *testing.T) {
+	dir := t.TempDir()
+	klm, err := NewFileLockManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locks := testKeyLocks{t, klm}
+
+	t.Run("exclusive", func(t *testing.T) {
+		locks.Lock("lock_key")
+
+		cmd, locked := startLockHelper(t, dir, "rlock", "lock_key")
+
+		select {
+		case <-locked:
+			t.Error("expected helper to be blocked, but it locked")
+		case <-time.After(250 * time.Millisecond):
+			// expected: our exclusive lock blocks the helper
+		}
+
+		locks.Unlock("lock_key")
+
+		select {
+		case <-locked:
+			// expected: helper got the lock after we unlocked
+		case <-time.After(10 * time.Second):
+			t.Error("expected helper to lock, but timed out")
+		}
+
+		if err := cmd.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		locks.RLock("lock_key")
+
+		cmd, locked := startLockHelper(t, dir, "rlock", "lock_key")
+
+		select {
+		case <-locked:
+			// expected: shared locks do not block each other
+		case <-time.After(10 * time.Second):
+			t.Error("expected helper to lock, but timed out")
+		}
+
+		if err := cmd.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		cmd, locked = startLockHelper(t, dir, "lock", "lock_key")
+
+		select {
+		case <-locked:
+			t.Error("expected helper to be blocked, but it locked")
+		case <-time.After(250 * time.Millisecond):
+			// expected: our shared lock blocks the helper
+		}
+
+		locks.RUnlock("lock_key")
+
+		select {
+		case <-locked:
+			// expected: helper got the lock after we unlocked
+		case <-time.After(10 * time.Second):
+			t.Error("expected helper to lock, but timed out")
+		}
+
+		if err := cmd.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestFileLockManagerTimeout(t *testing.T) {
+	dir := t.TempDir()
+	// two lock managers sharing a lock directory act like two processes
+	klm1, err := NewFileLockManager(dir, WithFileLockTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	klm2, err := NewFileLockManager(dir, WithFileLockTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = klm1.LockTxn("txn_1", "key_a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = klm2.LockTxn("txn_2", "key_b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// locking in opposite orders times out instead of hanging
+	errs := make(chan error, 2)
+	go func() { errs <- klm1.LockTxn("txn_1", "key_b") }()
+	go func() { errs <- klm2.LockTxn("txn_2", "key_a") }()
+	for i := 0; i < 2; i++ {
+		if err = <-errs; !errors.Is(err, ErrLockTimeout) || !kv.IsRetryable(err) {
+			t.Errorf("expected ErrLockTimeout, have: %v", err)
+		}
+	}
+
+	klm1.UnlockTxn("txn_1", "key_a")
+	if err = klm2.LockTxn("txn_2", "key_a"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileLockManagerReentrant(t *testing.T) {
+	klm, err := NewFileLockManager(t.TempDir(), WithFileLockTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a transaction may lock a key it holds
+	for _, lock := range []func(string, string) error{klm.LockTxn, klm.LockTxn, klm.RLockTxn} {
+		if err = lock("txn_1", "lock_key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	klm.UnlockTxn("txn_1", "lock_key")
+	klm.UnlockTxn("txn_1", "lock_key")
+	if err = klm.RLockTxn("txn_2", "lock_key"); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout while still held, have: %v", err)
+	}
+	klm.RUnlockTxn("txn_1", "lock_key")
+	if err = klm.LockTxn("txn_2", "lock_key"); err != nil {
+		t.Fatal(err)
+	}
+	klm.UnlockTxn("txn_2", "lock_key")
+
+	// but not upgrade a shared lock
+	if err = klm.RLockTxn("txn_1", "lock_key"); err != nil {
+		t.Fatal(err)
+	}
+	if err = klm.LockTxn("txn_1", "lock_key"); !errors.Is(err, ErrDeadlock) {
+		t.Errorf("expected ErrDeadlock, have: %v", err)
+	}
+	klm.RUnlockTxn("txn_1", "lock_key")
+	if len(klm.files) > 0 {
+		t.Errorf("expected no held lock files, have: %d", len(klm.files))
+	}
+}
+
+func TestFileLockManagerClean(t *testing.T) {
+	dir := t.TempDir()
+	klm, err := NewFileLockManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locks := testKeyLocks{t, klm}
+	locks.Lock("stale_key")
+	locks.Unlock("stale_key")
+
+	locks.Lock("held_key")
+
+	if err = klm.Clean(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(klm.lockPath("stale_key")); !os.IsNotExist(err) {
+		t.Errorf("expected stale lock file to be removed: %v", err)
+	}
+
+	if _, err = os.Stat(klm.lockPath("held_key")); err != nil {
+		t.Errorf("expected held lock file to exist: %v", err)
+	}
+
+	// make sure a lock file that was cleaned can be locked again
+	locks.Unlock("held_key")
+	if err = klm.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	locks.Lock("held_key")
+	locks.Unlock("held_key")
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+lockFileExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(matches), 1; have != want {
+		t.Errorf("have = %d, want = %d lock files", have, want)
+	}
+}
+
+func TestKVTxnFileLockManager(t *testing.T) {
+	klm, err := NewFileLockManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New(kvmap.New(), WithTxnKeyLockManager(klm))
+	ctx := context.Background()
+	test.TestBucketSimple(t, ctx, b)
+	test.TestTxnSimple(t, ctx, b, test.WithNoReadAfterRollback())
+}
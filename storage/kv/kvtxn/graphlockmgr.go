@@ -0,0 +1,349 @@
+package kvtxn
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// ErrDeadlock is returned when acquiring a lock would deadlock.
+// It is the same error as kv.ErrDeadlock.
+var ErrDeadlock = kv.ErrDeadlock
+
+// ErrLockTimeout is returned when a lock is not acquired in time.
+// It is the same error as kv.ErrLockTimeout.
+var ErrLockTimeout = kv.ErrLockTimeout
+
+// DefaultLockTimeout is the default time to wait for a lock for lock
+// managers that cannot detect deadlocks between processes.
+const DefaultLockTimeout = 30 * time.Second
+
+// TxnKeyLockManager works like KeyLockManager but is aware of which
+// transaction (lock owner) acquires and releases key locks.
+// An empty transaction ID is an anonymous, non-transactional, owner.
+// Lock acquisition can fail, for example with ErrDeadlock.
+type TxnKeyLockManager interface {
+	RLockTxn(txnID, key string) error
+	RUnlockTxn(txnID, key string)
+	LockTxn(txnID, key string) error
+	UnlockTxn(txnID, key string)
+}
+
+// TxnMultiKeyLockManager is a TxnKeyLockManager that can lock sets of
+// keys for writing in a deterministic order (see LockMany).
+type TxnMultiKeyLockManager interface {
+	TxnKeyLockManager
+	LockMany(txnID string, keys []string) error
+	UnlockMany(txnID string, keys []string)
+}
+
+// TxnKeyLockChecker is a TxnKeyLockManager whose locks can be lost
+// while held (for example when leases expire). Transactions check that
+// they still hold their locks before committing.
+type TxnKeyLockChecker interface {
+	TxnKeyLockManager
+	CheckLocksTxn(txnID string) error
+}
+
+// keyLockAdapter adapts a KeyLockManager to a TxnKeyLockManager.
+// Transaction IDs are ignored and locking never fails.
+type keyLockAdapter struct {
+	KeyLockManager
+}
+
+func (a keyLockAdapter) RLockTxn(_, key string) error {
+	a.RLock(key)
+	return nil
+}
+
+func (a keyLockAdapter) RUnlockTxn(_, key string) {
+	a.RUnlock(key)
+}
+
+func (a keyLockAdapter) LockTxn(_, key string) error {
+	a.Lock(key)
+	return nil
+}
+
+func (a keyLockAdapter) UnlockTxn(_, key string) {
+	a.Unlock(key)
+}
+
+// graphLock is the lock state of a single key.
+type graphLock struct {
+	writer  string
+	writers int            // number of write locks held by writer
+	readers map[string]int // number of read locks held by each reader
+}
+
+// blockers returns the lock holders that prevent txnID from locking.
+// Locks are re-entrant for the same (non-anonymous) transaction.
+func (l *graphLock) blockers(txnID string, exclusive bool) map[string]struct{} {
+	r := make(map[string]struct{})
+	if l.writers > 0 && (txnID == "" || l.writer != txnID) {
+		r[l.writer] = struct{}{}
+	}
+	if exclusive {
+		for reader := range l.readers {
+			if txnID == "" || reader != txnID {
+				r[reader] = struct{}{}
+			}
+		}
+	}
+	return r
+}
+
+// WaitGraphLockManager is a lock manager that supports locking on keys (strings).
+// It tracks which transactions wait on which other transactions (a
+// wait-for graph) and refuses a lock with ErrDeadlock when waiting
+// would close a cycle. The transaction that would close the cycle is
+// the one that receives the error and should be rolled back.
+//
+// Non-transactional (anonymous) locks never hold other locks while
+// waiting and so cannot deadlock.
+//
+// If configured with a lock timeout then transactions that wait
+// longer for a lock receive an ErrLockTimeout error.
+type WaitGraphLockManager struct {
+	m       sync.Mutex
+	cond    *sync.Cond
+	locks   map[string]*graphLock
+	waitFor map[string]map[string]struct{}
+	timeout time.Duration
+}
+
+// WaitGraphOption configures a WaitGraphLockManager.
+type WaitGraphOption func(*WaitGraphLockManager)
+
+// WithWaitGraphLockTimeout sets how long transactions wait for a lock.
+// The KeyLockManager methods (such as Lock) always wait without a timeout.
+func WithWaitGraphLockTimeout(d time.Duration) WaitGraphOption {
+	return func(klm *WaitGraphLockManager) {
+		klm.timeout = d
+	}
+}
+
+// NewWaitGraphLockManager creates a new deadlock detecting key lock manager.
+// Unless otherwise configured locks wait without a timeout.
+func NewWaitGraphLockManager(opts ...WaitGraphOption) *WaitGraphLockManager {
+	klm := &WaitGraphLockManager{
+		locks:   make(map[string]*graphLock),
+		waitFor: make(map[string]map[string]struct{}),
+	}
+	klm.cond = sync.NewCond(&klm.m)
+	for _, opt := range opts {
+		opt(klm)
+	}
+	return klm
+}
+
+// reaches reports whether txnID is reachable from the transactions in
+// from by following the wait-for graph.
+// klm.m should be locked.
+func (klm *WaitGraphLockManager) reaches(from map[string]struct{}, txnID string) bool {
+	visited := make(map[string]struct{})
+	var stack []string
+	for id := range from {
+		stack = append(stack, id)
+	}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if id == txnID {
+			return true
+		}
+		if _, ok := visited[id]; ok {
+			continue
+		}
+		visited[id] = struct{}{}
+		for next := range klm.waitFor[id] {
+			stack = append(stack, next)
+		}
+	}
+	return false
+}
+
+// lock acquires a lock on key for txnID.
+// ErrLockTimeout is returned if waiting longer than a positive timeout.
+func (klm *WaitGraphLockManager) lock(txnID, key string, exclusive bool, timeout time.Duration) error {
+	klm.m.Lock()
+	defer klm.m.Unlock()
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		// wake up waiters at the deadline
+		t := time.AfterFunc(timeout, func() {
+			klm.m.Lock()
+			klm.cond.Broadcast()
+			klm.m.Unlock()
+		})
+		defer t.Stop()
+	}
+
+	var l *graphLock
+	for {
+		var ok bool
+		l, ok = klm.locks[key]
+		if !ok || l == nil {
+			l = &graphLock{readers: make(map[string]int)}
+			klm.locks[key] = l
+		}
+
+		blockers := l.blockers(txnID, exclusive)
+		if len(blockers) < 1 {
+			break
+		}
+
+		if txnID != "" {
+			if klm.reaches(blockers, txnID) {
+				delete(klm.waitFor, txnID)
+				klm.cleanup(key, l)
+				return fmt.Errorf("%w: txn %s locking key %s", ErrDeadlock, txnID, key)
+			}
+			klm.waitFor[txnID] = blockers
+		}
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			delete(klm.waitFor, txnID)
+			klm.cleanup(key, l)
+			return fmt.Errorf("%w: txn %s locking key %s", ErrLockTimeout, txnID, key)
+		}
+
+		klm.cond.Wait()
+	}
+
+	if txnID != "" {
+		delete(klm.waitFor, txnID)
+	}
+
+	if exclusive {
+		l.writer = txnID
+		l.writers++
+	} else {
+		l.readers[txnID]++
+	}
+	return nil
+}
+
+// unlock releases a lock on key for txnID.
+func (klm *WaitGraphLockManager) unlock(txnID, key string, exclusive bool) {
+	klm.m.Lock()
+	defer klm.m.Unlock()
+
+	l, ok := klm.locks[key]
+	if !ok || l == nil {
+		// no lock present
+		return
+	}
+
+	if exclusive {
+		if l.writers > 0 {
+			l.writers--
+		}
+		if l.writers < 1 {
+			l.writer = ""
+		}
+	} else {
+		l.readers[txnID]--
+		if l.readers[txnID] < 1 {
+			delete(l.readers, txnID)
+		}
+	}
+	klm.cleanup(key, l)
+
+	klm.cond.Broadcast()
+}
+
+// cleanup removes the lock for key if it is no longer held.
+// klm.m should be locked.
+func (klm *WaitGraphLockManager) cleanup(key string, l *graphLock) {
+	if l.writers < 1 && len(l.readers) < 1 {
+		delete(klm.locks, key)
+	}
+}
+
+// RLockTxn locks key for reading by txnID.
+// ErrDeadlock is returned if waiting for the lock would deadlock and
+// ErrLockTimeout if waiting longer than the lock timeout.
+func (klm *WaitGraphLockManager) RLockTxn(txnID, key string) error {
+	return klm.lock(txnID, key, false, klm.timeout)
+}
+
+// RUnlockTxn undoes a single RLockTxn call for key by txnID.
+func (klm *WaitGraphLockManager) RUnlockTxn(txnID, key string) {
+	klm.unlock(txnID, key, false)
+}
+
+// LockTxn locks key for writing by txnID.
+// ErrDeadlock is returned if waiting for the lock would deadlock and
+// ErrLockTimeout if waiting longer than the lock timeout.
+func (klm *WaitGraphLockManager) LockTxn(txnID, key string) error {
+	return klm.lock(txnID, key, true, klm.timeout)
+}
+
+// UnlockTxn unlocks key for writing by txnID.
+func (klm *WaitGraphLockManager) UnlockTxn(txnID, key string) {
+	klm.unlock(txnID, key, true)
+}
+
+// LockMany locks keys for writing by txnID.
+// Keys are locked in a deterministic (sorted) order so that
+// transactions locking overlapping sets of keys with LockMany cannot
+// deadlock each other. If any lock fails then the already acquired
+// locks are released and the error is returned.
+func (klm *WaitGraphLockManager) LockMany(txnID string, keys []string) error {
+	sorted := make([]string, len(keys))
+	copy(sorted, keys)
+	sort.Strings(sorted)
+	var locked []string
+	for i, key := range sorted {
+		if i > 0 && key == sorted[i-1] {
+			// skip duplicates
+			continue
+		}
+		if err := klm.LockTxn(txnID, key); err != nil {
+			for j := len(locked) - 1; j >= 0; j-- {
+				klm.UnlockTxn(txnID, locked[j])
+			}
+			return err
+		}
+		locked = append(locked, key)
+	}
+	return nil
+}
+
+// UnlockMany unlocks keys locked with LockMany by txnID.
+func (klm *WaitGraphLockManager) UnlockMany(txnID string, keys []string) {
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		klm.UnlockTxn(txnID, key)
+	}
+}
+
+// RLock locks key in klm for reading as an anonymous owner.
+func (klm *WaitGraphLockManager) RLock(key string) {
+	klm.lock("", key, false, 0)
+}
+
+// RUnlock undoes a single RLock call for key in klm.
+func (klm *WaitGraphLockManager) RUnlock(key string) {
+	klm.unlock("", key, false)
+}
+
+// Lock locks key for writing in klm as an anonymous owner.
+func (klm *WaitGraphLockManager) Lock(key string) {
+	klm.lock("", key, true, 0)
+}
+
+// Unlock unlocks key for writing in klm.
+func (klm *WaitGraphLockManager) Unlock(key string) {
+	klm.unlock("", key, true)
+}
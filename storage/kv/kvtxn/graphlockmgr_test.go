@@ -0,0 +1,214 @@
+package kvtxn
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/test"
+)
+
+func TestWaitGraphLockManager(t *testing.T) {
+	timedKeyLockManagerTest(t, NewWaitGraphLockManager())
+}
+
+func TestWaitGraphLockManagerDeadlock(t *testing.T) {
+	klm := NewWaitGraphLockManager()
+
+	if err := klm.LockTxn("txn1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := klm.LockTxn("txn2", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// txn1 waits on txn2
+	var lockErr error
+	locked := make(chan struct{})
+	go func() {
+		lockErr = klm.LockTxn("txn1", "b")
+		close(locked)
+	}()
+	expectBlocked(t, locked)
+
+	// txn2 waiting on txn1 would close the cycle
+	err := klm.LockTxn("txn2", "a")
+	if !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("expected ErrDeadlock, have: %v", err)
+	}
+
+	// "roll back" txn2
+	klm.UnlockTxn("txn2", "b")
+
+	expectLocked(t, locked)
+	if lockErr != nil {
+		t.Fatal(lockErr)
+	}
+	klm.UnlockTxn("txn1", "a")
+	klm.UnlockTxn("txn1", "b")
+
+	if have := len(klm.locks); have != 0 {
+		t.Errorf("have = %d, want = 0 remaining locks", have)
+	}
+}
+
+func TestWaitGraphLockManagerTimeout(t *testing.T) {
+	ctx := context.Background()
+	klm := NewWaitGraphLockManager(WithWaitGraphLockTimeout(20 * time.Millisecond))
+	if err := klm.LockTxn("txn1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := klm.RLockTxn("txn2", "a"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expected ErrLockTimeout, have: %v", err)
+	}
+	if have := len(klm.waitFor); have != 0 {
+		t.Errorf("have = %d, want = 0 waiting transactions", have)
+	}
+
+	// a lock timeout is retried until the lock is released
+	b := New(kvmap.New(), WithTxnKeyLockManager(klm))
+	var attempts int
+	err := kv.PerformBucketTxnRetry(ctx, b, func(ctx context.Context, txn kv.Bucket) error {
+		if attempts++; attempts == 2 {
+			klm.UnlockTxn("txn1", "a")
+		}
+		return txn.Set(ctx, "a", []byte("a"))
+	}, kv.WithMaxAttempts(3), kv.WithBackoff(kv.Backoff{Initial: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("have = %d, want = 2 attempts", attempts)
+	}
+}
+
+func TestWaitGraphLockManagerLockMany(t *testing.T) {
+	klm := NewWaitGraphLockManager()
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i, keys := range [][]string{{"a", "b", "c"}, {"c", "b", "a", "a"}} {
+		wg.Add(1)
+		go func(txnID string, keys []string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := klm.LockMany(txnID, keys); err != nil {
+					errs <- err
+					continue
+				}
+				klm.UnlockMany(txnID, keys)
+			}
+		}(string(rune('x'+i)), keys)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestKVTxnDeadlock(t *testing.T) {
+	ctx := context.Background()
+	b := New(kvmap.New(), WithTxnKeyLockManager(NewWaitGraphLockManager()))
+	test.TestBucketSimple(t, ctx, b)
+	test.TestTxnSimple(t, ctx, b, test.WithNoReadAfterRollback())
+
+	// each transaction sets its first key then waits for the other
+	// transaction to do the same before setting its second key.
+	var ready sync.WaitGroup
+	ready.Add(2)
+	perform := func(first, second string) error {
+		return kv.PerformBucketTxn(ctx, b, func(ctx context.Context, txn kv.Bucket) error {
+			if err := txn.Set(ctx, first, []byte(first)); err != nil {
+				return err
+			}
+			ready.Done()
+			ready.Wait()
+			return txn.Set(ctx, second, []byte(first))
+		})
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, keys := range [][]string{{"a", "b"}, {"b", "a"}} {
+		wg.Add(1)
+		go func(i int, first, second string) {
+			defer wg.Done()
+			errs[i] = perform(first, second)
+		}(i, keys[0], keys[1])
+	}
+	wg.Wait()
+
+	var deadlocks int
+	winner := "a"
+	for i, err := range errs {
+		if errors.Is(err, ErrDeadlock) {
+			deadlocks++
+			if i == 0 {
+				winner = "b"
+			}
+		} else if err != nil {
+			t.Error(err)
+		}
+	}
+	if deadlocks != 1 {
+		t.Fatalf("expected exactly one deadlocked transaction, have: %v", errs)
+	}
+
+	// the winning transaction set both keys to its first key
+	for _, k := range []string{"a", "b"} {
+		v, err := b.Get(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := string(v), winner; have != want {
+			t.Errorf("key %s: have = %q, want = %q", k, have, want)
+		}
+	}
+}
+
+func TestKVTxnSetMany(t *testing.T) {
+	ctx := context.Background()
+	b := New(kvmap.New())
+
+	// overlapping key sets in different orders do not deadlock
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- kv.PerformBucketTxn(ctx, b, func(ctx context.Context, txn kv.Bucket) error {
+				m := map[string][]byte{"a": {byte(i)}, "b": {byte(i)}, "c": {byte(i)}}
+				if i%2 == 0 {
+					return txn.(*KVTxn).SetMany(ctx, m)
+				}
+				return txn.(*KVTxn).DeleteMany(ctx, []string{"c", "b", "a"})
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// auto-committed
+	if err := b.SetMany(ctx, map[string][]byte{"a": []byte("a"), "b": []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Get(ctx, "b"); err != nil || string(v) != "b" {
+		t.Errorf("expected b to be set: %v", err)
+	}
+	if err := b.DeleteMany(ctx, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := b.Has(ctx, "a"); err != nil || found {
+		t.Errorf("expected a to be deleted: %v", err)
+	}
+}
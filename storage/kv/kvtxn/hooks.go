@@ -0,0 +1,106 @@
+package kvtxn
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// AddPreCommitHook registers hook to run before b commits.
+// Transactions begun from b inherit its hooks. Hooks are also run for
+// auto-committed operations. A hook error aborts (rolls back) the commit.
+// Hooks may read through the committing transaction but not write to it.
+// Note hooks of auto-committed operations run with the operation's keys
+// locked so they should not read those keys through b.
+func (b *KVTxn) AddPreCommitHook(hook kv.PreCommitHook) {
+	b.stageLock.Lock()
+	defer b.stageLock.Unlock()
+	b.preHooks = append(b.preHooks, hook)
+}
+
+// AddPostCommitHook registers hook to run after b successfully commits.
+// Transactions begun from b inherit its hooks. Hooks are also run for
+// auto-committed operations.
+func (b *KVTxn) AddPostCommitHook(hook kv.PostCommitHook) {
+	b.stageLock.Lock()
+	defer b.stageLock.Unlock()
+	b.postHooks = append(b.postHooks, hook)
+}
+
+// changeSet builds the change set of the staged operations.
+func (b *KVTxn) changeSet(ctx context.Context) (*kv.ChangeSet, error) {
+	changes := &kv.ChangeSet{Set: make(map[string][]byte)}
+	for key, op := range b.stageKeyOps {
+		if op.del {
+			changes.Deleted = append(changes.Deleted, key)
+			continue
+		}
+		value, err := b.opValue(ctx, op)
+		if err != nil {
+			return nil, err
+		}
+		changes.Set[key] = value
+	}
+	sort.Strings(changes.Deleted)
+	return changes, nil
+}
+
+// commit runs the pre-commit hooks then commits the staged operations.
+// The pre-commit hooks run on a snapshot of the change set with the
+// stage unlocked so that they may read through b (see runPreHooks).
+// Optimistic transactions are then validated and locks that may be
+// lost are checked (see TxnKeyLockChecker). A validation, lock check,
+// or pre-commit hook error resets the stage (rolling back transactions).
+// The change set is returned for running the post-commit hooks once
+// the stage is unlocked. b.stageLock should be locked.
+func (b *KVTxn) commit(ctx context.Context) (changes *kv.ChangeSet, err error) {
+	if len(b.preHooks) > 0 || len(b.postHooks) > 0 {
+		if changes, err = b.changeSet(ctx); err != nil {
+			b.abort()
+			return nil, fmt.Errorf("building change set: %w", err)
+		}
+	}
+	if len(b.preHooks) > 0 && !changes.Empty() {
+		if err = b.runPreHooks(ctx, changes); err != nil {
+			b.abort()
+			return nil, fmt.Errorf("pre-commit hook: %w", err)
+		}
+	}
+	if b.commitLock != nil {
+		b.commitLock.Lock()
+		defer b.commitLock.Unlock()
+		if err = b.validate(ctx); err != nil {
+			b.abort()
+			return nil, err
+		}
+	}
+	if checker, ok := b.keyLock.(TxnKeyLockChecker); ok && len(b.stageKeyOps) > 0 {
+		if err = checker.CheckLocksTxn(b.id); err != nil {
+			b.abort()
+			return nil, fmt.Errorf("checking locks: %w", err)
+		}
+	}
+	return changes, b.stageCommit(ctx)
+}
+
+// runPreHooks runs the pre-commit hooks with changes.
+// b.stageLock should be locked. It is unlocked while the hooks run and
+// the transaction is marked as committing: reads are allowed but writes
+// are rejected with ErrReadOnly (and Commit and Rollback with ErrTxnClosed).
+func (b *KVTxn) runPreHooks(ctx context.Context, changes *kv.ChangeSet) error {
+	hooks := b.preHooks
+	b.state = txnCommitting
+	b.stageLock.Unlock()
+	defer func() {
+		b.stageLock.Lock()
+		b.state = txnActive
+	}()
+	for _, hook := range hooks {
+		if err := hook(ctx, changes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
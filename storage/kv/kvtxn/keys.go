@@ -10,7 +10,11 @@ import (
 // The keys channel should be closed if cancel was provided and closed.
 // Beware of deadlocks with underlying implementations.
 // Note that key-based stage locks are not consulted.
+// No keys are returned for completed transactions.
 func (b *KVTxn) Keys(ctx context.Context, cancel <-chan struct{}) <-chan string {
+	if b.closed() {
+		return closedKeys()
+	}
 	return b.keysWithStagedKeys(b.store.Keys(ctx, cancel), "", cancel)
 }
 
@@ -19,10 +23,21 @@ func (b *KVTxn) Keys(ctx context.Context, cancel <-chan struct{}) <-chan string
 // The keys channel should be closed if cancel was provided and closed.
 // Beware of deadlocks with underlying implementations.
 // Note that key-based stage locks are not consulted.
+// No keys are returned for completed transactions.
 func (b *KVTxn) KeysPrefix(ctx context.Context, prefix string, cancel <-chan struct{}) <-chan string {
+	if b.closed() {
+		return closedKeys()
+	}
 	return b.keysWithStagedKeys(b.store.KeysPrefix(ctx, prefix, cancel), prefix, cancel)
 }
 
+// closedKeys returns a closed keys channel.
+func closedKeys() <-chan string {
+	r := make(chan string)
+	close(r)
+	return r
+}
+
 // stageKeys returns a slice of all staged keys with prefix.
 // If prefix is empty then all staged keys are returned.
 // Keys that have a delete operation are not included if skipDeleted is true.
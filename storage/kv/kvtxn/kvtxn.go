@@ -7,7 +7,10 @@ package kvtxn
 import (
 	"context"
 	"sync"
+	"time"
 
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
 	"github.com/micromdm/nanolib/storage/kv"
 )
 
@@ -22,9 +25,22 @@ type KeyLockManager interface {
 // keyOp is a staged operation for a key.
 type keyOp struct {
 	value []byte
-	del   bool // if true this operation signifies a deletion (of a key)
+	del   bool      // if true this operation signifies a deletion (of a key)
+	size  int       // size of the staged value
+	file  string    // spill store key of a spilled value
+	mod   time.Time // when the value was staged
 }
 
+// txnState is the lifecycle state of a transaction.
+type txnState int
+
+const (
+	txnActive     txnState = iota
+	txnCommitting          // running pre-commit hooks
+	txnCommitted
+	txnRolledBack
+)
+
 // KVTxn is a key-value store wrapper that supports in-memory transactions.
 // Note the underlying KV store can still be inconsistent—this wrapper
 // does NOT gauarantee any commit atomicity.
@@ -33,48 +49,212 @@ type keyOp struct {
 // per-transaction. These staged operations can be rolled-back or
 // committed.
 // The store uses key-based mutexes for the duration of transactions
-// to try to maintain consistency.
+// to try to maintain consistency. Alternatively transactions can be
+// validated at commit instead of locking keys (see WithOptimistic).
 type KVTxn struct {
+	id          string
 	store       kv.KeysPrefixTraversingBucket
 	stageLock   sync.RWMutex
 	stageKeyOps map[string]keyOp
-	keyLock     KeyLockManager
+	keyLock     TxnKeyLockManager
 	autoCommit  bool
+	readOnly    bool
+	state       txnState
+	preHooks    []kv.PreCommitHook
+	postHooks   []kv.PostCommitHook
+	commitLock  *sync.Mutex        // serializes optimistic commits
+	versions    map[string]version // versions of keys for optimistic transactions
+	logger      log.Logger
+	label       string
+	begun       time.Time
+	maxKeys     int
+	maxBytes    int64
+	stageBytes  int64 // total size of staged values
+	spillDir    string
+	spill       *spill // spill store of staged values
+}
+
+type config struct {
+	keyLock    KeyLockManager
+	txnKeyLock TxnKeyLockManager
+	optimistic bool
+	logger     log.Logger
+	maxKeys    int
+	maxBytes   int64
+	spillDir   string
+}
+
+// Option configures a KVTxn.
+type Option func(*config)
+
+// WithKeyLockManager uses klm for transaction key locking.
+// Sharing a lock manager between stores (or processes, depending on
+// the lock manager) extends the scope of transaction locking.
+// KeyLockManagers are not aware of transactions and so cannot detect
+// deadlocks: transactions writing overlapping keys in different
+// orders may block forever. Prefer WithTxnKeyLockManager.
+func WithKeyLockManager(klm KeyLockManager) Option {
+	return func(c *config) {
+		c.keyLock = klm
+	}
+}
+
+// WithTxnKeyLockManager uses klm for transaction key locking.
+// Errors from klm (such as ErrDeadlock or ErrLockTimeout) are returned
+// from the transaction operations that lock keys.
+// Takes precedence over WithKeyLockManager.
+func WithTxnKeyLockManager(klm TxnKeyLockManager) Option {
+	return func(c *config) {
+		c.txnKeyLock = klm
+	}
+}
+
+// WithLogger sets the logger.
+// Transaction begin, commit, and rollback are logged at the debug
+// level (and errors at the info level) with their durations.
+func WithLogger(logger log.Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
 }
 
 // New creates a new in-memory transacting key-value store that wraps store.
-// Note that a single in-memory lock manager is created so transaction
-// locking will only be scoped to this newly created store.
-func New(store kv.KeysPrefixTraversingBucket) *KVTxn {
-	// create a new store with auto-commit on.
-	return new(store, NewInmemLockManager(), true)
+// Unless otherwise configured a single in-memory lock manager is
+// created so transaction locking will only be scoped to this newly
+// created store. It does not detect deadlocks: to have transactions
+// that would deadlock receive an ErrDeadlock error instead use
+// WithTxnKeyLockManager with a WaitGraphLockManager.
+func New(store kv.KeysPrefixTraversingBucket, opts ...Option) *KVTxn {
+	config := &config{logger: log.NopLogger}
+	for _, opt := range opts {
+		opt(config)
+	}
+	var b *KVTxn
+	if config.optimistic {
+		b = new(store, nopTxnKeyLockManager{}, true)
+		b.commitLock = &sync.Mutex{}
+	} else {
+		keyLock := config.txnKeyLock
+		if keyLock == nil {
+			if config.keyLock == nil {
+				config.keyLock = NewInmemLockManager()
+			}
+			keyLock = keyLockAdapter{config.keyLock}
+		}
+		// create a new store with auto-commit on.
+		b = new(store, keyLock, true)
+	}
+	b.logger = config.logger
+	b.maxKeys = config.maxKeys
+	b.maxBytes = config.maxBytes
+	b.spillDir = config.spillDir
+	return b
 }
 
 // new is a helper for creating KVTxns that wraps store.
-func new(store kv.KeysPrefixTraversingBucket, keyLock KeyLockManager, autoCommit bool) *KVTxn {
+// Non-auto-commit KVTxns are transactions and are given a new
+// transaction ID for key locking.
+func new(store kv.KeysPrefixTraversingBucket, keyLock TxnKeyLockManager, autoCommit bool) *KVTxn {
 	if store == nil {
 		panic("nil store")
 	}
 	if keyLock == nil {
 		panic("nil key lock manager")
 	}
+	var id string
+	if !autoCommit {
+		id = kv.NewID()
+	}
 	return &KVTxn{
+		id:          id,
 		store:       store,
 		stageKeyOps: make(map[string]keyOp),
 		keyLock:     keyLock,
 		autoCommit:  autoCommit,
+		logger:      log.NopLogger,
+	}
+}
+
+// newTxn creates a new non-auto-commit transaction wrapping the same
+// store that b wraps. The transaction inherits the commit hooks of b.
+func (b *KVTxn) newTxn() *KVTxn {
+	txn := new(b.store, b.keyLock, false)
+	txn.logger = b.logger
+	txn.maxKeys = b.maxKeys
+	txn.maxBytes = b.maxBytes
+	txn.spillDir = b.spillDir
+	if b.commitLock != nil {
+		txn.commitLock = b.commitLock
+		txn.versions = make(map[string]version)
+	}
+	b.stageLock.RLock()
+	defer b.stageLock.RUnlock()
+	txn.preHooks = append(txn.preHooks, b.preHooks...)
+	txn.postHooks = append(txn.postHooks, b.postHooks...)
+	return txn
+}
+
+// TxnID returns the transaction ID of b.
+// The ID is empty if b is not a transaction (i.e. it auto-commits).
+func (b *KVTxn) TxnID() string {
+	return b.id
+}
+
+// txnLogger returns a logger for logging about the transaction b.
+// The transaction ID is included unless it is already on ctx.
+func (b *KVTxn) txnLogger(ctx context.Context) log.Logger {
+	var logs []interface{}
+	if kv.GetTxnID(ctx) != b.id {
+		logs = append(logs, "txn_id", b.id)
+	}
+	if b.label != "" {
+		logs = append(logs, "label", b.label)
+	}
+	logger := ctxlog.Logger(ctx, b.logger)
+	if len(logs) > 0 {
+		logger = logger.With(logs...)
+	}
+	return logger
+}
+
+// logDone logs the completion of the transaction b by msg.
+// The completion started at start.
+func (b *KVTxn) logDone(ctx context.Context, msg string, start time.Time, err error) {
+	logs := []interface{}{
+		"msg", msg,
+		"duration", time.Since(start),
+		"txn_duration", time.Since(b.begun),
+	}
+	if err != nil {
+		b.txnLogger(ctx).Info(append(logs, "err", err)...)
+	} else {
+		b.txnLogger(ctx).Debug(logs...)
 	}
 }
 
 // stageGet retreives a key from the staged key operations.
-func (b *KVTxn) stageGet(key string) (value []byte, del bool, found bool) {
+// Spilled values are read from the spill store.
+func (b *KVTxn) stageGet(ctx context.Context, key string) (value []byte, del bool, found bool, err error) {
 	keyOp, ok := b.stageKeyOps[key]
-	return keyOp.value, keyOp.del, ok
+	if !ok || keyOp.del {
+		return nil, keyOp.del, ok, nil
+	}
+	value, err = b.opValue(ctx, keyOp)
+	return value, false, true, err
 }
 
 // stageSet sets a value for key in the staged key operations.
-func (b *KVTxn) stageSet(key string, value []byte) {
-	b.stageKeyOps[key] = keyOp{value: value}
+// Transactions configured to spill store the value in the spill store.
+func (b *KVTxn) stageSet(ctx context.Context, key string, value []byte) error {
+	op := keyOp{value: value, size: len(value), mod: time.Now()}
+	if b.spillDir != "" && !b.autoCommit {
+		file, err := b.spillSet(ctx, value)
+		if err != nil {
+			return err
+		}
+		op.value, op.file = nil, file
+	}
+	return b.stageOp(ctx, key, op)
 }
 
 // stageHas checks that a key can be found in the staged key operations.
@@ -84,17 +264,69 @@ func (b *KVTxn) stageHas(key string) (has, found bool) {
 }
 
 // stageDelete stages a key deletion in the staged key operations.
-func (b *KVTxn) stageDelete(key string) {
-	b.stageKeyOps[key] = keyOp{del: true}
+func (b *KVTxn) stageDelete(ctx context.Context, key string) error {
+	return b.stageOp(ctx, key, keyOp{del: true})
+}
+
+// stageOp replaces the staged operation for key with op.
+// A previously spilled value for key is removed from the spill store.
+func (b *KVTxn) stageOp(ctx context.Context, key string, op keyOp) error {
+	if prev, ok := b.stageKeyOps[key]; ok {
+		if prev.file != "" {
+			if err := b.spill.store.Delete(ctx, prev.file); err != nil {
+				return err
+			}
+		}
+		b.stageBytes -= int64(prev.size)
+	}
+	b.stageKeyOps[key] = op
+	b.stageBytes += int64(op.size)
+	return nil
+}
+
+// opValue returns the staged value of op.
+func (b *KVTxn) opValue(ctx context.Context, op keyOp) ([]byte, error) {
+	if op.file != "" {
+		return b.spill.store.Get(ctx, op.file)
+	}
+	return op.value, nil
 }
 
 // stageReset resets the staged operations.
-func (b *KVTxn) stageReset() {
+// The spill store (if any) is removed.
+func (b *KVTxn) stageReset() error {
 	for k := range b.stageKeyOps {
 		// make sure we unlock any keys in the stage
-		b.keyLock.Unlock(k)
+		b.keyLock.UnlockTxn(b.id, k)
 	}
 	b.stageKeyOps = make(map[string]keyOp)
+	b.stageBytes = 0
+	return b.spillReset()
+}
+
+// abort resets the staged operations and closes transactions.
+// Errors removing the spill store are ignored.
+func (b *KVTxn) abort() {
+	b.stageReset()
+	if !b.autoCommit {
+		b.state = txnRolledBack
+	}
+}
+
+// closed reports whether b is a completed transaction.
+// A read lock is obtained for the state lookup.
+func (b *KVTxn) closed() bool {
+	b.stageLock.RLock()
+	defer b.stageLock.RUnlock()
+	return b.state == txnCommitted || b.state == txnRolledBack
+}
+
+// committing reports whether b is running its pre-commit hooks.
+// A read lock is obtained for the state lookup.
+func (b *KVTxn) committing() bool {
+	b.stageLock.RLock()
+	defer b.stageLock.RUnlock()
+	return b.state == txnCommitting
 }
 
 // hasOp checks if there is an operation staged for key.
@@ -107,6 +339,7 @@ func (b *KVTxn) hasOp(key string) (ok bool) {
 }
 
 // stageCommit commits (sends) the staged operations to the wrapped KV store.
+// The spill store (if any) is removed once all operations are committed.
 func (b *KVTxn) stageCommit(ctx context.Context) error {
 	var err error
 	for key, op := range b.stageKeyOps {
@@ -114,14 +347,21 @@ func (b *KVTxn) stageCommit(ctx context.Context) error {
 			if op.del {
 				err = b.store.Delete(ctx, key)
 			} else {
-				err = b.store.Set(ctx, key, op.value)
+				var value []byte
+				if value, err = b.opValue(ctx, op); err == nil {
+					err = b.store.Set(ctx, key, value)
+				}
 			}
 		}
-		b.keyLock.Unlock(key)
+		b.keyLock.UnlockTxn(b.id, key)
 		// if we had no error, remove the operation
 		if err == nil {
 			delete(b.stageKeyOps, key)
+			b.stageBytes -= int64(op.size)
 		}
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	return b.spillReset()
 }
@@ -2,8 +2,11 @@ package kvtxn
 
 import (
 	"context"
+	"errors"
 	"testing"
 
+	logtest "github.com/micromdm/nanolib/log/test"
+	"github.com/micromdm/nanolib/storage/kv"
 	"github.com/micromdm/nanolib/storage/kv/kvmap"
 	"github.com/micromdm/nanolib/storage/kv/test"
 )
@@ -13,7 +16,124 @@ func TestKVTxn(t *testing.T) {
 	ctx := context.Background()
 	test.TestBucketSimple(t, ctx, b)
 	test.TestKeysTraversing(t, ctx, b)
-	test.TestTxnSimple(t, ctx, b)
+	test.TestErrors(t, ctx, b)
+	test.TestTxnSimple(t, ctx, b, test.WithNoReadAfterRollback())
+	test.TestTxnLifecycle(t, ctx, b)
+	test.TestTxnReadOnly(t, ctx, b)
+	test.TestCommitHooks(t, ctx, b)
 	b = New(kvmap.New()) // clear test data
 	t.Run("TestKVTxnKeys", func(t *testing.T) { test.TestKVTxnKeys(t, ctx, b) })
+	t.Run("TestErrorsTxn", func(t *testing.T) {
+		bt, err := b.BeginCRUDBucketTxn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.TestErrors(t, ctx, bt)
+		if err = bt.Rollback(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestKVTxnLogger(t *testing.T) {
+	ctx := context.Background()
+	logger := &logtest.Logger{KeepLastWith: true}
+	b := New(kvmap.New(), WithLogger(logger))
+
+	bt, err := b.BeginBucketTxnWithOptions(ctx, &kv.TxnOptions{Label: "test_label"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := bt.(kv.TxnIDer).TxnID()
+	if id == "" {
+		t.Fatal("expected transaction ID")
+	}
+	logtest.TestLastLogKeyValueMatches(t, logger, "msg", "begin transaction")
+
+	if err = bt.Set(ctx, "hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	logtest.TestLastLogKeyValueMatches(t, logger, "msg", "commit transaction")
+	logtest.TestLastLogKeyValueMatches(t, logger, "txn_id", id)
+	logtest.TestLastLogKeyValueMatches(t, logger, "label", "test_label")
+	for _, key := range []string{"duration", "txn_duration"} {
+		if _, v, _ := logger.LastKey(key); v == nil {
+			t.Errorf("expected %s to be logged", key)
+		}
+	}
+
+	bt, err = b.BeginBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	logtest.TestLastLogKeyValueMatches(t, logger, "msg", "rollback transaction")
+}
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+	for _, b := range []*KVTxn{
+		New(kvmap.New()),
+		New(kvmap.New(), WithSpill(t.TempDir())),
+	} {
+		test.TestStat(t, ctx, b)
+
+		bt, err := b.BeginBucketTxn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.TestStat(t, ctx, bt.(*KVTxn))
+		if err = bt.Rollback(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKVTxnHooksReadTxn(t *testing.T) {
+	ctx := context.Background()
+	b := New(kvmap.New())
+	if err := b.Set(ctx, "other", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	bt, err := b.BeginBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := bt.(*KVTxn)
+	var reads int
+	txn.AddPreCommitHook(func(ctx context.Context, _ *kv.ChangeSet) error {
+		// reads (including staged keys) through the committing txn
+		for _, key := range []string{"hello", "other"} {
+			if _, err := txn.Get(ctx, key); err != nil {
+				return err
+			}
+			reads++
+		}
+		if err := txn.Set(ctx, "hook", []byte("hook")); !errors.Is(err, kv.ErrReadOnly) {
+			t.Errorf("expected ErrReadOnly, have: %v", err)
+		}
+		return nil
+	})
+	txn.AddPostCommitHook(func(ctx context.Context, _ *kv.ChangeSet) {
+		if _, err := txn.Get(ctx, "hello"); !errors.Is(err, kv.ErrTxnClosed) {
+			t.Errorf("expected ErrTxnClosed, have: %v", err)
+		}
+	})
+	if err = txn.Set(ctx, "hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err = txn.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if reads != 2 {
+		t.Errorf("have: %d, want: 2 reads", reads)
+	}
+	if found, err := b.Has(ctx, "hook"); err != nil || found {
+		t.Errorf("expected hook to not be found: %v", err)
+	}
 }
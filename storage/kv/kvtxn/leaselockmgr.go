@@ -0,0 +1,573 @@
+package kvtxn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// ErrLeaseLost is returned when a lease for a held lock was lost (for
+// example if it could not be renewed before it expired).
+var ErrLeaseLost = errors.New("lease lost")
+
+// lease is a lock lease stored for a key.
+type lease struct {
+	// Owner is the owner ID of the exclusive lease holder.
+	Owner string `json:"owner,omitempty"`
+	// Expiry is when the exclusive lease expires in Unix nanoseconds.
+	Expiry int64 `json:"expiry,omitempty"`
+	// Readers maps the owner IDs of shared lease holders to their
+	// lease expiry in Unix nanoseconds.
+	Readers map[string]int64 `json:"readers,omitempty"`
+}
+
+// prune removes expired leases.
+func (l *lease) prune(now int64) {
+	if l.Owner != "" && l.Expiry <= now {
+		l.Owner = ""
+		l.Expiry = 0
+	}
+	for owner, expiry := range l.Readers {
+		if expiry <= now {
+			delete(l.Readers, owner)
+		}
+	}
+}
+
+// empty reports whether l has no lease holders.
+func (l *lease) empty() bool {
+	return l.Owner == "" && len(l.Readers) < 1
+}
+
+// heldLease is a lease held by a LeaseLockManager.
+type heldLease struct {
+	exclusive bool
+	expiry    int64 // lease expiry in Unix nanoseconds; 0 if lost
+	readers   int   // local shared locks
+	writers   int   // local exclusive locks
+}
+
+// LeaseLockManager is a lock manager that supports locking on keys (strings).
+// Locks are stored as expiring leases in a key-value store which
+// supports compare-and-swap. Multiple lease lock managers (e.g. on
+// different hosts) using the same store coordinate their locks.
+//
+// Leases for held locks are periodically renewed. If a lease holder
+// goes away (for example if the process dies) without unlocking then
+// the lease will be released once it expires.
+//
+// Locks within a single lease lock manager are coordinated in-memory
+// (using a WaitGraphLockManager) and share a single lease per key.
+//
+// LeaseLockManager is a TxnKeyLockChecker: use it with
+// WithTxnKeyLockManager. Lock acquisition then fails with
+// ErrLockTimeout if not acquired within the lock timeout and
+// transactions fail to commit with ErrLeaseLost if a lease for one of
+// their locks was lost. Because KeyLockManager methods cannot return
+// errors, they wait without a timeout and store errors are logged.
+type LeaseLockManager struct {
+	store   kv.CASBucket
+	owner   string
+	ttl     time.Duration
+	renew   time.Duration
+	poll    time.Duration
+	timeout time.Duration
+	clock   func() time.Time
+	logger  log.Logger
+
+	// local coordinates locks within this lock manager.
+	local *WaitGraphLockManager
+	// leaseLock serializes lease operations per key.
+	leaseLock *InmemLockManager
+
+	mu      sync.Mutex
+	held    map[string]*heldLease
+	txnKeys map[string]map[string]int // locks held by each transaction
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// LeaseOption configures a LeaseLockManager.
+type LeaseOption func(*LeaseLockManager)
+
+// WithLeaseOwner sets the owner ID of leases.
+// The owner ID must be unique among lock managers sharing a store.
+// By default a random owner ID is generated.
+func WithLeaseOwner(owner string) LeaseOption {
+	return func(m *LeaseLockManager) {
+		m.owner = owner
+	}
+}
+
+// WithLeaseTTL sets the duration of leases.
+// Unless otherwise configured leases are renewed at a third of ttl.
+func WithLeaseTTL(ttl time.Duration) LeaseOption {
+	return func(m *LeaseLockManager) {
+		m.ttl = ttl
+	}
+}
+
+// WithLeaseRenewInterval sets how often held leases are renewed.
+func WithLeaseRenewInterval(d time.Duration) LeaseOption {
+	return func(m *LeaseLockManager) {
+		m.renew = d
+	}
+}
+
+// WithLeasePollInterval sets how often lease acquisition is retried.
+func WithLeasePollInterval(d time.Duration) LeaseOption {
+	return func(m *LeaseLockManager) {
+		m.poll = d
+	}
+}
+
+// WithLeaseLockTimeout sets how long transactions wait for a lock.
+// A timeout less than 1 waits without a timeout.
+func WithLeaseLockTimeout(d time.Duration) LeaseOption {
+	return func(m *LeaseLockManager) {
+		m.timeout = d
+	}
+}
+
+// WithLeaseClock sets the clock used for lease expiry.
+func WithLeaseClock(clock func() time.Time) LeaseOption {
+	return func(m *LeaseLockManager) {
+		m.clock = clock
+	}
+}
+
+// WithLeaseLogger sets the logger.
+func WithLeaseLogger(logger log.Logger) LeaseOption {
+	return func(m *LeaseLockManager) {
+		m.logger = logger
+	}
+}
+
+// minLeaseRenewInterval is the minimum interval for renewing leases.
+const minLeaseRenewInterval = time.Millisecond
+
+// NewLeaseLockManager creates a new key lock manager storing leases in store.
+// Lease keys are the same as the locked keys so store should be
+// dedicated to leases (e.g. by using a prefixed store).
+// A goroutine is started to renew held leases. Stop it with Close.
+// The lease TTL must be positive. The renew interval is at least
+// one millisecond. Unless otherwise configured transactions wait for
+// locks for up to DefaultLockTimeout.
+func NewLeaseLockManager(store kv.CASBucket, opts ...LeaseOption) *LeaseLockManager {
+	if store == nil {
+		panic("nil store")
+	}
+	m := &LeaseLockManager{
+		store:     store,
+		ttl:       30 * time.Second,
+		poll:      100 * time.Millisecond,
+		timeout:   DefaultLockTimeout,
+		clock:     time.Now,
+		logger:    log.NopLogger,
+		leaseLock: NewInmemLockManager(),
+		held:      make(map[string]*heldLease),
+		txnKeys:   make(map[string]map[string]int),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.owner == "" {
+		m.owner = kv.NewID()
+	}
+	if m.ttl <= 0 {
+		panic("invalid lease TTL")
+	}
+	if m.renew <= 0 {
+		m.renew = m.ttl / 3
+	}
+	if m.renew < minLeaseRenewInterval {
+		m.renew = minLeaseRenewInterval
+	}
+	m.local = NewWaitGraphLockManager(WithWaitGraphLockTimeout(m.timeout))
+	go m.renewLoop()
+	return m
+}
+
+// Owner returns the owner ID of the leases of m.
+func (m *LeaseLockManager) Owner() string {
+	return m.owner
+}
+
+// Close stops renewing held leases.
+// Held leases are not released and will expire.
+func (m *LeaseLockManager) Close() {
+	m.closeOnce.Do(func() { close(m.done) })
+}
+
+// getLease retrieves the lease for key.
+// The raw stored value is returned for use with compare-and-swap.
+func (m *LeaseLockManager) getLease(ctx context.Context, key string) (*lease, []byte, error) {
+	raw, err := m.store.Get(ctx, key)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return &lease{}, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	l := &lease{}
+	if err = json.Unmarshal(raw, l); err != nil {
+		return nil, nil, fmt.Errorf("unmarshal lease: %w", err)
+	}
+	return l, raw, nil
+}
+
+// updateLease calls f with the current lease for key and stores the result.
+// If f returns false then the lease is not stored. Updates are retried
+// if the lease changed in the store.
+func (m *LeaseLockManager) updateLease(ctx context.Context, key string, f func(l *lease, now int64) bool) (bool, error) {
+	for {
+		l, old, err := m.getLease(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		now := m.clock().UnixNano()
+		l.prune(now)
+		if !f(l, now) {
+			return false, nil
+		}
+		var value []byte
+		if !l.empty() {
+			if value, err = json.Marshal(l); err != nil {
+				return false, fmt.Errorf("marshal lease: %w", err)
+			}
+		} else if old == nil {
+			// nothing to store or delete
+			return true, nil
+		}
+		swapped, err := m.store.CompareAndSwap(ctx, key, old, value)
+		if err != nil {
+			return false, err
+		} else if swapped {
+			return true, nil
+		}
+	}
+}
+
+// tryAcquire tries once to acquire a lease for key.
+// The expiry of the acquired lease is returned.
+func (m *LeaseLockManager) tryAcquire(ctx context.Context, key string, exclusive bool) (expiry int64, ok bool, err error) {
+	ok, err = m.updateLease(ctx, key, func(l *lease, now int64) bool {
+		expiry = now + int64(m.ttl)
+		if l.Owner != "" && l.Owner != m.owner {
+			return false
+		}
+		if exclusive {
+			for owner := range l.Readers {
+				if owner != m.owner {
+					return false
+				}
+			}
+			l.Readers = nil
+			l.Owner, l.Expiry = m.owner, expiry
+			return true
+		}
+		if l.Readers == nil {
+			l.Readers = make(map[string]int64)
+		}
+		l.Readers[m.owner] = expiry
+		return true
+	})
+	return
+}
+
+// acquire acquires a lease for key, waiting until it is available.
+// The expiry of the acquired lease is returned. ErrLockTimeout is
+// returned if ctx passes its deadline while waiting.
+func (m *LeaseLockManager) acquire(ctx context.Context, key string, exclusive bool) (int64, error) {
+	for {
+		expiry, ok, err := m.tryAcquire(ctx, key, exclusive)
+		if err != nil && ctx.Err() == nil {
+			m.logger.Info("msg", "acquiring lease", "key", key, "err", err)
+		} else if ok {
+			return expiry, nil
+		}
+		t := time.NewTimer(m.poll)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return 0, fmt.Errorf("%w: lease for key %s", ErrLockTimeout, key)
+			}
+			return 0, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// release releases our lease for key.
+func (m *LeaseLockManager) release(key string) {
+	_, err := m.updateLease(context.Background(), key, func(l *lease, _ int64) bool {
+		if l.Owner == m.owner {
+			l.Owner, l.Expiry = "", 0
+		}
+		delete(l.Readers, m.owner)
+		return true
+	})
+	if err != nil {
+		m.logger.Info("msg", "releasing lease", "key", key, "err", err)
+	}
+}
+
+// downgrade exchanges our exclusive lease for key for a shared lease.
+func (m *LeaseLockManager) downgrade(key string) {
+	_, err := m.updateLease(context.Background(), key, func(l *lease, now int64) bool {
+		if l.Owner == m.owner {
+			l.Owner, l.Expiry = "", 0
+		}
+		if l.Readers == nil {
+			l.Readers = make(map[string]int64)
+		}
+		l.Readers[m.owner] = now + int64(m.ttl)
+		return true
+	})
+	if err != nil {
+		m.logger.Info("msg", "downgrading lease", "key", key, "err", err)
+	}
+}
+
+// renewLoop periodically renews held leases until m is closed.
+func (m *LeaseLockManager) renewLoop() {
+	ticker := time.NewTicker(m.renew)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.renewAll()
+		}
+	}
+}
+
+// renewAll renews the expiry of all held leases.
+// Leases that are no longer found are marked as lost.
+func (m *LeaseLockManager) renewAll() {
+	m.mu.Lock()
+	held := make(map[string]*heldLease, len(m.held))
+	for k, h := range m.held {
+		if h.expiry != 0 {
+			held[k] = h
+		}
+	}
+	m.mu.Unlock()
+	ctx := context.Background()
+	for key, h := range held {
+		var expiry int64
+		ok, err := m.updateLease(ctx, key, func(l *lease, now int64) bool {
+			expiry = now + int64(m.ttl)
+			_, reader := l.Readers[m.owner]
+			if reader {
+				l.Readers[m.owner] = expiry
+			}
+			if l.Owner == m.owner {
+				l.Expiry = expiry
+				return true
+			}
+			return reader
+		})
+		if err != nil {
+			m.logger.Info("msg", "renewing lease", "key", key, "err", err)
+			continue
+		}
+		m.mu.Lock()
+		if m.held[key] == h {
+			if ok {
+				h.expiry = expiry
+			} else {
+				h.expiry = 0
+				m.logger.Info("msg", "renewing lease", "key", key, "err", ErrLeaseLost)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// lease acquires (or shares) the lease for a lock on key by txnID.
+// An exclusive lease is acquired for the first local exclusive lock.
+// A shared lease is acquired for the first local lock.
+func (m *LeaseLockManager) lease(ctx context.Context, txnID, key string, exclusive bool) error {
+	m.leaseLock.Lock(key)
+	defer m.leaseLock.Unlock(key)
+
+	m.mu.Lock()
+	h := m.held[key]
+	acquire := h == nil || (exclusive && !h.exclusive)
+	m.mu.Unlock()
+
+	var expiry int64
+	if acquire {
+		var err error
+		if expiry, err = m.acquire(ctx, key, exclusive); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h == nil {
+		h = &heldLease{}
+		m.held[key] = h
+	}
+	if acquire {
+		h.exclusive = h.exclusive || exclusive
+		h.expiry = expiry
+	}
+	if exclusive {
+		h.writers++
+	} else {
+		h.readers++
+	}
+	keys, ok := m.txnKeys[txnID]
+	if !ok {
+		keys = make(map[string]int)
+		m.txnKeys[txnID] = keys
+	}
+	keys[key]++
+	return nil
+}
+
+// unlease undoes a single lease call for key by txnID.
+// The lease is released for the last local lock or downgraded to a
+// shared lease for the last local exclusive lock.
+func (m *LeaseLockManager) unlease(txnID, key string, exclusive bool) {
+	m.leaseLock.Lock(key)
+	defer m.leaseLock.Unlock(key)
+
+	m.mu.Lock()
+	h, ok := m.held[key]
+	if !ok {
+		// no lock present
+		m.mu.Unlock()
+		return
+	}
+	if exclusive && h.writers > 0 {
+		h.writers--
+	} else if !exclusive && h.readers > 0 {
+		h.readers--
+	}
+	if keys, ok := m.txnKeys[txnID]; ok {
+		if keys[key]--; keys[key] < 1 {
+			delete(keys, key)
+		}
+		if len(keys) < 1 {
+			delete(m.txnKeys, txnID)
+		}
+	}
+	var release, downgrade bool
+	if h.writers < 1 && h.readers < 1 {
+		delete(m.held, key)
+		release = true
+	} else if h.exclusive && h.writers < 1 {
+		h.exclusive = false
+		downgrade = true
+	}
+	m.mu.Unlock()
+
+	if release {
+		m.release(key)
+	} else if downgrade {
+		m.downgrade(key)
+	}
+}
+
+// lockContext returns a context for acquiring leases within the lock timeout.
+func (m *LeaseLockManager) lockContext() (context.Context, context.CancelFunc) {
+	if m.timeout > 0 {
+		return context.WithTimeout(context.Background(), m.timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// RLockTxn locks key in m for reading by txnID.
+// A shared lease is acquired for the first local lock.
+// ErrLockTimeout is returned if not locked within the lock timeout.
+func (m *LeaseLockManager) RLockTxn(txnID, key string) error {
+	ctx, cancel := m.lockContext()
+	defer cancel()
+	if err := m.local.RLockTxn(txnID, key); err != nil {
+		return err
+	}
+	if err := m.lease(ctx, txnID, key, false); err != nil {
+		m.local.RUnlockTxn(txnID, key)
+		return err
+	}
+	return nil
+}
+
+// RUnlockTxn undoes a single RLockTxn call for key by txnID.
+func (m *LeaseLockManager) RUnlockTxn(txnID, key string) {
+	m.unlease(txnID, key, false)
+	m.local.RUnlockTxn(txnID, key)
+}
+
+// LockTxn locks key in m for writing by txnID.
+// An exclusive lease is acquired for the first local exclusive lock.
+// ErrLockTimeout is returned if not locked within the lock timeout.
+func (m *LeaseLockManager) LockTxn(txnID, key string) error {
+	ctx, cancel := m.lockContext()
+	defer cancel()
+	if err := m.local.LockTxn(txnID, key); err != nil {
+		return err
+	}
+	if err := m.lease(ctx, txnID, key, true); err != nil {
+		m.local.UnlockTxn(txnID, key)
+		return err
+	}
+	return nil
+}
+
+// UnlockTxn unlocks key for writing in m by txnID.
+func (m *LeaseLockManager) UnlockTxn(txnID, key string) {
+	m.unlease(txnID, key, true)
+	m.local.UnlockTxn(txnID, key)
+}
+
+// CheckLocksTxn returns an ErrLeaseLost error if the lease for any
+// lock held by txnID was lost or has expired.
+func (m *LeaseLockManager) CheckLocksTxn(txnID string) error {
+	now := m.clock().UnixNano()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.txnKeys[txnID] {
+		if h, ok := m.held[key]; !ok || h.expiry <= now {
+			return fmt.Errorf("%w: key %s", ErrLeaseLost, key)
+		}
+	}
+	return nil
+}
+
+// RLock locks key in m for reading.
+// It waits without a timeout for the shared lease.
+func (m *LeaseLockManager) RLock(key string) {
+	m.local.RLock(key)
+	m.lease(context.Background(), "", key, false)
+}
+
+// RUnlock undoes a single RLock call for key in m.
+func (m *LeaseLockManager) RUnlock(key string) {
+	m.RUnlockTxn("", key)
+}
+
+// Lock locks key for writing in m.
+// It waits without a timeout for the exclusive lease.
+func (m *LeaseLockManager) Lock(key string) {
+	m.local.Lock(key)
+	m.lease(context.Background(), "", key, true)
+}
+
+// Unlock unlocks key for writing in m.
+func (m *LeaseLockManager) Unlock(key string) {
+	m.UnlockTxn("", key)
+}
@@ -0,0 +1,274 @@
+package kvtxn
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/test"
+)
+
+// testClock is a manually advanced clock.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// lockAsync locks key using lockFn in a goroutine.
+// The returned channel is closed once locked.
+func lockAsync(lockFn func(string), key string) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		lockFn(key)
+		close(ch)
+	}()
+	return ch
+}
+
+func expectBlocked(t *testing.T, ch <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ch:
+		t.Error("expected to be blocked, but locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func expectLocked(t *testing.T, ch <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected to lock, but timed out")
+	}
+}
+
+func TestLeaseLockManager(t *testing.T) {
+	klm := NewLeaseLockManager(kvmap.New(), WithLeasePollInterval(time.Millisecond))
+	defer klm.Close()
+	timedKeyLockManagerTest(t, klm)
+
+	ctx := context.Background()
+	b := New(kvmap.New(), WithTxnKeyLockManager(klm))
+	test.TestBucketSimple(t, ctx, b)
+	test.TestTxnSimple(t, ctx, b, test.WithNoReadAfterRollback())
+}
+
+func TestLeaseLockManagerIntervals(t *testing.T) {
+	// a tiny TTL does not panic renewing leases
+	klm := NewLeaseLockManager(kvmap.New(), WithLeaseTTL(2))
+	defer klm.Close()
+	if have, want := klm.renew, minLeaseRenewInterval; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for zero TTL")
+		}
+	}()
+	NewLeaseLockManager(kvmap.New(), WithLeaseTTL(0))
+}
+
+func TestLeaseLockManagerShared(t *testing.T) {
+	store := kvmap.New()
+	clock := &testClock{now: time.Unix(1000, 0)}
+	opts := []LeaseOption{
+		WithLeasePollInterval(time.Millisecond),
+		WithLeaseClock(clock.Now),
+	}
+	a := NewLeaseLockManager(store, opts...)
+	defer a.Close()
+	b := NewLeaseLockManager(store, opts...)
+	defer b.Close()
+
+	// shared leases from different managers do not block
+	a.RLock("lock_key")
+	a.RLock("lock_key")
+	expectLocked(t, lockAsync(b.RLock, "lock_key"))
+
+	// but exclusive leases do
+	locked := lockAsync(b.Lock, "other_key")
+	expectLocked(t, locked)
+	a.RUnlock("lock_key")
+	locked = lockAsync(a.Lock, "other_key")
+	expectBlocked(t, locked)
+	b.Unlock("other_key")
+	expectLocked(t, locked)
+	a.Unlock("other_key")
+
+	// b's shared lease still blocks
+	a.RUnlock("lock_key")
+	locked = lockAsync(a.Lock, "lock_key")
+	expectBlocked(t, locked)
+	b.RUnlock("lock_key")
+	expectLocked(t, locked)
+	a.Unlock("lock_key")
+
+	// all leases were released
+	if keys := kv.AllKeys(context.Background(), store); len(keys) > 0 {
+		t.Errorf("expected no leases, have: %v", keys)
+	}
+}
+
+func TestLeaseLockManagerExpiry(t *testing.T) {
+	store := kvmap.New()
+	clock := &testClock{now: time.Unix(1000, 0)}
+	opts := []LeaseOption{
+		WithLeaseTTL(10 * time.Second),
+		WithLeasePollInterval(time.Millisecond),
+		WithLeaseClock(clock.Now),
+	}
+	a := NewLeaseLockManager(store, append(opts, WithLeaseRenewInterval(time.Hour))...)
+	b := NewLeaseLockManager(store, opts...)
+	defer b.Close()
+
+	a.Lock("lock_key")
+
+	// simulate a dying holder: it never renews or unlocks
+	a.Close()
+
+	locked := lockAsync(b.Lock, "lock_key")
+	expectBlocked(t, locked)
+
+	clock.Add(5 * time.Second)
+	expectBlocked(t, locked)
+
+	clock.Add(5 * time.Second)
+	expectLocked(t, locked)
+	b.Unlock("lock_key")
+}
+
+func TestLeaseLockManagerRenew(t *testing.T) {
+	store := kvmap.New()
+	clock := &testClock{now: time.Unix(1000, 0)}
+	opts := []LeaseOption{
+		WithLeaseTTL(10 * time.Second),
+		WithLeasePollInterval(time.Millisecond),
+		WithLeaseClock(clock.Now),
+	}
+	a := NewLeaseLockManager(store, append(opts, WithLeaseRenewInterval(time.Millisecond))...)
+	defer a.Close()
+	b := NewLeaseLockManager(store, opts...)
+	defer b.Close()
+
+	a.Lock("lock_key")
+
+	locked := lockAsync(b.Lock, "lock_key")
+
+	// advance beyond the original lease expiry giving a time to renew
+	for i := 0; i < 4; i++ {
+		clock.Add(5 * time.Second)
+		expectBlocked(t, locked)
+	}
+
+	a.Unlock("lock_key")
+	expectLocked(t, locked)
+	b.Unlock("lock_key")
+}
+
+func TestLeaseLockManagerTimeout(t *testing.T) {
+	store := kvmap.New()
+	opts := []LeaseOption{
+		WithLeasePollInterval(time.Millisecond),
+		WithLeaseLockTimeout(50 * time.Millisecond),
+	}
+	a := NewLeaseLockManager(store, opts...)
+	defer a.Close()
+	b := NewLeaseLockManager(store, opts...)
+	defer b.Close()
+
+	if err := a.LockTxn("txn_1", "lock_key"); err != nil {
+		t.Fatal(err)
+	}
+	// waiting on the local lock and on the lease times out
+	if err := a.LockTxn("txn_2", "lock_key"); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout, have: %v", err)
+	}
+	if err := b.RLockTxn("txn_3", "lock_key"); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout, have: %v", err)
+	}
+
+	// locks are re-entrant for a transaction
+	if err := a.RLockTxn("txn_1", "lock_key"); err != nil {
+		t.Fatal(err)
+	}
+	a.UnlockTxn("txn_1", "lock_key")
+	if err := b.LockTxn("txn_3", "lock_key"); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout for the shared lease, have: %v", err)
+	}
+	a.RUnlockTxn("txn_1", "lock_key")
+	if err := b.LockTxn("txn_3", "lock_key"); err != nil {
+		t.Fatal(err)
+	}
+	b.UnlockTxn("txn_3", "lock_key")
+	if keys := kv.AllKeys(context.Background(), store); len(keys) > 0 {
+		t.Errorf("expected no leases, have: %v", keys)
+	}
+}
+
+func TestLeaseLockManagerLost(t *testing.T) {
+	ctx := context.Background()
+	store := kvmap.New()
+	clock := &testClock{now: time.Unix(1000, 0)}
+	a := NewLeaseLockManager(store,
+		WithLeaseTTL(10*time.Second),
+		WithLeaseRenewInterval(time.Millisecond),
+		WithLeaseClock(clock.Now),
+	)
+	defer a.Close()
+	b := New(kvmap.New(), WithTxnKeyLockManager(a))
+
+	begin := func(key string) *KVTxn {
+		t.Helper()
+		bt, err := b.BeginBucketTxn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = bt.Set(ctx, key, []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+		return bt.(*KVTxn)
+	}
+
+	// a lease removed from the store is found lost when renewing
+	txn := begin("key_1")
+	if err := store.Delete(ctx, "key_1"); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); a.CheckLocksTxn(txn.TxnID()) == nil; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected lease to be lost")
+		}
+	}
+	if err := txn.Commit(ctx); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("expected ErrLeaseLost, have: %v", err)
+	}
+	if found, err := b.Has(ctx, "key_1"); err != nil || found {
+		t.Errorf("expected key_1 to not be committed: %v", err)
+	}
+
+	// a lease that expired without being renewed is lost
+	a.Close()
+	txn = begin("key_2")
+	clock.Add(10 * time.Second)
+	if err := txn.Commit(ctx); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("expected ErrLeaseLost, have: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package kvtxn
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// KeyLockInfo is a snapshot of the lock state of a key.
+type KeyLockInfo struct {
+	Key string `json:"key"`
+
+	// Readers is the number of read locks held.
+	Readers int `json:"readers"`
+
+	// Writer is true if the write lock is held.
+	Writer bool `json:"writer"`
+
+	// Waiting is the number of lockers waiting to acquire the lock.
+	Waiting int `json:"waiting"`
+
+	// HeldSince is when the lock was first held by its current holders.
+	// It is the zero time if the lock is not held.
+	HeldSince time.Time `json:"held_since"`
+
+	// HeldFor is how long the lock has been held for in nanoseconds.
+	HeldFor time.Duration `json:"held_for_ns"`
+}
+
+// LockInfoer reports the lock state of keys.
+type LockInfoer interface {
+	Locks() []KeyLockInfo
+}
+
+// NewLockInfoHandler responds with the JSON lock state of keys in li.
+// The JSON is in the form of `{"locks":[{"key":"k","readers":1,...}]}`.
+// The lock state can be sensitive: consider protecting the handler
+// with authentication.
+func NewLockInfoHandler(li LockInfoer) http.HandlerFunc {
+	if li == nil {
+		panic("nil lock infoer")
+	}
+	return func(w http.ResponseWriter, _ *http.Request) {
+		locks := li.Locks()
+		if locks == nil {
+			locks = []KeyLockInfo{}
+		}
+		body, err := json.Marshal(struct {
+			Locks []KeyLockInfo `json:"locks"`
+		}{Locks: locks})
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
@@ -0,0 +1,106 @@
+package kvtxn
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitLocks waits until the lock state of klm satisfies f.
+func waitLocks(t *testing.T, klm *InmemLockManager, f func([]KeyLockInfo) bool) []KeyLockInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		locks := klm.Locks()
+		if f(locks) {
+			return locks
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for lock state, have: %v", locks)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInmemLockManagerLocks(t *testing.T) {
+	klm := NewInmemLockManager()
+
+	klm.Lock("key_a")
+	klm.RLock("key_b")
+	klm.RLock("key_b")
+
+	done := make(chan struct{})
+	go func() {
+		klm.Lock("key_a")
+		klm.Unlock("key_a")
+		close(done)
+	}()
+
+	locks := waitLocks(t, klm, func(locks []KeyLockInfo) bool {
+		return len(locks) == 2 && locks[0].Waiting == 1
+	})
+
+	for _, info := range locks {
+		if info.HeldSince.IsZero() || info.HeldFor < 0 {
+			t.Errorf("%s: expected held lock, have: %v", info.Key, info)
+		}
+	}
+	for i := range locks {
+		locks[i].HeldSince, locks[i].HeldFor = time.Time{}, 0
+	}
+	want := []KeyLockInfo{
+		{Key: "key_a", Writer: true, Waiting: 1},
+		{Key: "key_b", Readers: 2},
+	}
+	if !reflect.DeepEqual(locks, want) {
+		t.Errorf("have: %v, want: %v", locks, want)
+	}
+
+	klm.Unlock("key_a")
+	<-done
+	klm.RUnlock("key_b")
+	klm.RUnlock("key_b")
+
+	if locks = klm.Locks(); len(locks) != 0 {
+		t.Errorf("expected no locks, have: %v", locks)
+	}
+}
+
+func TestLockInfoHandler(t *testing.T) {
+	klm := NewInmemLockManager()
+	h := NewLockInfoHandler(klm)
+
+	get := func() (r struct{ Locks []KeyLockInfo }) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if have, want := rec.Code, http.StatusOK; have != want {
+			t.Fatalf("have: %d, want: %d", have, want)
+		}
+		if have, want := rec.Header().Get("Content-Type"), "application/json"; have != want {
+			t.Errorf("have: %q, want: %q", have, want)
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if r := get(); r.Locks == nil || len(r.Locks) != 0 {
+		t.Errorf("expected empty locks, have: %v", r.Locks)
+	}
+
+	klm.Lock("key_a")
+	defer klm.Unlock("key_a")
+
+	r := get()
+	if len(r.Locks) != 1 {
+		t.Fatalf("expected 1 lock, have: %v", r.Locks)
+	}
+	if info := r.Locks[0]; info.Key != "key_a" || !info.Writer || info.HeldSince.IsZero() {
+		t.Errorf("unexpected lock info: %v", info)
+	}
+}
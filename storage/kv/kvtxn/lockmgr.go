@@ -1,103 +1,222 @@
 package kvtxn
 
 import (
+	"sort"
 	"sync"
+	"time"
 )
 
+// DefaultShards is the default number of InmemLockManager shards.
+const DefaultShards = 64
+
+// keyLock is a reference counted lock for a single key.
+type keyLock struct {
+	sync.RWMutex
+	refs      int // number of lockers holding or waiting on this lock
+	readers   int
+	writer    bool
+	heldSince time.Time
+}
+
+// held records that lock was acquired.
+func (lock *keyLock) held(write bool) {
+	if lock.readers < 1 && !lock.writer {
+		lock.heldSince = time.Now()
+	}
+	if write {
+		lock.writer = true
+	} else {
+		lock.readers++
+	}
+}
+
+// released records that lock was released.
+func (lock *keyLock) released(write bool) {
+	if write {
+		lock.writer = false
+	} else if lock.readers > 0 {
+		lock.readers--
+	}
+	if lock.readers < 1 && !lock.writer {
+		lock.heldSince = time.Time{}
+	}
+}
+
+// lockShard holds the key locks for a subset of keys.
+type lockShard struct {
+	m     sync.Mutex
+	locks map[string]*keyLock
+}
+
 // InmemLockManager is a lock manager that supports locking on keys (strings).
-// In-memory native map based.
+// In-memory native map based. Keys are spread across shards (each with
+// their own mutex) to reduce contention between unrelated keys.
 type InmemLockManager struct {
-	locks    map[string]*sync.RWMutex
-	counters map[string]int
-	m        sync.Mutex
+	shards []lockShard
+	mask   uint32
+	pool   sync.Pool
 }
 
-// NewInmemLockManager creates a new key lock manager.
-func NewInmemLockManager() *InmemLockManager {
-	return &InmemLockManager{
-		locks:    make(map[string]*sync.RWMutex),
-		counters: make(map[string]int),
+type inmemConfig struct {
+	shards int
+}
+
+// InmemLockManagerOption configures an InmemLockManager.
+type InmemLockManagerOption func(*inmemConfig)
+
+// WithShards sets the number of shards to n.
+// The number of shards is rounded up to a power of two.
+func WithShards(n int) InmemLockManagerOption {
+	return func(c *inmemConfig) {
+		c.shards = n
 	}
 }
 
-// RLock locks key lock in klm for reading.
-// RLock on a sync.RWMutex is called under the hood.
-func (klm *InmemLockManager) RLock(key string) {
-	klm.m.Lock()
+// NewInmemLockManager creates a new key lock manager.
+// Unless otherwise configured DefaultShards shards are used.
+func NewInmemLockManager(opts ...InmemLockManagerOption) *InmemLockManager {
+	config := &inmemConfig{shards: DefaultShards}
+	for _, opt := range opts {
+		opt(config)
+	}
+	n := 1
+	for n < config.shards {
+		n <<= 1
+	}
+	klm := &InmemLockManager{
+		shards: make([]lockShard, n),
+		mask:   uint32(n - 1),
+		pool:   sync.Pool{New: func() interface{} { return &keyLock{} }},
+	}
+	for i := range klm.shards {
+		klm.shards[i].locks = make(map[string]*keyLock)
+	}
+	return klm
+}
 
-	lock, ok := klm.locks[key]
-	if !ok || lock == nil {
-		lock = &sync.RWMutex{}
-		klm.locks[key] = lock
+// shard returns the shard for key using the FNV-1a hash of key.
+func (klm *InmemLockManager) shard(key string) *lockShard {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	h := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= prime32
 	}
+	return &klm.shards[h&klm.mask]
+}
 
-	klm.counters[key]++
+// acquire references the lock for key, creating it if needed.
+func (klm *InmemLockManager) acquire(key string) *keyLock {
+	s := klm.shard(key)
+	s.m.Lock()
+	defer s.m.Unlock()
 
-	klm.m.Unlock()
+	lock, ok := s.locks[key]
+	if !ok {
+		lock = klm.pool.Get().(*keyLock)
+		s.locks[key] = lock
+	}
+	lock.refs++
 
-	lock.RLock()
+	return lock
 }
 
-// RUnlock undoes a single RLock call for key in klm.
-// RUnlock on a sync.RWMutex is called under the hood.
-func (klm *InmemLockManager) RUnlock(key string) {
-	klm.m.Lock()
-	defer klm.m.Unlock()
-
-	lock, ok := klm.locks[key]
-	if !ok || lock == nil {
-		// no lock present, remove the keys anyway
-		delete(klm.counters, key)
-		delete(klm.locks, key)
+// held records that the lock for key was acquired.
+func (klm *InmemLockManager) held(key string, lock *keyLock, write bool) {
+	s := klm.shard(key)
+	s.m.Lock()
+	defer s.m.Unlock()
+	lock.held(write)
+}
+
+// release unlocks the lock for key and dereferences it.
+// Unreferenced locks are removed and returned to the pool.
+func (klm *InmemLockManager) release(key string, write bool) {
+	s := klm.shard(key)
+	s.m.Lock()
+
+	lock, ok := s.locks[key]
+	if !ok {
+		// no lock present
+		s.m.Unlock()
 		return
 	}
 
-	klm.counters[key]--
-	lock.RUnlock()
+	lock.refs--
+	lock.released(write)
+	if write {
+		lock.Unlock()
+	} else {
+		lock.RUnlock()
+	}
 
-	if klm.counters[key] <= 0 {
-		delete(klm.counters, key)
-		delete(klm.locks, key)
+	if lock.refs > 0 {
+		s.m.Unlock()
+		return
 	}
+	delete(s.locks, key)
+	s.m.Unlock()
+
+	klm.pool.Put(lock)
+}
+
+// RLock locks key lock in klm for reading.
+// RLock on a sync.RWMutex is called under the hood.
+func (klm *InmemLockManager) RLock(key string) {
+	lock := klm.acquire(key)
+	lock.RLock()
+	klm.held(key, lock, false)
+}
+
+// RUnlock undoes a single RLock call for key in klm.
+// RUnlock on a sync.RWMutex is called under the hood.
+func (klm *InmemLockManager) RUnlock(key string) {
+	klm.release(key, false)
 }
 
 // Lock locks key for writing in klm.
 // Lock on a sync.RWMutex is called under the hood.
 func (klm *InmemLockManager) Lock(key string) {
-	klm.m.Lock()
-
-	lock, ok := klm.locks[key]
-	if !ok || lock == nil {
-		lock = &sync.RWMutex{}
-		klm.locks[key] = lock
-	}
-
-	klm.counters[key]++
-
-	klm.m.Unlock()
-
+	lock := klm.acquire(key)
 	lock.Lock()
+	klm.held(key, lock, true)
 }
 
 // Unlock unlocks key for writing in klm.
 // Unlock on a sync.RWMutex is called under the hood.
 func (klm *InmemLockManager) Unlock(key string) {
-	klm.m.Lock()
-	defer klm.m.Unlock()
-
-	lock, ok := klm.locks[key]
-	if !ok || lock == nil {
-		// no lock present, remove the keys anyway
-		delete(klm.counters, key)
-		delete(klm.locks, key)
-		return
-	}
-
-	klm.counters[key]--
-	lock.Unlock()
+	klm.release(key, true)
+}
 
-	if klm.counters[key] <= 0 {
-		delete(klm.counters, key)
-		delete(klm.locks, key)
+// Locks returns a snapshot of the lock state of all keys sorted by key.
+// Keys are included if their lock is held or waited on.
+func (klm *InmemLockManager) Locks() []KeyLockInfo {
+	now := time.Now()
+	var infos []KeyLockInfo
+	for i := range klm.shards {
+		s := &klm.shards[i]
+		s.m.Lock()
+		for key, lock := range s.locks {
+			info := KeyLockInfo{
+				Key:       key,
+				Readers:   lock.readers,
+				Writer:    lock.writer,
+				Waiting:   lock.refs - lock.readers,
+				HeldSince: lock.heldSince,
+			}
+			if lock.writer {
+				info.Waiting--
+			}
+			if !lock.heldSince.IsZero() {
+				info.HeldFor = now.Sub(lock.heldSince)
+			}
+			infos = append(infos, info)
+		}
+		s.m.Unlock()
 	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos
 }
@@ -1,13 +1,77 @@
 package kvtxn
 
 import (
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestKeyLockManager(t *testing.T) {
 	timedKeyLockManagerTest(t, NewInmemLockManager())
+	for _, shards := range []int{1, 3, 16} {
+		t.Run("shards-"+strconv.Itoa(shards), func(t *testing.T) {
+			timedKeyLockManagerTest(t, NewInmemLockManager(WithShards(shards)))
+		})
+	}
+}
+
+func TestKeyLockManagerShards(t *testing.T) {
+	for _, test := range []struct {
+		shards int
+		want   int
+	}{
+		{0, 1},
+		{1, 1},
+		{3, 4},
+		{64, 64},
+	} {
+		klm := NewInmemLockManager(WithShards(test.shards))
+		if have, want := len(klm.shards), test.want; have != want {
+			t.Errorf("shards %d: have: %d, want: %d", test.shards, have, want)
+		}
+	}
+}
+
+func TestKeyLockManagerParallel(t *testing.T) {
+	klm := NewInmemLockManager(WithShards(4))
+	const workers, iterations, keys = 8, 500, 16
+	// each counter is only accessed under the lock for its key
+	counters := make([]int, keys)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				n := (i + j) % keys
+				key := "key_" + strconv.Itoa(n)
+				klm.Lock(key)
+				counters[n]++
+				klm.Unlock(key)
+				klm.RLock(key)
+				_ = counters[n]
+				klm.RUnlock(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var total int
+	for _, c := range counters {
+		total += c
+	}
+	if have, want := total, workers*iterations; have != want {
+		t.Errorf("have: %d, want: %d", have, want)
+	}
+
+	// all locks should have been released
+	for i := range klm.shards {
+		if have := len(klm.shards[i].locks); have != 0 {
+			t.Errorf("shard %d: have: %d locks, want: 0", i, have)
+		}
+	}
 }
 
 func timedKeyLockManagerTest(t *testing.T, klm KeyLockManager) {
@@ -58,3 +122,99 @@ func timedKeyLockManagerTest(t *testing.T, klm KeyLockManager) {
 		t.Error("expected second lock to have happened, but didn't")
 	}
 }
+
+// mutexLockManager is the previous InmemLockManager implementation
+// which guards all keys with a single mutex. Kept for benchmarking.
+type mutexLockManager struct {
+	locks    map[string]*sync.RWMutex
+	counters map[string]int
+	m        sync.Mutex
+}
+
+func newMutexLockManager() *mutexLockManager {
+	return &mutexLockManager{
+		locks:    make(map[string]*sync.RWMutex),
+		counters: make(map[string]int),
+	}
+}
+
+func (klm *mutexLockManager) lock(key string) *sync.RWMutex {
+	klm.m.Lock()
+	defer klm.m.Unlock()
+	lock, ok := klm.locks[key]
+	if !ok || lock == nil {
+		lock = &sync.RWMutex{}
+		klm.locks[key] = lock
+	}
+	klm.counters[key]++
+	return lock
+}
+
+func (klm *mutexLockManager) unlock(key string, unlock func(*sync.RWMutex)) {
+	klm.m.Lock()
+	defer klm.m.Unlock()
+	lock, ok := klm.locks[key]
+	if !ok || lock == nil {
+		delete(klm.counters, key)
+		delete(klm.locks, key)
+		return
+	}
+	klm.counters[key]--
+	unlock(lock)
+	if klm.counters[key] <= 0 {
+		delete(klm.counters, key)
+		delete(klm.locks, key)
+	}
+}
+
+func (klm *mutexLockManager) RLock(key string) { klm.lock(key).RLock() }
+func (klm *mutexLockManager) Lock(key string)  { klm.lock(key).Lock() }
+
+func (klm *mutexLockManager) RUnlock(key string) {
+	klm.unlock(key, func(lock *sync.RWMutex) { lock.RUnlock() })
+}
+
+func (klm *mutexLockManager) Unlock(key string) {
+	klm.unlock(key, func(lock *sync.RWMutex) { lock.Unlock() })
+}
+
+func BenchmarkKeyLockManager(b *testing.B) {
+	managers := []struct {
+		name string
+		new  func() KeyLockManager
+	}{
+		{"mutex", func() KeyLockManager { return newMutexLockManager() }},
+		{"sharded-1", func() KeyLockManager { return NewInmemLockManager(WithShards(1)) }},
+		{"sharded-16", func() KeyLockManager { return NewInmemLockManager(WithShards(16)) }},
+		{"sharded-64", func() KeyLockManager { return NewInmemLockManager() }},
+		{"sharded-256", func() KeyLockManager { return NewInmemLockManager(WithShards(256)) }},
+	}
+	for _, keys := range []int{16, 1024} {
+		keyNames := make([]string, keys)
+		for i := range keyNames {
+			keyNames[i] = "bench_key_" + strconv.Itoa(i)
+		}
+		for _, m := range managers {
+			b.Run("keys-"+strconv.Itoa(keys)+"/"+m.name, func(b *testing.B) {
+				klm := m.new()
+				var worker uint32
+				b.ReportAllocs()
+				b.RunParallel(func(pb *testing.PB) {
+					// spread the starting key of each worker
+					i := int(atomic.AddUint32(&worker, 1)) * 7919
+					for pb.Next() {
+						key := keyNames[i%keys]
+						if i%4 == 0 {
+							klm.Lock(key)
+							klm.Unlock(key)
+						} else {
+							klm.RLock(key)
+							klm.RUnlock(key)
+						}
+						i++
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package kvtxn
+
+import (
+	"context"
+	"sort"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// write is a staged write of a multi-key operation.
+type write struct {
+	key   string
+	value []byte
+	del   bool
+}
+
+// checkMultiOp returns an error for the multi-key op on key if b is
+// closed, read-only or running pre-commit hooks.
+func (b *KVTxn) checkMultiOp(op, key string) error {
+	var err error
+	if b.closed() {
+		err = kv.ErrTxnClosed
+	} else if b.readOnly || b.committing() {
+		err = kv.ErrReadOnly
+	}
+	if err != nil {
+		return &kv.KeyError{Op: op, Key: key, Err: err}
+	}
+	return nil
+}
+
+// lockKeys locks keys for writing by b in a deterministic (sorted)
+// order so that multi-key operations cannot deadlock each other.
+// Duplicate keys and keys already locked by b (i.e. staged) are
+// skipped. LockMany is used if supported by the lock manager.
+// The newly locked keys are returned. On error no keys are newly locked.
+func (b *KVTxn) lockKeys(keys []string) ([]string, error) {
+	seen := make(map[string]struct{}, len(keys))
+	var toLock []string
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if !b.hasOp(key) {
+			toLock = append(toLock, key)
+		}
+	}
+	sort.Strings(toLock)
+	if mklm, ok := b.keyLock.(TxnMultiKeyLockManager); ok {
+		if err := mklm.LockMany(b.id, toLock); err != nil {
+			return nil, err
+		}
+		return toLock, nil
+	}
+	for i, key := range toLock {
+		if err := b.keyLock.LockTxn(b.id, key); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				b.keyLock.UnlockTxn(b.id, toLock[j])
+			}
+			return nil, err
+		}
+	}
+	return toLock, nil
+}
+
+// lockWrites locks keys for writing (see lockKeys) and records their
+// versions if tracking. The newly locked keys are returned (even on error).
+func (b *KVTxn) lockWrites(ctx context.Context, keys []string) (locked []string, err error) {
+	if locked, err = b.lockKeys(keys); err != nil || !b.tracking() {
+		return
+	}
+	for _, key := range keys {
+		if err = b.observeWrite(ctx, key); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// releaseUnstaged unlocks the keys that have no staged operation.
+// b.stageLock should be locked.
+func (b *KVTxn) releaseUnstaged(keys []string) {
+	for _, key := range keys {
+		if _, ok := b.stageKeyOps[key]; !ok {
+			b.keyLock.UnlockTxn(b.id, key)
+		}
+	}
+}
+
+// releaseWrites unlocks the locked keys that have no staged operation.
+func (b *KVTxn) releaseWrites(locked []string) {
+	b.stageLock.Lock()
+	defer b.stageLock.Unlock()
+	b.releaseUnstaged(locked)
+}
+
+// stageWrites stages writes (locked by lockWrites).
+// On error the locked keys that were not staged are unlocked.
+func (b *KVTxn) stageWrites(ctx context.Context, writes []write, locked []string) error {
+	b.stageLock.Lock()
+	defer b.stageLock.Unlock()
+	var err error
+	for i := 0; err == nil && i < len(writes); i++ {
+		w := writes[i]
+		if err = b.checkLimits(w.key, len(w.value)); err != nil {
+			break
+		}
+		if w.del {
+			err = b.stageDelete(ctx, w.key)
+		} else {
+			err = b.stageSet(ctx, w.key, w.value)
+		}
+	}
+	if err != nil {
+		b.releaseUnstaged(locked)
+	}
+	return err
+}
+
+// perform runs f with a new transaction of the auto-commit store b
+// and commits it. Auto-committed operations use transactions so that
+// they have their own stage and their key locks have an owner (e.g.
+// for deadlock detection). These transactions are not logged, do not
+// spill and do not track versions for optimistic validation.
+func (b *KVTxn) perform(ctx context.Context, f func(txn *KVTxn) error) error {
+	txn := b.newTxn()
+	txn.logger = log.NopLogger
+	txn.spillDir = ""
+	txn.versions = nil
+	if err := f(txn); err != nil {
+		txn.Rollback(ctx)
+		return err
+	}
+	return txn.Commit(ctx)
+}
+
+// SetMany stages setting the keys in m to their values.
+// All keys are locked at once in a deterministic (sorted) order, using
+// LockMany if the lock manager supports it (see TxnMultiKeyLockManager).
+// Transactions that write overlapping sets of keys with SetMany and
+// DeleteMany thus cannot deadlock each other. The sets may be
+// auto-committed (as a single commit).
+// An ErrReadOnly error is returned for read-only transactions and an
+// ErrTxnClosed error for completed transactions.
+func (b *KVTxn) SetMany(ctx context.Context, m map[string][]byte) error {
+	writes := make([]write, 0, len(m))
+	for key, value := range m {
+		writes = append(writes, write{key: key, value: value})
+	}
+	return b.writeMany(ctx, "set many", writes)
+}
+
+// DeleteMany stages deleting keys.
+// See SetMany for locking.
+func (b *KVTxn) DeleteMany(ctx context.Context, keys []string) error {
+	writes := make([]write, len(keys))
+	for i, key := range keys {
+		writes[i] = write{key: key, del: true}
+	}
+	return b.writeMany(ctx, "delete many", writes)
+}
+
+// writeMany locks and stages writes for the multi-key op.
+func (b *KVTxn) writeMany(ctx context.Context, op string, writes []write) error {
+	if len(writes) < 1 {
+		return b.checkMultiOp(op, "")
+	}
+	if b.autoCommit {
+		return b.perform(ctx, func(txn *KVTxn) error {
+			return txn.writeMany(ctx, op, writes)
+		})
+	}
+	keys := make([]string, len(writes))
+	for i, w := range writes {
+		if err := b.checkOp(op, w.key, true); err != nil {
+			return err
+		}
+		keys[i] = w.key
+	}
+	locked, err := b.lockWrites(ctx, keys)
+	if err != nil {
+		b.releaseWrites(locked)
+		return &kv.KeyError{Op: op, Key: keys[0], Err: err}
+	}
+	if err = b.stageWrites(ctx, writes, locked); err != nil {
+		return &kv.KeyError{Op: op, Key: keys[0], Err: err}
+	}
+	return nil
+}
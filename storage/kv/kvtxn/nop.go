@@ -43,3 +43,41 @@ func (b *NopTxn) Commit(context.Context) error {
 func (b *NopTxn) Rollback(context.Context) error {
 	return nil
 }
+
+// readOnlyNopTxn is a NopTxn that rejects writes.
+type readOnlyNopTxn struct {
+	*NopTxn
+}
+
+// Set returns an ErrReadOnly error.
+func (b *readOnlyNopTxn) Set(_ context.Context, key string, _ []byte) error {
+	return &kv.KeyError{Op: "set", Key: key, Err: kv.ErrReadOnly}
+}
+
+// Delete returns an ErrReadOnly error.
+func (b *readOnlyNopTxn) Delete(_ context.Context, key string) error {
+	return &kv.KeyError{Op: "delete", Key: key, Err: kv.ErrReadOnly}
+}
+
+// withOptions returns a read-only wrapper of b if opts is read-only.
+func (b *NopTxn) withOptions(opts *kv.TxnOptions) kv.BucketTxnCompleter {
+	if opts != nil && opts.ReadOnly {
+		return &readOnlyNopTxn{NopTxn: b}
+	}
+	return b
+}
+
+// BeginCRUDBucketTxnWithOptions returns b, or a read-only wrapper of b if opts is read-only.
+func (b *NopTxn) BeginCRUDBucketTxnWithOptions(_ context.Context, opts *kv.TxnOptions) (kv.CRUDBucketTxnCompleter, error) {
+	return b.withOptions(opts), nil
+}
+
+// BeginKeysPrefixTraversingBucketTxnWithOptions returns b, or a read-only wrapper of b if opts is read-only.
+func (b *NopTxn) BeginKeysPrefixTraversingBucketTxnWithOptions(_ context.Context, opts *kv.TxnOptions) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
+	return b.withOptions(opts), nil
+}
+
+// BeginBucketTxnWithOptions returns b, or a read-only wrapper of b if opts is read-only.
+func (b *NopTxn) BeginBucketTxnWithOptions(_ context.Context, opts *kv.TxnOptions) (kv.BucketTxnCompleter, error) {
+	return b.withOptions(opts), nil
+}
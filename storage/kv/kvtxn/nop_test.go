@@ -16,7 +16,9 @@ func TestNop(t *testing.T) {
 		t.Fatal(err)
 	}
 	test.TestBucketSimple(t, ctx, b)
+	test.TestErrors(t, ctx, b)
 	test.TestKeysTraversing(t, ctx, b)
+	test.TestTxnReadOnly(t, ctx, b)
 
 	// We cannot run `test.TestTxnSimple()` because NopTxn does not
 	// actually support commit/rollback (i.e. caching transaction data)
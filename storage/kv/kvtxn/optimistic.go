@@ -0,0 +1,99 @@
+package kvtxn
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// WithOptimistic uses optimistic concurrency control for transactions.
+// Transactions do not lock keys. Instead the versions (value hashes) of
+// keys read and written are recorded and validated at commit. If
+// another commit changed any of those keys then the transaction is
+// rolled back and an ErrConflict error is returned.
+// Key lock manager options are ignored in optimistic mode.
+// Note that keys traversed but not read are not validated.
+func WithOptimistic() Option {
+	return func(c *config) {
+		c.optimistic = true
+	}
+}
+
+// nopTxnKeyLockManager does not lock keys.
+type nopTxnKeyLockManager struct{}
+
+func (nopTxnKeyLockManager) RLockTxn(_, _ string) error { return nil }
+func (nopTxnKeyLockManager) RUnlockTxn(_, _ string)     {}
+func (nopTxnKeyLockManager) LockTxn(_, _ string) error  { return nil }
+func (nopTxnKeyLockManager) UnlockTxn(_, _ string)      {}
+
+// version is the state of a key in the wrapped store.
+type version struct {
+	found bool
+	hash  [sha256.Size]byte
+}
+
+// newVersion creates a version from the result of a wrapped store Get.
+// Returns false if the result was an error other than ErrKeyNotFound.
+func newVersion(value []byte, err error) (version, bool) {
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return version{}, true
+	} else if err != nil {
+		return version{}, false
+	}
+	return version{found: true, hash: sha256.Sum256(value)}, true
+}
+
+// tracking reports whether b records key versions.
+func (b *KVTxn) tracking() bool {
+	return b.versions != nil
+}
+
+// observe records the version of key from the result of a wrapped store Get.
+// Only the first observed version of key is kept.
+func (b *KVTxn) observe(key string, value []byte, err error) {
+	v, ok := newVersion(value, err)
+	if !ok {
+		return
+	}
+	b.stageLock.Lock()
+	defer b.stageLock.Unlock()
+	if _, found := b.versions[key]; !found {
+		b.versions[key] = v
+	}
+}
+
+// observeWrite records the version of key before it is first written.
+func (b *KVTxn) observeWrite(ctx context.Context, key string) error {
+	b.stageLock.RLock()
+	_, found := b.versions[key]
+	b.stageLock.RUnlock()
+	if found {
+		return nil
+	}
+	value, err := b.store.Get(ctx, key)
+	if err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+		return err
+	}
+	b.observe(key, value, err)
+	return nil
+}
+
+// validate checks that the recorded key versions still match the wrapped store.
+// An ErrConflict error is returned for the first mismatched key.
+// The commit lock should be locked.
+func (b *KVTxn) validate(ctx context.Context) error {
+	for key, v := range b.versions {
+		value, err := b.store.Get(ctx, key)
+		cur, ok := newVersion(value, err)
+		if !ok {
+			return err
+		}
+		if cur != v {
+			return &kv.KeyError{Op: "commit", Key: key, Err: kv.ErrConflict}
+		}
+	}
+	return nil
+}
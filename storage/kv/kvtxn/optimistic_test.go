@@ -0,0 +1,168 @@
+package kvtxn
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/test"
+)
+
+func TestKVTxnOptimistic(t *testing.T) {
+	b := New(kvmap.New(), WithOptimistic())
+	ctx := context.Background()
+	test.TestBucketSimple(t, ctx, b)
+	test.TestKeysTraversing(t, ctx, b)
+	test.TestErrors(t, ctx, b)
+	test.TestTxnSimple(t, ctx, b, test.WithNoReadAfterRollback())
+	test.TestTxnLifecycle(t, ctx, b)
+	test.TestTxnReadOnly(t, ctx, b)
+	test.TestCommitHooks(t, ctx, b)
+}
+
+// expectConflict checks that err is a commit conflict for key.
+func expectConflict(t *testing.T, err error, key string) {
+	t.Helper()
+	if !errors.Is(err, kv.ErrConflict) {
+		t.Fatalf("expected conflict error, have: %v", err)
+	}
+	var keyErr *kv.KeyError
+	if !errors.As(err, &keyErr) || keyErr.Key != key {
+		t.Errorf("expected KeyError for key %q, have: %v", key, err)
+	}
+}
+
+func TestKVTxnOptimisticConflict(t *testing.T) {
+	b := New(kvmap.New(), WithOptimistic())
+	ctx := context.Background()
+
+	if err := b.Set(ctx, "key", []byte("val1")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("read", func(t *testing.T) {
+		bt1, _ := b.BeginBucketTxn(ctx)
+		bt2, _ := b.BeginBucketTxn(ctx)
+
+		if _, err := bt1.Get(ctx, "key"); err != nil {
+			t.Fatal(err)
+		}
+		if err := bt1.Set(ctx, "other_key", []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt2.Set(ctx, "key", []byte("val2")); err != nil {
+			t.Fatal(err)
+		}
+		if err := bt2.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		expectConflict(t, bt1.Commit(ctx), "key")
+
+		// the conflicting transaction was rolled back
+		if found, err := b.Has(ctx, "other_key"); err != nil || found {
+			t.Errorf("expected other_key to not be found: %v", err)
+		}
+		if err := bt1.Rollback(ctx); !errors.Is(err, kv.ErrTxnClosed) {
+			t.Errorf("expected ErrTxnClosed, have: %v", err)
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		bt1, _ := b.BeginBucketTxn(ctx)
+		bt2, _ := b.BeginBucketTxn(ctx)
+
+		// neither write blocks the other
+		if err := bt1.Set(ctx, "key", []byte("val3")); err != nil {
+			t.Fatal(err)
+		}
+		if err := bt2.Delete(ctx, "key"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bt2.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		expectConflict(t, bt1.Commit(ctx), "key")
+
+		if found, err := b.Has(ctx, "key"); err != nil || found {
+			t.Errorf("expected key to not be found: %v", err)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		bt1, _ := b.BeginBucketTxn(ctx)
+
+		if found, err := bt1.Has(ctx, "key"); err != nil || found {
+			t.Fatalf("expected key to not be found: %v", err)
+		}
+
+		// a key created after it was read conflicts
+		if err := b.Set(ctx, "key", []byte("val4")); err != nil {
+			t.Fatal(err)
+		}
+		expectConflict(t, bt1.Commit(ctx), "key")
+	})
+
+	t.Run("disjoint", func(t *testing.T) {
+		bt1, _ := b.BeginBucketTxn(ctx)
+		bt2, _ := b.BeginBucketTxn(ctx)
+
+		if err := bt1.Set(ctx, "key_1", []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+		if err := bt2.Set(ctx, "key_2", []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+		if err := bt2.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := bt1.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestKVTxnOptimisticRetry(t *testing.T) {
+	b := New(kvmap.New(), WithOptimistic())
+	ctx := context.Background()
+
+	const workers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := kv.PerformBucketTxnRetry(ctx, b, func(ctx context.Context, bt kv.Bucket) error {
+				var n int
+				value, err := bt.Get(ctx, "counter")
+				if err == nil {
+					if n, err = strconv.Atoi(string(value)); err != nil {
+						return err
+					}
+				} else if !errors.Is(err, kv.ErrKeyNotFound) {
+					return err
+				}
+				return bt.Set(ctx, "counter", []byte(strconv.Itoa(n+1)))
+			}, kv.WithMaxAttempts(100), kv.WithBackoff(kv.Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond, Jitter: 1}))
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := b.Get(ctx, "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(value), strconv.Itoa(workers); have != want {
+		t.Errorf("have: %s, want: %s", have, want)
+	}
+}
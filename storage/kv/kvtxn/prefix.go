@@ -0,0 +1,42 @@
+package kvtxn
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// DeletePrefix stages deletes for all keys starting with prefix.
+// This includes staged keys. The deletes may be auto-committed (as a
+// single commit). If an error occurs then transactions may be left
+// with some of the deletes staged.
+// An ErrReadOnly error is returned for read-only transactions and an
+// ErrTxnClosed error for completed transactions.
+func (b *KVTxn) DeletePrefix(ctx context.Context, prefix string) error {
+	if err := b.checkMultiOp("delete prefix", prefix); err != nil {
+		return err
+	}
+	if b.autoCommit {
+		return b.perform(ctx, func(txn *KVTxn) error {
+			return txn.DeletePrefix(ctx, prefix)
+		})
+	}
+	keys := kv.AllKeysPrefix(ctx, b, prefix)
+	if err := ctx.Err(); err != nil {
+		return &kv.KeyError{Op: "delete prefix", Key: prefix, Err: fmt.Errorf("finding keys: %w", err)}
+	}
+	locked, err := b.lockWrites(ctx, keys)
+	if err != nil {
+		b.releaseWrites(locked)
+		return &kv.KeyError{Op: "delete prefix", Key: prefix, Err: err}
+	}
+	writes := make([]write, len(keys))
+	for i, key := range keys {
+		writes[i] = write{key: key, del: true}
+	}
+	if err = b.stageWrites(ctx, writes, locked); err != nil {
+		return &kv.KeyError{Op: "delete prefix", Key: prefix, Err: err}
+	}
+	return nil
+}
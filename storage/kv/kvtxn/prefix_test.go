@@ -0,0 +1,139 @@
+package kvtxn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/test"
+)
+
+func TestDeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	b := New(kvmap.New())
+	test.TestDeletePrefix(t, ctx, b)
+	test.TestDeletePrefix(t, ctx, New(kvmap.New(), WithOptimistic()))
+
+	err := kv.SetMap(ctx, b, map[string][]byte{
+		"dp.1": []byte("1"),
+		"dp.2": []byte("2"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bt, err := b.BeginKeysPrefixTraversingBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Set(ctx, "dp.3", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.(kv.PrefixDeleter).DeletePrefix(ctx, "dp."); err != nil {
+		t.Fatal(err)
+	}
+	if have := kv.AllKeysPrefix(ctx, bt, "dp."); len(have) > 0 {
+		t.Errorf("expected no keys in transaction, have: %v", have)
+	}
+	if err = bt.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(kv.AllKeysPrefix(ctx, b, "dp.")), 2; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// exceeding the stage limits stages nothing and releases key locks
+	b = New(kvmap.New(), WithStageLimits(1, 0))
+	if err = kv.SetMap(ctx, b, map[string][]byte{"dp.1": nil, "dp.2": nil}); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.DeletePrefix(ctx, "dp."); !errors.Is(err, ErrStageLimit) {
+		t.Fatalf("expected stage limit error, have: %v", err)
+	}
+	if err = b.Delete(ctx, "dp.1"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := kv.AllKeysPrefix(ctx, b, "dp."), []string{"dp.2"}; len(have) != 1 || have[0] != want[0] {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// canceled contexts delete nothing
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err = b.DeletePrefix(cctx, "dp."); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled error, have: %v", err)
+	}
+	if have, want := len(kv.AllKeysPrefix(ctx, b, "dp.")), 1; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
+
+func TestRename(t *testing.T) {
+	ctx := context.Background()
+	b := New(kvmap.New())
+	test.TestRename(t, ctx, b)
+	test.TestRename(t, ctx, New(kvmap.New(), WithOptimistic()))
+
+	bt, err := b.BeginKeysPrefixTraversingBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.TestRename(t, ctx, bt.(*KVTxn))
+	if err = bt.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenamePrefixConcurrent(t *testing.T) {
+	ctx := context.Background()
+	for name, b := range map[string]*KVTxn{
+		"default":    New(kvmap.New()),
+		"wait-graph": New(kvmap.New(), WithTxnKeyLockManager(NewWaitGraphLockManager())),
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := make(map[string][]byte)
+			for i := 0; i < 10; i++ {
+				m[fmt.Sprintf("a.%d", i)] = []byte("a")
+				m[fmt.Sprintf("b.%d", i)] = []byte("b")
+			}
+			if err := kv.SetMap(ctx, b, m); err != nil {
+				t.Fatal(err)
+			}
+
+			// overlapping multi-key operations lock keys in the same order
+			var wg sync.WaitGroup
+			ops := []func() error{
+				func() error { return b.RenamePrefix(ctx, "a.", "b.") },
+				func() error { return b.RenamePrefix(ctx, "b.", "a.") },
+				func() error { return b.DeletePrefix(ctx, "a.") },
+			}
+			for i := 0; i < 100; i++ {
+				for _, op := range ops {
+					wg.Add(1)
+					go func(op func() error) {
+						defer wg.Done()
+						// keys may be moved after they are found
+						if err := op(); err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+							t.Error(err)
+						}
+					}(op)
+				}
+			}
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out: deadlock")
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package kvtxn
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// Rename stages moving the value of key from to key to.
+// Any value at to is replaced. The move may be auto-committed (as a
+// single commit). If from is not found then a wrapped ErrKeyNotFound
+// error is returned.
+// An ErrReadOnly error is returned for read-only transactions and an
+// ErrTxnClosed error for completed transactions.
+func (b *KVTxn) Rename(ctx context.Context, from, to string) error {
+	if err := b.checkOp("rename", from, true); err != nil {
+		return err
+	}
+	if err := b.checkOp("rename", to, true); err != nil {
+		return err
+	}
+	if b.autoCommit {
+		return b.perform(ctx, func(txn *KVTxn) error {
+			return txn.Rename(ctx, from, to)
+		})
+	}
+	keys := []string{from}
+	if to != from {
+		keys = append(keys, to)
+	}
+	locked, err := b.lockWrites(ctx, keys)
+	var value []byte
+	if err == nil {
+		value, err = b.getLocked(ctx, from)
+	}
+	if err != nil {
+		b.releaseWrites(locked)
+		return &kv.KeyError{Op: "rename", Key: from, Err: err}
+	}
+	if to == from {
+		b.releaseWrites(locked)
+		return nil
+	}
+	writes := []write{{key: to, value: value}, {key: from, del: true}}
+	if err = b.stageWrites(ctx, writes, locked); err != nil {
+		return &kv.KeyError{Op: "rename", Key: from, Err: err}
+	}
+	return nil
+}
+
+// getLocked retrieves the value of key which b has locked.
+// An ErrKeyNotFound error is returned if key is not found.
+func (b *KVTxn) getLocked(ctx context.Context, key string) ([]byte, error) {
+	b.stageLock.RLock()
+	value, del, found, err := b.stageGet(ctx, key)
+	b.stageLock.RUnlock()
+	if err != nil {
+		return nil, err
+	} else if found && del {
+		return nil, kv.ErrKeyNotFound
+	} else if found {
+		return value, nil
+	}
+	value, err = b.store.Get(ctx, key)
+	if b.tracking() {
+		b.observe(key, value, err)
+	}
+	return value, err
+}
+
+// RenamePrefix stages moving the values of all keys starting with from
+// to keys starting with to instead. This includes staged keys.
+// The prefixes must not overlap (one being the prefix of the other).
+// The moves may be auto-committed (as a single commit). If an error
+// occurs then transactions may be left with some of the moves staged.
+// An ErrReadOnly error is returned for read-only transactions and an
+// ErrTxnClosed error for completed transactions.
+func (b *KVTxn) RenamePrefix(ctx context.Context, from, to string) error {
+	if strings.HasPrefix(from, to) || strings.HasPrefix(to, from) {
+		return &kv.KeyError{Op: "rename prefix", Key: to, Err: kv.ErrInvalidKey}
+	}
+	if err := b.checkMultiOp("rename prefix", from); err != nil {
+		return err
+	}
+	if b.autoCommit {
+		return b.perform(ctx, func(txn *KVTxn) error {
+			return txn.RenamePrefix(ctx, from, to)
+		})
+	}
+	keys := kv.AllKeysPrefix(ctx, b, from)
+	if err := ctx.Err(); err != nil {
+		return &kv.KeyError{Op: "rename prefix", Key: from, Err: fmt.Errorf("finding keys: %w", err)}
+	}
+	lockKeys := make([]string, 0, len(keys)*2)
+	for _, key := range keys {
+		lockKeys = append(lockKeys, key, to+key[len(from):])
+	}
+	locked, err := b.lockWrites(ctx, lockKeys)
+	writes := make([]write, 0, len(lockKeys))
+	for i := 0; err == nil && i < len(keys); i++ {
+		var value []byte
+		if value, err = b.getLocked(ctx, keys[i]); err == nil {
+			writes = append(writes,
+				write{key: to + keys[i][len(from):], value: value},
+				write{key: keys[i], del: true},
+			)
+		}
+	}
+	if err != nil {
+		b.releaseWrites(locked)
+		return &kv.KeyError{Op: "rename prefix", Key: from, Err: err}
+	}
+	if err = b.stageWrites(ctx, writes, locked); err != nil {
+		return &kv.KeyError{Op: "rename prefix", Key: from, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package kvtxn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/micromdm/nanolib/storage/kv/kvdiskv"
+	"github.com/peterbourgon/diskv/v3"
+)
+
+// ErrStageLimit is returned (as a StageLimitError) when staging an
+// operation would exceed the configured stage limits.
+var ErrStageLimit = errors.New("stage limit exceeded")
+
+// StageLimitError is the error returned when staging an operation
+// would exceed the configured stage limits.
+type StageLimitError struct {
+	Keys     int   // number of keys staged including the operation
+	MaxKeys  int   // maximum number of staged keys (0 for no limit)
+	Bytes    int64 // total size of staged values including the operation
+	MaxBytes int64 // maximum total size of staged values (0 for no limit)
+}
+
+func (e *StageLimitError) Error() string {
+	return fmt.Sprintf(
+		"%s: %d keys (max %d), %d bytes (max %d)",
+		ErrStageLimit, e.Keys, e.MaxKeys, e.Bytes, e.MaxBytes,
+	)
+}
+
+// Unwrap returns ErrStageLimit.
+func (e *StageLimitError) Unwrap() error {
+	return ErrStageLimit
+}
+
+// WithStageLimits limits the staged operations of transactions to
+// maxKeys keys and maxBytes total bytes of values. A limit of 0 means
+// no limit. Operations that would exceed a limit are not staged and
+// return a StageLimitError error; the transaction otherwise remains
+// usable.
+func WithStageLimits(maxKeys int, maxBytes int64) Option {
+	return func(c *config) {
+		c.maxKeys = maxKeys
+		c.maxBytes = maxBytes
+	}
+}
+
+// WithSpill stores staged values of transactions in a temporary on-disk
+// store created within dir rather than in memory. The index of staged
+// operations is kept in memory. The temporary store is removed when
+// the transaction is committed or rolled back.
+func WithSpill(dir string) Option {
+	return func(c *config) {
+		c.spillDir = dir
+	}
+}
+
+// checkLimits checks that staging an operation for key with a value of
+// size bytes would not exceed the stage limits of b.
+// b.stageLock should be locked.
+func (b *KVTxn) checkLimits(key string, size int) error {
+	if b.maxKeys < 1 && b.maxBytes < 1 {
+		return nil
+	}
+	keys, bytes := len(b.stageKeyOps), b.stageBytes+int64(size)
+	if prev, ok := b.stageKeyOps[key]; ok {
+		bytes -= int64(prev.size)
+	} else {
+		keys++
+	}
+	if (b.maxKeys > 0 && keys > b.maxKeys) || (b.maxBytes > 0 && bytes > b.maxBytes) {
+		return &StageLimitError{
+			Keys:     keys,
+			MaxKeys:  b.maxKeys,
+			Bytes:    bytes,
+			MaxBytes: b.maxBytes,
+		}
+	}
+	return nil
+}
+
+// spill is a temporary on-disk store of staged values.
+type spill struct {
+	dir   string
+	store *kvdiskv.KVDiskv
+	files int // number of spilled values written
+}
+
+// spillSet writes value to the spill store, creating it if needed.
+// The spill store key of the value is returned.
+// b.stageLock should be locked.
+func (b *KVTxn) spillSet(ctx context.Context, value []byte) (string, error) {
+	if b.spill == nil {
+		dir, err := os.MkdirTemp(b.spillDir, "kvtxn-")
+		if err != nil {
+			return "", fmt.Errorf("creating spill directory: %w", err)
+		}
+		b.spill = &spill{
+			dir: dir,
+			store: kvdiskv.New(diskv.New(diskv.Options{
+				BasePath:  dir,
+				Transform: kvdiskv.FlatTransform,
+			})),
+		}
+	}
+	file := strconv.Itoa(b.spill.files)
+	if err := b.spill.store.Set(ctx, file, value); err != nil {
+		return "", err
+	}
+	b.spill.files++
+	return file, nil
+}
+
+// spillReset removes the spill store (if any).
+// b.stageLock should be locked.
+func (b *KVTxn) spillReset() error {
+	if b.spill == nil {
+		return nil
+	}
+	dir := b.spill.dir
+	b.spill = nil
+	return os.RemoveAll(dir)
+}
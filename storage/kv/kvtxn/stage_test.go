@@ -0,0 +1,136 @@
+package kvtxn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/test"
+)
+
+func TestStageLimits(t *testing.T) {
+	ctx := context.Background()
+	b := New(kvmap.New(), WithStageLimits(2, 10))
+
+	bt, err := b.BeginBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Set(ctx, "a", []byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+	// replacing a staged value only counts its new size
+	if err = bt.Set(ctx, "a", []byte("123456")); err != nil {
+		t.Fatal(err)
+	}
+
+	// exceed the byte limit
+	err = bt.Set(ctx, "b", []byte("12345"))
+	var limitErr *StageLimitError
+	if !errors.Is(err, ErrStageLimit) || !errors.As(err, &limitErr) {
+		t.Fatalf("expected stage limit error, have: %v", err)
+	}
+	if have, want := limitErr.Bytes, int64(11); have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	if err = bt.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// exceed the key limit
+	err = bt.Delete(ctx, "c")
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected stage limit error, have: %v", err)
+	}
+	if have, want := limitErr.Keys, 3; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// the key lock for the rejected operation should be released
+	bt2, err := b.BeginBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bt2.Set(ctx, "c", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = bt2.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the transaction is still usable
+	if err = bt.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, ctx, b, "a", []byte("123456"))
+}
+
+// expectValue checks that the value of key in b is value.
+func expectValue(t *testing.T, ctx context.Context, b kv.ROBucket, key string, value []byte) {
+	t.Helper()
+	have, err := b.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, value) {
+		t.Errorf("have: %q, want: %q", have, value)
+	}
+}
+
+// dirEntries returns the number of entries in dir.
+func dirEntries(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestSpill(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	b := New(kvmap.New(), WithSpill(dir))
+	test.TestBucketSimple(t, ctx, b)
+	test.TestTxnSimple(t, ctx, b, test.WithNoReadAfterRollback())
+	test.TestTxnLifecycle(t, ctx, b)
+	test.TestCommitHooks(t, ctx, b)
+	if have, want := dirEntries(t, dir), 0; have != want {
+		t.Errorf("spill directory entries: have: %v, want: %v", have, want)
+	}
+
+	for _, commit := range []bool{true, false} {
+		bt, err := b.BeginBucketTxn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = bt.Set(ctx, "spill", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err = bt.Set(ctx, "spill", []byte("world")); err != nil {
+			t.Fatal(err)
+		}
+		if have, want := dirEntries(t, dir), 1; have != want {
+			t.Errorf("spill directory entries: have: %v, want: %v", have, want)
+		}
+		expectValue(t, ctx, bt, "spill", []byte("world"))
+
+		if commit {
+			err = bt.Commit(ctx)
+		} else {
+			err = bt.Rollback(ctx)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := dirEntries(t, dir), 0; have != want {
+			t.Errorf("spill directory entries: have: %v, want: %v", have, want)
+		}
+	}
+	expectValue(t, ctx, b, "spill", []byte("world"))
+}
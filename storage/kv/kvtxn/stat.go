@@ -0,0 +1,36 @@
+package kvtxn
+
+import (
+	"context"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// Stat returns metadata about the value of key.
+// A previously staged value is considered: its modification time is
+// the time it was staged and its hash is not computed. Otherwise the
+// metadata is from the wrapped store (see kv.Stat).
+// Note that Stat does not record versions for optimistic transactions.
+// An ErrTxnClosed error is returned for completed transactions.
+func (b *KVTxn) Stat(ctx context.Context, key string) (*kv.KeyInfo, error) {
+	if err := b.checkOp("stat", key, false); err != nil {
+		return nil, err
+	}
+	if !b.hasOp(key) {
+		if err := b.keyLock.RLockTxn(b.id, key); err != nil {
+			return nil, &kv.KeyError{Op: "stat", Key: key, Err: err}
+		}
+		defer b.keyLock.RUnlockTxn(b.id, key)
+	}
+	if !b.autoCommit {
+		b.stageLock.RLock()
+		op, found := b.stageKeyOps[key]
+		b.stageLock.RUnlock()
+		if found && op.del {
+			return nil, &kv.KeyError{Op: "stat", Key: key, Err: kv.ErrKeyNotFound}
+		} else if found {
+			return &kv.KeyInfo{Key: key, Size: int64(op.size), ModTime: op.mod}, nil
+		}
+	}
+	return kv.Stat(ctx, b.store, key)
+}
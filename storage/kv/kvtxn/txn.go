@@ -2,6 +2,7 @@ package kvtxn
 
 import (
 	"context"
+	"time"
 
 	"github.com/micromdm/nanolib/storage/kv"
 )
@@ -16,35 +17,106 @@ import (
 // Note also that if there is an error then the stage will contain the
 // errored and remaining operations (which could theorectically be
 // re-tried with another commit attempt).
+// Once committed a transaction is closed and can no longer be used.
+// ErrTxnClosed is returned for completed transactions.
+// A pre-commit hook error rolls back the transaction.
 func (b *KVTxn) Commit(ctx context.Context) error {
 	b.stageLock.Lock()
-	defer b.stageLock.Unlock()
-	return b.stageCommit(ctx)
+	if b.state != txnActive {
+		b.stageLock.Unlock()
+		return kv.ErrTxnClosed
+	}
+	start := time.Now()
+	changes, err := b.commit(ctx)
+	if !b.autoCommit {
+		b.logDone(ctx, "commit transaction", start, err)
+		if err == nil {
+			b.state = txnCommitted
+		}
+	}
+	postHooks := b.postHooks
+	b.stageLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if !changes.Empty() {
+		// run after unlocking so that the hooks may read through b
+		for _, hook := range postHooks {
+			hook(ctx, changes)
+		}
+	}
+	return nil
 }
 
 // Rollback resets (removes) the staged operations and unlocks staged locks.
-func (b *KVTxn) Rollback(context.Context) error {
+// Once rolled back a transaction is closed and can no longer be used.
+// ErrTxnClosed is returned for completed transactions.
+func (b *KVTxn) Rollback(ctx context.Context) error {
 	b.stageLock.Lock()
 	defer b.stageLock.Unlock()
+	if b.state != txnActive {
+		return kv.ErrTxnClosed
+	}
+	start := time.Now()
 	// discard any transaction operations
-	b.stageReset()
-	return nil
+	err := b.stageReset()
+	if !b.autoCommit {
+		b.state = txnRolledBack
+		b.logDone(ctx, "rollback transaction", start, err)
+	}
+	return err
 }
 
 // BeginKeysPrefixTraversingBucketTxn creates a new in-memory transacting key-value store that wraps the same store that b wraps.
 // Auto-commit is turned off for the new store (allowing staged operations).
-func (b *KVTxn) BeginKeysPrefixTraversingBucketTxn(context.Context) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
-	return new(b.store, b.keyLock, false), nil
+func (b *KVTxn) BeginKeysPrefixTraversingBucketTxn(ctx context.Context) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
+	return b.begin(ctx, nil), nil
 }
 
 // BeginCRUDBucketTxn creates a new in-memory transacting key-value store that wraps the same store that b wraps.
 // Auto-commit is turned off for the new store (allowing staged operations).
-func (b *KVTxn) BeginCRUDBucketTxn(context.Context) (kv.CRUDBucketTxnCompleter, error) {
-	return new(b.store, b.keyLock, false), nil
+func (b *KVTxn) BeginCRUDBucketTxn(ctx context.Context) (kv.CRUDBucketTxnCompleter, error) {
+	return b.begin(ctx, nil), nil
 }
 
 // BeginBucketTxn creates a new in-memory transacting key-value store that wraps the same store that b wraps.
 // Auto-commit is turned off for the new store (allowing staged operations).
-func (b *KVTxn) BeginBucketTxn(context.Context) (kv.BucketTxnCompleter, error) {
-	return new(b.store, b.keyLock, false), nil
+func (b *KVTxn) BeginBucketTxn(ctx context.Context) (kv.BucketTxnCompleter, error) {
+	return b.begin(ctx, nil), nil
+}
+
+// begin creates a new transaction configured by opts.
+// The isolation level hint and timeout are not used.
+func (b *KVTxn) begin(ctx context.Context, opts *kv.TxnOptions) *KVTxn {
+	start := time.Now()
+	txn := b.newTxn()
+	if opts != nil {
+		txn.readOnly = opts.ReadOnly
+		txn.label = opts.Label
+	}
+	txn.begun = start
+	txn.txnLogger(ctx).Debug(
+		"msg", "begin transaction",
+		"duration", time.Since(start),
+		"read_only", txn.readOnly,
+	)
+	return txn
+}
+
+// BeginKeysPrefixTraversingBucketTxnWithOptions is like BeginKeysPrefixTraversingBucketTxn but configures the transaction with opts.
+// Writes to read-only transactions will return an ErrReadOnly error.
+func (b *KVTxn) BeginKeysPrefixTraversingBucketTxnWithOptions(ctx context.Context, opts *kv.TxnOptions) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
+	return b.begin(ctx, opts), nil
+}
+
+// BeginCRUDBucketTxnWithOptions is like BeginCRUDBucketTxn but configures the transaction with opts.
+// Writes to read-only transactions will return an ErrReadOnly error.
+func (b *KVTxn) BeginCRUDBucketTxnWithOptions(ctx context.Context, opts *kv.TxnOptions) (kv.CRUDBucketTxnCompleter, error) {
+	return b.begin(ctx, opts), nil
+}
+
+// BeginBucketTxnWithOptions is like BeginBucketTxn but configures the transaction with opts.
+// Writes to read-only transactions will return an ErrReadOnly error.
+func (b *KVTxn) BeginBucketTxnWithOptions(ctx context.Context, opts *kv.TxnOptions) (kv.BucketTxnCompleter, error) {
+	return b.begin(ctx, opts), nil
 }
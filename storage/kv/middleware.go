@@ -0,0 +1,182 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+)
+
+// Middleware wraps a Bucket (e.g. to add logging or metrics).
+type Middleware func(Bucket) Bucket
+
+// Chain layers middlewares around b.
+// The first middleware is the outermost (i.e. called first).
+func Chain(b Bucket, middlewares ...Middleware) Bucket {
+	// assemble middleware in descending order
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		b = middlewares[i](b)
+	}
+	return b
+}
+
+// Wrapper is a Bucket that forwards the basic operations to Next.
+// It is meant to be embedded in middleware types so that they only need
+// to override the operations they change.
+//
+// Wrapper does not support transactions so that detecting them (and
+// the other optional capabilities) by type assertion is correct
+// whatever Next is. Middleware should also embed a TxnWrapper only
+// when Next supports transactions (i.e. it is a BucketTxnBeginner or a
+// TxnCompleter). The optional capabilities (e.g. PrefixDeleter, Renamer,
+// Stater) are not forwarded so that their helpers (e.g. DeletePrefix)
+// fall back to the basic operations (or transactions) of the embedding
+// type. Middleware may implement them to forward them to Next.
+type Wrapper struct {
+	Next Bucket
+}
+
+// Get retrieves the value at key in Next.
+func (w Wrapper) Get(ctx context.Context, key string) ([]byte, error) {
+	return w.Next.Get(ctx, key)
+}
+
+// Has checks that key can be found in Next.
+func (w Wrapper) Has(ctx context.Context, key string) (bool, error) {
+	return w.Next.Has(ctx, key)
+}
+
+// Set sets key to value in Next.
+func (w Wrapper) Set(ctx context.Context, key string, value []byte) error {
+	return w.Next.Set(ctx, key, value)
+}
+
+// Delete deletes key in Next.
+func (w Wrapper) Delete(ctx context.Context, key string) error {
+	return w.Next.Delete(ctx, key)
+}
+
+// Keys returns all keys in Next.
+func (w Wrapper) Keys(ctx context.Context, cancel <-chan struct{}) <-chan string {
+	return w.Next.Keys(ctx, cancel)
+}
+
+// KeysPrefix returns all keys starting with prefix in Next.
+func (w Wrapper) KeysPrefix(ctx context.Context, prefix string, cancel <-chan struct{}) <-chan string {
+	return w.Next.KeysPrefix(ctx, prefix, cancel)
+}
+
+// TxnWrapper forwards beginning and completing transactions to Next.
+// It is meant to be embedded (alongside a Wrapper) in the variant of a
+// middleware type used when Next supports transactions.
+type TxnWrapper struct {
+	Next Bucket
+
+	// WrapTxn wraps the transactions begun in Next, if set.
+	// Typically this is the middleware that created the TxnWrapper so
+	// that transactions are wrapped the same way.
+	WrapTxn Middleware
+}
+
+// Commit commits Next if it is a transaction.
+// Otherwise an ErrNotSupported error is returned.
+func (w TxnWrapper) Commit(ctx context.Context) error {
+	if tc, ok := w.Next.(TxnCompleter); ok {
+		return tc.Commit(ctx)
+	}
+	return fmt.Errorf("commit: %w", ErrNotSupported)
+}
+
+// Rollback rolls back Next if it is a transaction.
+// Otherwise an ErrNotSupported error is returned: operations were
+// already auto-committed.
+func (w TxnWrapper) Rollback(ctx context.Context) error {
+	if tc, ok := w.Next.(TxnCompleter); ok {
+		return tc.Rollback(ctx)
+	}
+	return fmt.Errorf("rollback: %w", ErrNotSupported)
+}
+
+// TxnID returns the transaction ID of Next, if any.
+func (w TxnWrapper) TxnID() string {
+	if ider, ok := w.Next.(TxnIDer); ok {
+		return ider.TxnID()
+	}
+	return ""
+}
+
+// wrappedTxn is a wrapped transaction whose underlying transaction
+// cannot begin transactions. Only the completing methods of the wrapped
+// transaction are exposed.
+type wrappedTxn struct {
+	BucketTxnCompleter
+}
+
+// TxnID returns the transaction ID of the wrapped transaction, if any.
+func (t wrappedTxn) TxnID() string {
+	if ider, ok := t.BucketTxnCompleter.(TxnIDer); ok {
+		return ider.TxnID()
+	}
+	return ""
+}
+
+// begin begins a transaction in Next and wraps it with WrapTxn.
+// The transaction is configured with opts if supported by Next.
+func (w TxnWrapper) begin(ctx context.Context, opts *TxnOptions) (BucketTxnCompleter, error) {
+	beginner, ok := w.Next.(BucketTxnBeginner)
+	if !ok {
+		return nil, fmt.Errorf("begin transaction: %w", ErrNotSupported)
+	}
+	bt, err := BeginBucketTxnWithOptions(ctx, beginner, opts)
+	if err != nil || w.WrapTxn == nil {
+		return bt, err
+	}
+	wrapped := w.WrapTxn(bt)
+	wbt, ok := wrapped.(BucketTxnCompleter)
+	if !ok {
+		// complete the wrapped transaction directly
+		return struct {
+			Bucket
+			TxnCompleter
+		}{wrapped, bt}, nil
+	}
+	if _, ok = bt.(BucketTxnBeginner); !ok {
+		// do not claim to begin transactions bt cannot
+		return wrappedTxn{wbt}, nil
+	}
+	return wbt, nil
+}
+
+// BeginBucketTxn begins a transaction in Next.
+// An ErrNotSupported error is returned if Next does not support transactions.
+func (w TxnWrapper) BeginBucketTxn(ctx context.Context) (BucketTxnCompleter, error) {
+	return w.begin(ctx, nil)
+}
+
+// BeginCRUDBucketTxn begins a transaction in Next.
+// See BeginBucketTxn.
+func (w TxnWrapper) BeginCRUDBucketTxn(ctx context.Context) (CRUDBucketTxnCompleter, error) {
+	return w.begin(ctx, nil)
+}
+
+// BeginKeysPrefixTraversingBucketTxn begins a transaction in Next.
+// See BeginBucketTxn.
+func (w TxnWrapper) BeginKeysPrefixTraversingBucketTxn(ctx context.Context) (KeysPrefixTraversingBucketTxnCompleter, error) {
+	return w.begin(ctx, nil)
+}
+
+// BeginBucketTxnWithOptions is like BeginBucketTxn but configures the transaction with opts.
+// See the BeginBucketTxnWithOptions function for stores that do not support options.
+func (w TxnWrapper) BeginBucketTxnWithOptions(ctx context.Context, opts *TxnOptions) (BucketTxnCompleter, error) {
+	return w.begin(ctx, opts)
+}
+
+// BeginCRUDBucketTxnWithOptions is like BeginCRUDBucketTxn but configures the transaction with opts.
+// See BeginBucketTxnWithOptions.
+func (w TxnWrapper) BeginCRUDBucketTxnWithOptions(ctx context.Context, opts *TxnOptions) (CRUDBucketTxnCompleter, error) {
+	return w.begin(ctx, opts)
+}
+
+// BeginKeysPrefixTraversingBucketTxnWithOptions is like BeginKeysPrefixTraversingBucketTxn but configures the transaction with opts.
+// See BeginBucketTxnWithOptions.
+func (w TxnWrapper) BeginKeysPrefixTraversingBucketTxnWithOptions(ctx context.Context, opts *TxnOptions) (KeysPrefixTraversingBucketTxnCompleter, error) {
+	return w.begin(ctx, opts)
+}
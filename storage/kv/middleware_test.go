@@ -0,0 +1,200 @@
+package kv_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/kvtxn"
+	"github.com/micromdm/nanolib/storage/kv/test"
+)
+
+// getRecorder records the name of the middleware for each Get.
+type getRecorder struct {
+	kv.Wrapper
+	name  string
+	calls *[]string
+}
+
+func (r *getRecorder) Get(ctx context.Context, key string) ([]byte, error) {
+	*r.calls = append(*r.calls, r.name)
+	return r.Next.Get(ctx, key)
+}
+
+// getRecorderTxn is a getRecorder that supports transactions.
+type getRecorderTxn struct {
+	*getRecorder
+	kv.TxnWrapper
+}
+
+// supportsTxn reports whether b begins or completes transactions.
+func supportsTxn(b kv.Bucket) bool {
+	_, begins := b.(kv.BucketTxnBeginner)
+	_, completes := b.(kv.TxnCompleter)
+	return begins || completes
+}
+
+func recordGets(name string, calls *[]string) kv.Middleware {
+	var mw kv.Middleware
+	mw = func(next kv.Bucket) kv.Bucket {
+		r := &getRecorder{
+			Wrapper: kv.Wrapper{Next: next},
+			name:    name,
+			calls:   calls,
+		}
+		if !supportsTxn(next) {
+			return r
+		}
+		return &getRecorderTxn{
+			getRecorder: r,
+			TxnWrapper:  kv.TxnWrapper{Next: next, WrapTxn: mw},
+		}
+	}
+	return mw
+}
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+	var calls []string
+	b := kv.Chain(
+		kvtxn.New(kvmap.New()),
+		recordGets("first", &calls),
+		recordGets("second", &calls),
+	).(*getRecorderTxn)
+
+	test.TestBucketSimple(t, ctx, b)
+	test.TestKeysTraversing(t, ctx, b)
+	test.TestTxnSimple(t, ctx, b, test.WithNoReadAfterRollback())
+	test.TestTxnReadOnly(t, ctx, b)
+
+	if err := b.Set(ctx, "hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	calls = nil
+	if _, err := b.Get(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := calls, []string{"first", "second"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// transactions are wrapped by the same middleware
+	bt, err := b.BeginBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls = nil
+	if _, err = bt.Get(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := calls, []string{"first", "second"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if _, ok := bt.(kv.TxnIDer); !ok {
+		t.Error("expected transaction ID to be forwarded")
+	} else if bt.(kv.TxnIDer).TxnID() == "" {
+		t.Error("expected transaction ID")
+	}
+	if err = bt.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWrapperNotSupported(t *testing.T) {
+	ctx := context.Background()
+	var calls []string
+	// hide the transaction support of kvtxn
+	b := kv.Chain(struct{ kv.Bucket }{kvtxn.New(kvmap.New())}, recordGets("first", &calls))
+	test.TestBucketSimple(t, ctx, b)
+
+	// transaction support is detected by interface
+	if _, ok := b.(kv.BucketTxnBeginner); ok {
+		t.Error("expected store without transaction support")
+	}
+	if _, ok := b.(kv.TxnCompleter); ok {
+		t.Error("expected store without transaction support")
+	}
+
+	// the helpers use the basic operations
+	if err := b.Set(ctx, "hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Rename(ctx, b, "hello", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := b.Has(ctx, "hi"); err != nil || !found {
+		t.Errorf("expected hi to be found: %v", err)
+	}
+
+	// transactions that cannot begin transactions are wrapped as such
+	b = kv.Chain(kvmap.New(), recordGets("first", &calls))
+	bt, err := b.(kv.BucketTxnBeginner).BeginBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bt.(kv.BucketTxnBeginner); ok {
+		t.Error("expected transaction to not begin transactions")
+	}
+	if err = bt.Set(ctx, "hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deleteGuard rejects deleting keys starting with "guarded.".
+type deleteGuard struct {
+	kv.Wrapper
+}
+
+// deleteGuardTxn is a deleteGuard that supports transactions.
+type deleteGuardTxn struct {
+	*deleteGuard
+	kv.TxnWrapper
+}
+
+func newDeleteGuard(next kv.Bucket) kv.Bucket {
+	g := &deleteGuard{Wrapper: kv.Wrapper{Next: next}}
+	if !supportsTxn(next) {
+		return g
+	}
+	return &deleteGuardTxn{
+		deleteGuard: g,
+		TxnWrapper:  kv.TxnWrapper{Next: next, WrapTxn: newDeleteGuard},
+	}
+}
+
+func (g *deleteGuard) Delete(ctx context.Context, key string) error {
+	if strings.HasPrefix(key, "guarded.") {
+		return &kv.KeyError{Op: "delete", Key: key, Err: kv.ErrReadOnly}
+	}
+	return g.Next.Delete(ctx, key)
+}
+
+func TestWrapperCapabilities(t *testing.T) {
+	ctx := context.Background()
+	b := newDeleteGuard(kvtxn.New(kvmap.New()))
+	if err := b.Set(ctx, "guarded.a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the helpers use the overridden basic operations
+	if err := kv.DeletePrefix(ctx, b.(kv.KeysPrefixTraversingBucket), "guarded."); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, have: %v", err)
+	}
+	if err := kv.Rename(ctx, b, "guarded.a", "b"); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, have: %v", err)
+	}
+	if found, err := b.Has(ctx, "guarded.a"); err != nil || !found {
+		t.Errorf("expected guarded.a to be found: %v", err)
+	}
+	if found, err := b.Has(ctx, "b"); err != nil || found {
+		t.Errorf("expected b to not be found: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+)
+
+// PrefixDeleter can delete all keys starting with a prefix.
+type PrefixDeleter interface {
+	// DeletePrefix deletes all keys starting with prefix.
+	// An empty prefix deletes all keys.
+	DeletePrefix(ctx context.Context, prefix string) error
+}
+
+// DeletePrefix deletes all keys starting with prefix in b.
+// If b is a PrefixDeleter then its DeletePrefix is used. Otherwise, if
+// b supports transactions, the keys are deleted within a transaction.
+// Otherwise keys are deleted one at a time (and not atomically).
+func DeletePrefix(ctx context.Context, b KeysPrefixTraversingBucket, prefix string) error {
+	if pd, ok := b.(PrefixDeleter); ok {
+		return pd.DeletePrefix(ctx, prefix)
+	}
+	if beginner, ok := b.(KeysPrefixTraversingBucketTxnBeginner); ok {
+		return PerformKeysPrefixTraversingBucketTxn(ctx, beginner, func(ctx context.Context, txn KeysPrefixTraversingBucket) error {
+			return deletePrefix(ctx, txn, prefix)
+		})
+	}
+	return deletePrefix(ctx, b, prefix)
+}
+
+// deletePrefix deletes the keys starting with prefix in b one at a time.
+// The keys are collected first to avoid deadlocks with implementations.
+func deletePrefix(ctx context.Context, b KeysPrefixTraversingBucket, prefix string) error {
+	keys := AllKeysPrefix(ctx, b, prefix)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("finding keys: %w", err)
+	}
+	return DeleteSlice(ctx, b, keys)
+}
@@ -0,0 +1,123 @@
+package kv_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/kvtxn"
+)
+
+func TestDeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	for _, b := range []kv.KeysPrefixTraversingBucket{
+		kvmap.New(),
+		// hide the native implementations to test the fallbacks
+		struct {
+			kv.TxnKeysPrefixTraversingBucket
+		}{kvtxn.New(kvmap.New())},
+		struct{ kv.KeysPrefixTraversingBucket }{kvmap.New()},
+	} {
+		err := kv.SetMap(ctx, b, map[string][]byte{
+			"dp.1": []byte("1"),
+			"dp.2": []byte("2"),
+			"dq.3": []byte("3"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kv.DeletePrefix(ctx, b, "dp."); err != nil {
+			t.Fatal(err)
+		}
+		if have, want := kv.AllKeys(ctx, b), []string{"dq.3"}; len(have) != 1 || have[0] != want[0] {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	ctx := context.Background()
+	for _, b := range []kv.KeysPrefixTraversingBucket{
+		kvmap.New(),
+		// hide the native implementations to test the fallbacks
+		struct {
+			kv.TxnKeysPrefixTraversingBucket
+		}{kvtxn.New(kvmap.New())},
+		struct{ kv.KeysPrefixTraversingBucket }{kvmap.New()},
+	} {
+		err := kv.SetMap(ctx, b, map[string][]byte{
+			"rp.1": []byte("1"),
+			"rp.2": []byte("2"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kv.Rename(ctx, b, "rp.1", "rn.1"); err != nil {
+			t.Fatal(err)
+		}
+		if err = kv.RenamePrefix(ctx, b, "rp.", "rq."); err != nil {
+			t.Fatal(err)
+		}
+		keys := kv.AllKeys(ctx, b)
+		sort.Strings(keys)
+		if have, want := keys, []string{"rn.1", "rq.2"}; !reflect.DeepEqual(have, want) {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+	}
+}
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+	// hide the native implementation to test the fallback
+	b := struct{ kv.KeysPrefixTraversingBucket }{kvmap.New()}
+	if err := b.Set(ctx, "hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := kv.Stat(ctx, b, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := info.Size, int64(5); have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if hash := sha256.Sum256([]byte("world")); !bytes.Equal(info.Hash, hash[:]) {
+		t.Errorf("have: %x, want: %x", info.Hash, hash)
+	}
+	if _, err = kv.Stat(ctx, b, "missing"); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("expected key not found error, have: %v", err)
+	}
+}
+
+func TestCountSize(t *testing.T) {
+	ctx := context.Background()
+	// hide the native implementations to test the fallbacks
+	b := struct{ kv.KeysPrefixTraversingBucket }{kvmap.New()}
+	err := kv.SetMap(ctx, b, map[string][]byte{
+		"c.1": []byte("1"),
+		"c.2": []byte("22"),
+		"d.3": []byte("333"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := kv.CountPrefix(ctx, b, "c.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := n, 2; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	size, err := kv.SizePrefix(ctx, b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := size, int64(6); have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
@@ -0,0 +1,24 @@
+package kv
+
+import "context"
+
+// TxnPreparer can prepare a transaction for two-phase commit.
+type TxnPreparer interface {
+	// Prepare durably prepares the transaction to be committed as id.
+	// A prepared transaction can no longer be written to. It can still
+	// be committed or rolled back and, if interrupted (e.g. by a crash),
+	// is later resolved using a PreparedTxnResolver.
+	Prepare(ctx context.Context, id string) error
+}
+
+// PreparedTxnResolver resolves interrupted prepared transactions.
+type PreparedTxnResolver interface {
+	// PreparedTxns returns the IDs of unresolved prepared transactions.
+	PreparedTxns(ctx context.Context) ([]string, error)
+
+	// CommitPrepared commits the prepared transaction id.
+	CommitPrepared(ctx context.Context, id string) error
+
+	// RollbackPrepared rolls back the prepared transaction id.
+	RollbackPrepared(ctx context.Context, id string) error
+}
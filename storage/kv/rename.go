@@ -0,0 +1,91 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Renamer can rename keys.
+type Renamer interface {
+	// Rename moves the value of key from to key to.
+	// Any value at to is replaced. If from is not found then a wrapped
+	// ErrKeyNotFound error is returned.
+	Rename(ctx context.Context, from, to string) error
+}
+
+// Rename moves the value of key from to key to in b.
+// If b is a Renamer then its Rename is used. Otherwise, if b supports
+// transactions, the key is moved within a transaction. Otherwise the
+// key is copied then deleted (not atomically).
+func Rename(ctx context.Context, b CRUDBucket, from, to string) error {
+	if r, ok := b.(Renamer); ok {
+		return r.Rename(ctx, from, to)
+	}
+	if beginner, ok := b.(CRUDBucketTxnBeginner); ok {
+		return PerformCRUDBucketTxn(ctx, beginner, func(ctx context.Context, txn CRUDBucket) error {
+			return rename(ctx, txn, from, to)
+		})
+	}
+	return rename(ctx, b, from, to)
+}
+
+// rename copies the value of key from to key to in b then deletes from.
+func rename(ctx context.Context, b CRUDBucket, from, to string) error {
+	value, err := b.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	if err = b.Set(ctx, to, value); err != nil {
+		return err
+	}
+	return b.Delete(ctx, from)
+}
+
+// PrefixRenamer can rename all keys starting with a prefix.
+type PrefixRenamer interface {
+	// RenamePrefix moves the values of all keys starting with from to
+	// keys starting with to instead. The prefixes must not overlap
+	// (one being the prefix of the other).
+	RenamePrefix(ctx context.Context, from, to string) error
+}
+
+// RenamePrefix moves the values of all keys starting with from in b to
+// keys starting with to instead. For example with from "a." and to "b."
+// the key "a.1" is moved to "b.1". The prefixes must not overlap (one
+// being the prefix of the other). If b is a PrefixRenamer then its
+// RenamePrefix is used. Otherwise, if b supports transactions, the keys
+// are moved within a transaction. Otherwise the keys are moved one at
+// a time (not atomically) using Rename.
+func RenamePrefix(ctx context.Context, b KeysPrefixTraversingBucket, from, to string) error {
+	if pr, ok := b.(PrefixRenamer); ok {
+		return pr.RenamePrefix(ctx, from, to)
+	}
+	if strings.HasPrefix(from, to) || strings.HasPrefix(to, from) {
+		return &KeyError{Op: "rename prefix", Key: to, Err: ErrInvalidKey}
+	}
+	if beginner, ok := b.(KeysPrefixTraversingBucketTxnBeginner); ok {
+		return PerformKeysPrefixTraversingBucketTxn(ctx, beginner, func(ctx context.Context, txn KeysPrefixTraversingBucket) error {
+			return renamePrefix(ctx, txn, from, to)
+		})
+	}
+	return renamePrefix(ctx, b, from, to)
+}
+
+// renamePrefix moves the keys starting with from in b one at a time.
+// The keys are collected first to avoid deadlocks with implementations.
+func renamePrefix(ctx context.Context, b KeysPrefixTraversingBucket, from, to string) error {
+	keys := AllKeysPrefix(ctx, b, from)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("finding keys: %w", err)
+	}
+	for _, k := range keys {
+		if err := Rename(ctx, b, k, to+k[len(from):]); err != nil {
+			return fmt.Errorf("renaming %s: %w", k, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package kv
+
+import (
+	"context"
+	"crypto/sha256"
+	"time"
+)
+
+// KeyInfo is metadata about the value of a key.
+type KeyInfo struct {
+	Key     string
+	Size    int64     // size of the value in bytes
+	ModTime time.Time // when the value was last written (zero if unknown)
+	Hash    []byte    // SHA-256 hash of the value (nil if not computed)
+}
+
+// Stater can return metadata about the value of a key.
+type Stater interface {
+	// Stat returns metadata about the value of key without necessarily
+	// reading it. If key is not found then a wrapped ErrKeyNotFound
+	// error is returned.
+	Stat(ctx context.Context, key string) (*KeyInfo, error)
+}
+
+// Stat returns metadata about the value of key in b.
+// If b is a Stater then its Stat is used. Otherwise the value is read
+// to determine its size and hash. The modification time is unknown.
+func Stat(ctx context.Context, b ROBucket, key string) (*KeyInfo, error) {
+	if s, ok := b.(Stater); ok {
+		return s.Stat(ctx, key)
+	}
+	value, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyInfo(key, value, time.Time{}), nil
+}
+
+// NewKeyInfo creates metadata (including the hash) for key from value.
+func NewKeyInfo(key string, value []byte, modTime time.Time) *KeyInfo {
+	hash := sha256.Sum256(value)
+	return &KeyInfo{
+		Key:     key,
+		Size:    int64(len(value)),
+		ModTime: modTime,
+		Hash:    hash[:],
+	}
+}
@@ -0,0 +1,49 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// StreamGetter can read values as streams.
+type StreamGetter interface {
+	// GetReader returns a reader of the value at key.
+	// The reader should be closed when done.
+	// If key is not found then a wrapped ErrKeyNotFound error is returned.
+	GetReader(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// StreamSetter can write values from streams.
+type StreamSetter interface {
+	// SetReader sets key to the value read from r until EOF.
+	SetReader(ctx context.Context, key string, r io.Reader) error
+}
+
+// GetReader returns a reader of the value at key in b.
+// If b is a StreamGetter then its GetReader is used. Otherwise the
+// whole value is read into memory.
+func GetReader(ctx context.Context, b ROBucket, key string) (io.ReadCloser, error) {
+	if sg, ok := b.(StreamGetter); ok {
+		return sg.GetReader(ctx, key)
+	}
+	value, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(value)), nil
+}
+
+// SetReader sets key to the value read from r until EOF in b.
+// If b is a StreamSetter then its SetReader is used. Otherwise the
+// whole value is read into memory.
+func SetReader(ctx context.Context, b RWBucket, key string, r io.Reader) error {
+	if ss, ok := b.(StreamSetter); ok {
+		return ss.SetReader(ctx, key, r)
+	}
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return &KeyError{Op: "set", Key: key, Err: err}
+	}
+	return b.Set(ctx, key, value)
+}
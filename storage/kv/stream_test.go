@@ -0,0 +1,31 @@
+package kv_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+)
+
+func TestStream(t *testing.T) {
+	ctx := context.Background()
+	b := kvmap.New()
+	if err := kv.SetReader(ctx, b, "hello", strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := kv.GetReader(ctx, b, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	value, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(value), "world"; have != want {
+		t.Errorf("have: %q, want: %q", have, want)
+	}
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// TestCompareAndSwap tests compare-and-swap operations.
+func TestCompareAndSwap(t *testing.T, ctx context.Context, b kv.CASBucket) {
+	const testKey = "test_cas_key"
+
+	err := b.Delete(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// swap a missing key into existence
+	swapped, err := b.CompareAndSwap(ctx, testKey, nil, []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !swapped {
+		t.Error("expected swap of missing key")
+	}
+
+	// the key now exists, so this should not swap
+	swapped, err = b.CompareAndSwap(ctx, testKey, nil, []byte("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swapped {
+		t.Error("expected no swap of existing key")
+	}
+
+	// mismatched old value should not swap
+	swapped, err = b.CompareAndSwap(ctx, testKey, []byte("v0"), []byte("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swapped {
+		t.Error("expected no swap of mismatched value")
+	}
+
+	swapped, err = b.CompareAndSwap(ctx, testKey, []byte("v1"), []byte("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !swapped {
+		t.Error("expected swap of matching value")
+	}
+
+	v, err := b.Get(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(v), "v2"; have != want {
+		t.Errorf("have = %q, want = %q", have, want)
+	}
+
+	// swap to a nil value deletes
+	swapped, err = b.CompareAndSwap(ctx, testKey, []byte("v2"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !swapped {
+		t.Error("expected swap to delete")
+	}
+
+	_, err = b.Get(ctx, testKey)
+	if !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("error should be an ErrKeyNotFound, but found: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// testCountSize checks the count and size of keys starting with prefix in b.
+func testCountSize(t *testing.T, ctx context.Context, b interface {
+	kv.Counter
+	kv.Sizer
+}, prefix string, count int, size int64) {
+	t.Helper()
+	n, err := b.CountPrefix(ctx, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := n, count; have != want {
+		t.Errorf("count: have: %v, want: %v", have, want)
+	}
+	s, err := b.SizePrefix(ctx, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := s, size; have != want {
+		t.Errorf("size: have: %v, want: %v", have, want)
+	}
+}
+
+// TestCountSize tests counting keys and totaling value sizes.
+// The bucket b should be empty.
+func TestCountSize(t *testing.T, ctx context.Context, b interface {
+	kv.CRUDBucket
+	kv.Counter
+	kv.Sizer
+}) {
+	testCountSize(t, ctx, b, "", 0, 0)
+
+	err := kv.SetMap(ctx, b, map[string][]byte{
+		"test_count.a":   []byte("a"),
+		"test_count.b":   []byte("bb"),
+		"test_count.c.d": []byte("ddd"),
+		"test_other":     []byte("eeee"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCountSize(t, ctx, b, "", 4, 10)
+	testCountSize(t, ctx, b, "test_count.", 3, 6)
+	testCountSize(t, ctx, b, "test_count.c.", 1, 3)
+	testCountSize(t, ctx, b, "test_none.", 0, 0)
+
+	// replaced values
+	if err = b.Set(ctx, "test_count.a", []byte("aaaaa")); err != nil {
+		t.Fatal(err)
+	}
+	testCountSize(t, ctx, b, "test_count.", 3, 10)
+
+	if err = kv.DeleteSlice(ctx, b, []string{"test_count.a", "test_count.b", "test_count.c.d", "test_other"}); err != nil {
+		t.Fatal(err)
+	}
+	testCountSize(t, ctx, b, "", 0, 0)
+}
@@ -0,0 +1,102 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// testKeyError checks that err is a *kv.KeyError for op and key wrapping target.
+func testKeyError(t *testing.T, err error, op, key string, target error) {
+	t.Helper()
+	if !errors.Is(err, target) {
+		t.Errorf("%s %q: error should be %v, but found: %v", op, key, target, err)
+	}
+	var keyErr *kv.KeyError
+	if !errors.As(err, &keyErr) {
+		t.Errorf("%s %q: error should be a KeyError, but found: %v", op, key, err)
+		return
+	}
+	if keyErr.Op != op || keyErr.Key != key {
+		t.Errorf("%s %q: have op = %q, key = %q", op, key, keyErr.Op, keyErr.Key)
+	}
+}
+
+// TestErrors tests that b returns the standard errors for missing and invalid keys.
+func TestErrors(t *testing.T, ctx context.Context, b kv.CRUDBucket) {
+	const testKey = "test_errors_missing_key"
+
+	err := b.Delete(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = b.Get(ctx, testKey)
+	testKeyError(t, err, "get", testKey, kv.ErrKeyNotFound)
+
+	// the empty key is always invalid
+	_, err = b.Get(ctx, "")
+	testKeyError(t, err, "get", "", kv.ErrInvalidKey)
+
+	_, err = b.Has(ctx, "")
+	testKeyError(t, err, "has", "", kv.ErrInvalidKey)
+
+	err = b.Set(ctx, "", []byte("test_value"))
+	testKeyError(t, err, "set", "", kv.ErrInvalidKey)
+
+	err = b.Delete(ctx, "")
+	testKeyError(t, err, "delete", "", kv.ErrInvalidKey)
+}
+
+// TestTxnLifecycle tests that completed transactions can no longer be used.
+func TestTxnLifecycle(t *testing.T, ctx context.Context, b kv.BucketTxnBeginner) {
+	const testKey = "test_txn_lifecycle_key"
+
+	for _, complete := range []string{"commit", "rollback"} {
+		t.Run(complete, func(t *testing.T) {
+			bt, err := b.BeginBucketTxn(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = bt.Set(ctx, testKey, []byte("test_value")); err != nil {
+				t.Fatal(err)
+			}
+
+			if complete == "commit" {
+				err = bt.Commit(ctx)
+			} else {
+				err = bt.Rollback(ctx)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = bt.Get(ctx, testKey)
+			testKeyError(t, err, "get", testKey, kv.ErrTxnClosed)
+
+			_, err = bt.Has(ctx, testKey)
+			testKeyError(t, err, "has", testKey, kv.ErrTxnClosed)
+
+			err = bt.Set(ctx, testKey, []byte("test_value"))
+			testKeyError(t, err, "set", testKey, kv.ErrTxnClosed)
+
+			err = bt.Delete(ctx, testKey)
+			testKeyError(t, err, "delete", testKey, kv.ErrTxnClosed)
+
+			if keys := kv.AllKeys(ctx, bt); len(keys) > 0 {
+				t.Errorf("expected no keys, have: %v", keys)
+			}
+
+			if err = bt.Commit(ctx); !errors.Is(err, kv.ErrTxnClosed) {
+				t.Errorf("commit: error should be ErrTxnClosed, but found: %v", err)
+			}
+
+			if err = bt.Rollback(ctx); !errors.Is(err, kv.ErrTxnClosed) {
+				t.Errorf("rollback: error should be ErrTxnClosed, but found: %v", err)
+			}
+		})
+	}
+}
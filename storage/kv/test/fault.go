@@ -0,0 +1,402 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// ErrFault is a convenience error for injecting faults.
+var ErrFault = errors.New("injected fault")
+
+// Op is an operation of a FaultBucket.
+type Op string
+
+const (
+	OpGet      Op = "get"
+	OpHas      Op = "has"
+	OpSet      Op = "set"
+	OpDelete   Op = "delete"
+	OpKeys     Op = "keys" // Keys and KeysPrefix
+	OpBegin    Op = "begin"
+	OpCommit   Op = "commit"
+	OpRollback Op = "rollback"
+)
+
+// Fault describes a fault injected into the matching calls of a FaultBucket.
+type Fault struct {
+	// Op matches only this operation. All operations match if empty.
+	Op Op
+
+	// Key matches only calls for this key, if set.
+	Key string
+
+	// Prefix matches only calls for keys starting with prefix, if set.
+	// For OpKeys the traversed prefix is matched.
+	Prefix string
+
+	// Nth injects the fault into only the Nth (starting from 1)
+	// matching call. The fault is injected into all matching calls if zero.
+	Nth int
+
+	// Latency delays the call.
+	Latency time.Duration
+
+	// Err is returned from the call. The call does not fail if nil.
+	// Keys cannot return errors so failing OpKeys calls return no keys.
+	Err error
+
+	// CommitWrites is the number of the transaction's writes that are
+	// (non-atomically) applied before a failing OpCommit returns Err.
+	// Simulates a commit that fails partway.
+	CommitWrites int
+
+	// Truncate closes the keys channel of OpKeys calls after
+	// TruncateAfter keys.
+	Truncate      bool
+	TruncateAfter int
+}
+
+// match reports whether f matches op for key.
+func (f *Fault) match(op Op, key string) bool {
+	if f.Op != "" && f.Op != op {
+		return false
+	}
+	if f.Key != "" && f.Key != key {
+		return false
+	}
+	return strings.HasPrefix(key, f.Prefix)
+}
+
+type faultRule struct {
+	Fault
+	calls int // number of matching calls
+}
+
+// faults are the faults and call counts shared by a FaultBucket and
+// its transactions.
+type faults struct {
+	mu    sync.Mutex
+	rules []*faultRule
+	calls map[Op]int
+}
+
+// inject finds the fault for the call of op for key.
+// The call is delayed by the latency of the fault. Nil is returned if
+// no fault is injected. The error of ctx is returned if it is done
+// while delaying.
+func (fs *faults) inject(ctx context.Context, op Op, key string) (*Fault, error) {
+	fs.mu.Lock()
+	fs.calls[op]++
+	var fault *Fault
+	for _, rule := range fs.rules {
+		if !rule.match(op, key) {
+			continue
+		}
+		rule.calls++
+		if fault == nil && (rule.Nth == 0 || rule.Nth == rule.calls) {
+			fault = &rule.Fault
+		}
+	}
+	fs.mu.Unlock()
+	if fault == nil || fault.Latency <= 0 {
+		return fault, nil
+	}
+	t := time.NewTimer(fault.Latency)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.C:
+	}
+	return fault, nil
+}
+
+// faultWrite is a write of a transaction.
+type faultWrite struct {
+	key   string
+	value []byte
+	del   bool
+}
+
+// FaultBucket wraps a store to inject faults into its operations.
+// The optional capabilities (such as kv.PrefixDeleter) of the wrapped
+// store are not forwarded so helpers (such as kv.DeletePrefix) use the
+// operations above and see their injected faults.
+// See FaultBucketTxn for stores that support transactions.
+type FaultBucket struct {
+	kv.Wrapper
+	faults *faults
+	parent kv.Bucket // store the transaction was begun from, if a transaction
+
+	mu     sync.Mutex
+	writes []faultWrite // writes of a transaction
+}
+
+// FaultBucketTxn is a FaultBucket that supports transactions.
+// Transactions begun from a FaultBucketTxn share its faults.
+type FaultBucketTxn struct {
+	*FaultBucket
+	txn kv.TxnWrapper
+}
+
+// NewFaultBucket creates a new fault-injecting store wrapping b.
+func NewFaultBucket(b kv.Bucket) *FaultBucket {
+	if b == nil {
+		panic("nil store")
+	}
+	return &FaultBucket{
+		Wrapper: kv.Wrapper{Next: b},
+		faults:  &faults{calls: make(map[Op]int)},
+	}
+}
+
+// NewFaultBucketTxn creates a new fault-injecting store wrapping b and its transactions.
+func NewFaultBucketTxn(b kv.TxnBucket) *FaultBucketTxn {
+	fb := NewFaultBucket(b)
+	return &FaultBucketTxn{FaultBucket: fb, txn: kv.TxnWrapper{Next: b, WrapTxn: fb.wrap}}
+}
+
+// wrap wraps the transaction txn sharing the faults of fb.
+func (fb *FaultBucket) wrap(txn kv.Bucket) kv.Bucket {
+	w := &FaultBucket{Wrapper: kv.Wrapper{Next: txn}, faults: fb.faults, parent: fb.Next}
+	return &FaultBucketTxn{FaultBucket: w, txn: kv.TxnWrapper{Next: txn, WrapTxn: w.wrap}}
+}
+
+// AddFault adds f to the injected faults.
+// The first matching fault is injected into a call.
+func (fb *FaultBucket) AddFault(f Fault) {
+	fb.faults.mu.Lock()
+	defer fb.faults.mu.Unlock()
+	fb.faults.rules = append(fb.faults.rules, &faultRule{Fault: f})
+}
+
+// ClearFaults removes all faults and resets the call counts.
+func (fb *FaultBucket) ClearFaults() {
+	fb.faults.mu.Lock()
+	defer fb.faults.mu.Unlock()
+	fb.faults.rules = nil
+	fb.faults.calls = make(map[Op]int)
+}
+
+// Calls returns the number of calls of op.
+func (fb *FaultBucket) Calls(op Op) int {
+	fb.faults.mu.Lock()
+	defer fb.faults.mu.Unlock()
+	return fb.faults.calls[op]
+}
+
+// inject returns the error for the call of op for key, if any.
+func (fb *FaultBucket) inject(ctx context.Context, op Op, key string) error {
+	fault, err := fb.faults.inject(ctx, op, key)
+	if err != nil {
+		return err
+	}
+	if fault == nil || fault.Err == nil {
+		return nil
+	}
+	if key != "" {
+		return &kv.KeyError{Op: string(op), Key: key, Err: fault.Err}
+	}
+	return fault.Err
+}
+
+// Get retrieves the value at key unless a fault is injected.
+func (fb *FaultBucket) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := fb.inject(ctx, OpGet, key); err != nil {
+		return nil, err
+	}
+	return fb.Next.Get(ctx, key)
+}
+
+// Has checks that key can be found unless a fault is injected.
+func (fb *FaultBucket) Has(ctx context.Context, key string) (bool, error) {
+	if err := fb.inject(ctx, OpHas, key); err != nil {
+		return false, err
+	}
+	return fb.Next.Has(ctx, key)
+}
+
+// record records a write if fb is a transaction.
+func (fb *FaultBucket) record(w faultWrite) {
+	if fb.parent == nil {
+		return
+	}
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.writes = append(fb.writes, w)
+}
+
+// Set sets key to value unless a fault is injected.
+func (fb *FaultBucket) Set(ctx context.Context, key string, value []byte) error {
+	if err := fb.inject(ctx, OpSet, key); err != nil {
+		return err
+	}
+	if err := fb.Next.Set(ctx, key, value); err != nil {
+		return err
+	}
+	fb.record(faultWrite{key: key, value: value})
+	return nil
+}
+
+// Delete deletes key unless a fault is injected.
+func (fb *FaultBucket) Delete(ctx context.Context, key string) error {
+	if err := fb.inject(ctx, OpDelete, key); err != nil {
+		return err
+	}
+	if err := fb.Next.Delete(ctx, key); err != nil {
+		return err
+	}
+	fb.record(faultWrite{key: key, del: true})
+	return nil
+}
+
+// keys returns the keys traversed by keys using prefix unless a fault
+// is injected. Failing calls return no keys.
+func (fb *FaultBucket) keys(ctx context.Context, prefix string, cancel <-chan struct{}, keys func(cancel <-chan struct{}) <-chan string) <-chan string {
+	fault, err := fb.faults.inject(ctx, OpKeys, prefix)
+	if err != nil || (fault != nil && fault.Err != nil) {
+		r := make(chan string)
+		close(r)
+		return r
+	}
+	if fault == nil || !fault.Truncate {
+		return keys(cancel)
+	}
+	stop := make(chan struct{})
+	in := keys(stop)
+	r := make(chan string)
+	go func() {
+		defer close(r)
+		defer func() {
+			// stop the traversal and drain any remaining keys
+			close(stop)
+			for range in {
+			}
+		}()
+		for i := 0; i < fault.TruncateAfter; i++ {
+			key, ok := <-in
+			if !ok {
+				return
+			}
+			select {
+			case r <- key:
+			case <-cancel:
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// Keys returns all keys unless a fault is injected.
+func (fb *FaultBucket) Keys(ctx context.Context, cancel <-chan struct{}) <-chan string {
+	return fb.keys(ctx, "", cancel, func(cancel <-chan struct{}) <-chan string {
+		return fb.Next.Keys(ctx, cancel)
+	})
+}
+
+// KeysPrefix returns all keys starting with prefix unless a fault is injected.
+func (fb *FaultBucket) KeysPrefix(ctx context.Context, prefix string, cancel <-chan struct{}) <-chan string {
+	return fb.keys(ctx, prefix, cancel, func(cancel <-chan struct{}) <-chan string {
+		return fb.Next.KeysPrefix(ctx, prefix, cancel)
+	})
+}
+
+// Commit commits the wrapped transaction unless a fault is injected.
+// Failed commits roll back the wrapped transaction after applying any
+// of the transaction's writes configured with CommitWrites directly to
+// the wrapped store.
+func (fb *FaultBucketTxn) Commit(ctx context.Context) error {
+	fault, err := fb.faults.inject(ctx, OpCommit, "")
+	if err != nil {
+		return err
+	}
+	if fault == nil || fault.Err == nil {
+		return fb.txn.Commit(ctx)
+	}
+	if err = fb.txn.Rollback(ctx); err != nil {
+		return err
+	}
+	fb.mu.Lock()
+	writes := fb.writes
+	fb.writes = nil
+	fb.mu.Unlock()
+	for i := 0; i < fault.CommitWrites && i < len(writes); i++ {
+		w := writes[i]
+		if w.del {
+			err = fb.parent.Delete(ctx, w.key)
+		} else {
+			err = fb.parent.Set(ctx, w.key, w.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fault.Err
+}
+
+// Rollback rolls back the wrapped transaction unless a fault is injected.
+func (fb *FaultBucketTxn) Rollback(ctx context.Context) error {
+	if err := fb.inject(ctx, OpRollback, ""); err != nil {
+		return err
+	}
+	return fb.txn.Rollback(ctx)
+}
+
+// TxnID returns the transaction ID of the wrapped transaction, if any.
+func (fb *FaultBucketTxn) TxnID() string {
+	return fb.txn.TxnID()
+}
+
+// BeginBucketTxn begins a transaction unless a fault is injected.
+func (fb *FaultBucketTxn) BeginBucketTxn(ctx context.Context) (kv.BucketTxnCompleter, error) {
+	if err := fb.inject(ctx, OpBegin, ""); err != nil {
+		return nil, err
+	}
+	return fb.txn.BeginBucketTxn(ctx)
+}
+
+// BeginCRUDBucketTxn begins a transaction unless a fault is injected.
+func (fb *FaultBucketTxn) BeginCRUDBucketTxn(ctx context.Context) (kv.CRUDBucketTxnCompleter, error) {
+	if err := fb.inject(ctx, OpBegin, ""); err != nil {
+		return nil, err
+	}
+	return fb.txn.BeginCRUDBucketTxn(ctx)
+}
+
+// BeginKeysPrefixTraversingBucketTxn begins a transaction unless a fault is injected.
+func (fb *FaultBucketTxn) BeginKeysPrefixTraversingBucketTxn(ctx context.Context) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
+	if err := fb.inject(ctx, OpBegin, ""); err != nil {
+		return nil, err
+	}
+	return fb.txn.BeginKeysPrefixTraversingBucketTxn(ctx)
+}
+
+// BeginBucketTxnWithOptions is like BeginBucketTxn but configures the transaction with opts.
+func (fb *FaultBucketTxn) BeginBucketTxnWithOptions(ctx context.Context, opts *kv.TxnOptions) (kv.BucketTxnCompleter, error) {
+	if err := fb.inject(ctx, OpBegin, ""); err != nil {
+		return nil, err
+	}
+	return fb.txn.BeginBucketTxnWithOptions(ctx, opts)
+}
+
+// BeginCRUDBucketTxnWithOptions is like BeginCRUDBucketTxn but configures the transaction with opts.
+func (fb *FaultBucketTxn) BeginCRUDBucketTxnWithOptions(ctx context.Context, opts *kv.TxnOptions) (kv.CRUDBucketTxnCompleter, error) {
+	if err := fb.inject(ctx, OpBegin, ""); err != nil {
+		return nil, err
+	}
+	return fb.txn.BeginCRUDBucketTxnWithOptions(ctx, opts)
+}
+
+// BeginKeysPrefixTraversingBucketTxnWithOptions is like BeginKeysPrefixTraversingBucketTxn but configures the transaction with opts.
+func (fb *FaultBucketTxn) BeginKeysPrefixTraversingBucketTxnWithOptions(ctx context.Context, opts *kv.TxnOptions) (kv.KeysPrefixTraversingBucketTxnCompleter, error) {
+	if err := fb.inject(ctx, OpBegin, ""); err != nil {
+		return nil, err
+	}
+	return fb.txn.BeginKeysPrefixTraversingBucketTxnWithOptions(ctx, opts)
+}
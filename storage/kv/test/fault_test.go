@@ -0,0 +1,180 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/kvtxn"
+)
+
+func TestFaultBucket(t *testing.T) {
+	ctx := context.Background()
+	b := NewFaultBucketTxn(kvtxn.New(kvmap.New()))
+	TestBucketSimple(t, ctx, b)
+	TestKeysTraversing(t, ctx, b)
+	TestTxnSimple(t, ctx, b, WithNoReadAfterRollback())
+}
+
+func TestFaultBucketTxnSupport(t *testing.T) {
+	// transaction support is detected by interface
+	var b interface{} = NewFaultBucket(kvtxn.New(kvmap.New()))
+	if _, ok := b.(kv.TxnCompleter); ok {
+		t.Error("expected store without transaction support")
+	}
+	b = NewFaultBucketTxn(kvtxn.New(kvmap.New()))
+	if _, ok := b.(kv.TxnBucket); !ok {
+		t.Error("expected store with transaction support")
+	}
+}
+
+func TestFaultBucketFaults(t *testing.T) {
+	ctx := context.Background()
+	b := NewFaultBucket(kvmap.New())
+	err := kv.SetMap(ctx, b, map[string][]byte{
+		"a.1": []byte("1"),
+		"a.2": []byte("2"),
+		"b.1": []byte("3"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.ClearFaults() // reset call counts
+
+	b.AddFault(Fault{Op: OpGet, Prefix: "a.", Err: ErrFault})
+	b.AddFault(Fault{Op: OpSet, Nth: 2, Err: ErrFault})
+	b.AddFault(Fault{Op: OpHas, Key: "b.1", Latency: 20 * time.Millisecond})
+
+	_, err = b.Get(ctx, "a.1")
+	if !errors.Is(err, ErrFault) {
+		t.Errorf("expected ErrFault, have: %v", err)
+	}
+	var keyErr *kv.KeyError
+	if !errors.As(err, &keyErr) || keyErr.Key != "a.1" {
+		t.Errorf("expected key error for a.1, have: %v", err)
+	}
+	if _, err = b.Get(ctx, "b.1"); err != nil {
+		t.Error(err)
+	}
+
+	// only the second set fails
+	for i, want := range []error{nil, ErrFault, nil} {
+		if err = b.Set(ctx, "c", []byte("c")); !errors.Is(err, want) {
+			t.Errorf("set %d: have: %v, want: %v", i+1, err, want)
+		}
+	}
+	if have, want := b.Calls(OpSet), 3; have != want {
+		t.Errorf("have: %d, want: %d calls", have, want)
+	}
+
+	start := time.Now()
+	if found, err := b.Has(ctx, "b.1"); err != nil || !found {
+		t.Errorf("expected b.1 to be found: %v", err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("expected latency")
+	}
+
+	b.ClearFaults()
+	if _, err = b.Get(ctx, "a.1"); err != nil {
+		t.Error(err)
+	}
+	if have := b.Calls(OpSet); have != 0 {
+		t.Errorf("expected no calls, have: %d", have)
+	}
+}
+
+func TestFaultBucketKeys(t *testing.T) {
+	ctx := context.Background()
+	b := NewFaultBucket(kvmap.New())
+	err := kv.SetMap(ctx, b, map[string][]byte{
+		"a.1": []byte("1"),
+		"a.2": []byte("2"),
+		"a.3": []byte("3"),
+		"b.1": []byte("4"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.AddFault(Fault{Op: OpKeys, Prefix: "a.", Truncate: true, TruncateAfter: 2})
+	b.AddFault(Fault{Op: OpKeys, Prefix: "b.", Err: ErrFault})
+
+	if have, want := len(kv.AllKeysPrefix(ctx, b, "a.")), 2; have != want {
+		t.Errorf("have: %d, want: %d keys", have, want)
+	}
+	if have := kv.AllKeysPrefix(ctx, b, "b."); len(have) > 0 {
+		t.Errorf("expected no keys, have: %v", have)
+	}
+	if have, want := len(kv.AllKeys(ctx, b)), 4; have != want {
+		t.Errorf("have: %d, want: %d keys", have, want)
+	}
+}
+
+func TestFaultBucketHelpers(t *testing.T) {
+	ctx := context.Background()
+	for _, b := range []interface {
+		kv.Bucket
+		AddFault(Fault)
+	}{
+		NewFaultBucket(kvmap.New()),
+		NewFaultBucketTxn(kvtxn.New(kvmap.New())),
+	} {
+		err := kv.SetMap(ctx, b, map[string][]byte{
+			"a.1": []byte("1"),
+			"a.2": []byte("2"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b.AddFault(Fault{Op: OpDelete, Key: "a.2", Err: ErrFault})
+		if err = kv.DeletePrefix(ctx, b, "a."); !errors.Is(err, ErrFault) {
+			t.Errorf("expected ErrFault, have: %v", err)
+		}
+		b.AddFault(Fault{Op: OpGet, Key: "a.1", Err: ErrFault})
+		if err = kv.Rename(ctx, b, "a.1", "b.1"); !errors.Is(err, ErrFault) {
+			t.Errorf("expected ErrFault, have: %v", err)
+		}
+		if _, err = kv.Stat(ctx, b, "a.1"); !errors.Is(err, ErrFault) {
+			t.Errorf("expected ErrFault, have: %v", err)
+		}
+	}
+}
+
+func TestFaultBucketCommit(t *testing.T) {
+	ctx := context.Background()
+	store := kvmap.New()
+	b := NewFaultBucketTxn(kvtxn.New(store))
+	b.AddFault(Fault{Op: OpCommit, Err: ErrFault, CommitWrites: 1})
+
+	bt, err := b.BeginBucketTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Set(ctx, "key_1", []byte("val_1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Set(ctx, "key_2", []byte("val_2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Commit(ctx); !errors.Is(err, ErrFault) {
+		t.Fatalf("expected ErrFault, have: %v", err)
+	}
+
+	// only the first write is applied
+	if found, err := store.Has(ctx, "key_1"); err != nil || !found {
+		t.Errorf("expected key_1 to be found: %v", err)
+	}
+	if found, err := store.Has(ctx, "key_2"); err != nil || found {
+		t.Errorf("expected key_2 to not be found: %v", err)
+	}
+
+	b.AddFault(Fault{Op: OpBegin, Err: ErrFault})
+	if _, err = b.BeginBucketTxn(ctx); !errors.Is(err, ErrFault) {
+		t.Errorf("expected ErrFault, have: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// TestCommitHooks tests that b runs commit hooks with transaction changes.
+// Hooks are registered on b and stay registered but are inactive once
+// the test returns.
+func TestCommitHooks(t *testing.T, ctx context.Context, b interface {
+	kv.TxnBucket
+	kv.CommitHooker
+}) {
+	const abortKey = "test_hooks_abort_key"
+	errAbort := errors.New("test hook abort")
+
+	var mu sync.Mutex
+	active := true
+	var pre, post []*kv.ChangeSet
+
+	b.AddPreCommitHook(func(_ context.Context, changes *kv.ChangeSet) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !active {
+			return nil
+		}
+		pre = append(pre, changes)
+		if _, ok := changes.Set[abortKey]; ok {
+			return errAbort
+		}
+		return nil
+	})
+	b.AddPostCommitHook(func(ctx context.Context, changes *kv.ChangeSet) {
+		// the committed changes should be visible (and not deadlock)
+		for key := range changes.Set {
+			if found, err := b.Has(ctx, key); err != nil || !found {
+				t.Errorf("post-commit: key %q not found: %v", key, err)
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if active {
+			post = append(post, changes)
+		}
+	})
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		active = false
+	}()
+
+	// reset returns the changes hooks were called with and resets them.
+	reset := func() (rPre, rPost []*kv.ChangeSet) {
+		mu.Lock()
+		defer mu.Unlock()
+		rPre, rPost, pre, post = pre, post, nil, nil
+		return
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		bt, err := b.BeginBucketTxn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"test_hooks_key_1", "test_hooks_key_2"} {
+			if err = bt.Set(ctx, key, []byte("test_value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, key := range []string{"test_hooks_key_3", "test_hooks_key_2"} {
+			if err = bt.Delete(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = bt.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		want := &kv.ChangeSet{
+			Set:     map[string][]byte{"test_hooks_key_1": []byte("test_value")},
+			Deleted: []string{"test_hooks_key_2", "test_hooks_key_3"},
+		}
+		pre, post := reset()
+		if have := pre; len(have) != 1 || !reflect.DeepEqual(have[0], want) {
+			t.Errorf("pre-commit: have: %v, want: %v", have, want)
+		}
+		if have := post; len(have) != 1 || !reflect.DeepEqual(have[0], want) {
+			t.Errorf("post-commit: have: %v, want: %v", have, want)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		bt, err := b.BeginBucketTxn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = bt.Set(ctx, abortKey, []byte("test_value")); err != nil {
+			t.Fatal(err)
+		}
+		if err = bt.Commit(ctx); !errors.Is(err, errAbort) {
+			t.Errorf("commit: error should be hook error, but found: %v", err)
+		}
+
+		pre, post := reset()
+		if have, want := len(pre), 1; have != want {
+			t.Errorf("pre-commit: have: %d, want: %d calls", have, want)
+		}
+		if have, want := len(post), 0; have != want {
+			t.Errorf("post-commit: have: %d, want: %d calls", have, want)
+		}
+
+		found, err := b.Has(ctx, abortKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			t.Error("aborted key should not be found")
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		bt, err := b.BeginBucketTxn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = bt.Set(ctx, "test_hooks_key_1", []byte("test_value_2")); err != nil {
+			t.Fatal(err)
+		}
+		if err = bt.Rollback(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		pre, post := reset()
+		if have, want := len(pre)+len(post), 0; have != want {
+			t.Errorf("have: %d, want: %d hook calls", have, want)
+		}
+	})
+
+	t.Run("autocommit", func(t *testing.T) {
+		if err := b.Set(ctx, "test_hooks_key_4", []byte("test_value")); err != nil {
+			t.Fatal(err)
+		}
+
+		want := &kv.ChangeSet{Set: map[string][]byte{"test_hooks_key_4": []byte("test_value")}}
+		pre, post := reset()
+		if have := pre; len(have) != 1 || !reflect.DeepEqual(have[0], want) {
+			t.Errorf("pre-commit: have: %v, want: %v", have, want)
+		}
+		if have := post; len(have) != 1 || !reflect.DeepEqual(have[0], want) {
+			t.Errorf("post-commit: have: %v, want: %v", have, want)
+		}
+
+		if err := b.Set(ctx, abortKey, []byte("test_value")); !errors.Is(err, errAbort) {
+			t.Errorf("set: error should be hook error, but found: %v", err)
+		}
+		found, err := b.Has(ctx, abortKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			t.Error("aborted key should not be found")
+		}
+		reset()
+	})
+}
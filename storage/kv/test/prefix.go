@@ -0,0 +1,47 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// TestDeletePrefix tests deleting keys by prefix.
+func TestDeletePrefix(t *testing.T, ctx context.Context, b interface {
+	kv.KeysPrefixTraversingBucket
+	kv.PrefixDeleter
+}) {
+	err := kv.SetMap(ctx, b, map[string][]byte{
+		"test_dp.a":   []byte("a"),
+		"test_dp.b":   []byte("b"),
+		"test_dp.c.d": []byte("d"),
+		"test_dq":     []byte("q"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.DeletePrefix(ctx, "test_dp."); err != nil {
+		t.Fatal(err)
+	}
+	if have := kv.AllKeysPrefix(ctx, b, "test_dp."); len(have) > 0 {
+		t.Errorf("expected no keys, have: %v", have)
+	}
+	found, err := b.Has(ctx, "test_dq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("expected key to be found")
+	}
+
+	// deleting a prefix with no keys is not an error
+	if err = b.DeletePrefix(ctx, "test_dp."); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Delete(ctx, "test_dq"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,97 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// TestRename tests renaming keys and prefixes.
+func TestRename(t *testing.T, ctx context.Context, b interface {
+	kv.KeysPrefixTraversingBucket
+	kv.Renamer
+}) {
+	err := kv.SetMap(ctx, b, map[string][]byte{
+		"test_rn_a": []byte("a"),
+		"test_rn_c": []byte("c"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Rename(ctx, "test_rn_a", "test_rn_b"); err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, ctx, b, "test_rn_b", []byte("a"))
+	testNotFound(t, ctx, b, "test_rn_a")
+
+	// replaces the existing value
+	if err = b.Rename(ctx, "test_rn_b", "test_rn_c"); err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, ctx, b, "test_rn_c", []byte("a"))
+	testNotFound(t, ctx, b, "test_rn_b")
+
+	// renaming to itself keeps the value
+	if err = b.Rename(ctx, "test_rn_c", "test_rn_c"); err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, ctx, b, "test_rn_c", []byte("a"))
+
+	err = b.Rename(ctx, "test_rn_a", "test_rn_d")
+	if !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("expected key not found error, have: %v", err)
+	}
+
+	err = kv.SetMap(ctx, b, map[string][]byte{
+		"test_rp.x.1": []byte("1"),
+		"test_rp.x.2": []byte("2"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = kv.RenamePrefix(ctx, b, "test_rp.x.", "test_rp.y."); err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, ctx, b, "test_rp.y.1", []byte("1"))
+	testGet(t, ctx, b, "test_rp.y.2", []byte("2"))
+	if have := kv.AllKeysPrefix(ctx, b, "test_rp.x."); len(have) > 0 {
+		t.Errorf("expected no keys, have: %v", have)
+	}
+
+	err = kv.RenamePrefix(ctx, b, "test_rp.y.", "test_rp.y.z.")
+	if !errors.Is(err, kv.ErrInvalidKey) {
+		t.Errorf("expected invalid key error, have: %v", err)
+	}
+
+	if err = kv.DeleteSlice(ctx, b, []string{"test_rn_c", "test_rp.y.1", "test_rp.y.2"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testGet checks that the value of key in b is value.
+func testGet(t *testing.T, ctx context.Context, b kv.ROBucket, key string, value []byte) {
+	t.Helper()
+	have, err := b.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, value) {
+		t.Errorf("key %s: have: %q, want: %q", key, have, value)
+	}
+}
+
+// testNotFound checks that key is not found in b.
+func testNotFound(t *testing.T, ctx context.Context, b kv.ROBucket, key string) {
+	t.Helper()
+	found, err := b.Has(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Errorf("key %s: expected not found", key)
+	}
+}
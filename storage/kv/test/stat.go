@@ -0,0 +1,52 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// TestStat tests key metadata.
+func TestStat(t *testing.T, ctx context.Context, b interface {
+	kv.CRUDBucket
+	kv.Stater
+}) {
+	const testKey = "test_stat_key"
+	value := []byte("hello, world")
+
+	start := time.Now()
+	if err := b.Set(ctx, testKey, value); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := b.Stat(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := info.Key, testKey; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if have, want := info.Size, int64(len(value)); have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	// allow for coarse filesystem timestamps
+	if info.ModTime.IsZero() || info.ModTime.Before(start.Add(-2*time.Second)) || info.ModTime.After(time.Now().Add(time.Second)) {
+		t.Errorf("unexpected modification time: %v (started: %v)", info.ModTime, start)
+	}
+	if hash := sha256.Sum256(value); info.Hash != nil && !bytes.Equal(info.Hash, hash[:]) {
+		t.Errorf("have: %x, want: %x", info.Hash, hash)
+	}
+
+	if err = b.Delete(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Stat(ctx, testKey)
+	if !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("expected key not found error, have: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// TestStream tests reading and writing values as streams.
+func TestStream(t *testing.T, ctx context.Context, b interface {
+	kv.CRUDBucket
+	kv.StreamGetter
+	kv.StreamSetter
+}) {
+	const testKey = "test_stream_key"
+	value := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+
+	if err := b.SetReader(ctx, testKey, bytes.NewReader(value)); err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, ctx, b, testKey, value)
+
+	if err := b.Set(ctx, testKey, value[:1024]); err != nil {
+		t.Fatal(err)
+	}
+	r, err := b.GetReader(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, value[:1024]) {
+		t.Error("streamed value not equal")
+	}
+
+	// closing before reading everything
+	if r, err = b.GetReader(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Delete(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.GetReader(ctx, testKey)
+	if !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("expected key not found error, have: %v", err)
+	}
+}
@@ -236,3 +236,44 @@ func TestKVTxnKeys(t *testing.T, ctx context.Context, b kv.TxnKeysPrefixTraversi
 		t.Fatal(err)
 	}
 }
+
+// TestTxnReadOnly tests that read-only transactions reject writes.
+func TestTxnReadOnly(t *testing.T, ctx context.Context, b kv.BucketTxnOptionsBeginner) {
+	bt, err := b.BeginBucketTxnWithOptions(ctx, &kv.TxnOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reads should work
+	_, err = bt.Get(ctx, "test-txn-ro-key-1")
+	if !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("error should be an ErrKeyNotFound, but found: %v", err)
+	}
+
+	// writes should not
+	err = bt.Set(ctx, "test-txn-ro-key-1", []byte("test-txn-ro-val-1"))
+	if !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("error should be an ErrReadOnly, but found: %v", err)
+	}
+	err = bt.Delete(ctx, "test-txn-ro-key-1")
+	if !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("error should be an ErrReadOnly, but found: %v", err)
+	}
+
+	if err = bt.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a transaction that is not read-only should allow writes
+	bt, err = b.BeginBucketTxnWithOptions(ctx, &kv.TxnOptions{Label: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bt.Set(ctx, "test-txn-ro-key-1", []byte("test-txn-ro-val-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bt.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
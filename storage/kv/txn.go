@@ -1,6 +1,26 @@
 package kv
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrConflict indicates a transaction conflicted with another.
+	ErrConflict = errors.New("transaction conflict")
+
+	// ErrDeadlock indicates a transaction would deadlock with another.
+	ErrDeadlock = errors.New("deadlock")
+
+	// ErrLockTimeout indicates a timeout waiting to acquire a lock.
+	ErrLockTimeout = errors.New("lock timeout")
+
+	// ErrReadOnly indicates a write to a read-only transaction.
+	ErrReadOnly = errors.New("read-only transaction")
+
+	// ErrTxnClosed indicates use of a committed or rolled back transaction.
+	ErrTxnClosed = errors.New("transaction closed")
+)
 
 // TxnCompleter completes transactions.
 type TxnCompleter interface {
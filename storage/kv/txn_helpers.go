@@ -12,11 +12,24 @@ type CRUDBucketTxnPerformer func(context.Context, CRUDBucket) error
 // It takes care of beginning a transaction, committing it, or rolling
 // it back if f returns an error.
 func PerformCRUDBucketTxn(ctx context.Context, beginner CRUDBucketTxnBeginner, f CRUDBucketTxnPerformer) error {
-	// note: implementation same/similar to PerformKeysPrefixTraversingBucketTxn and PerformBucketTxn
-	b, err := beginner.BeginCRUDBucketTxn(ctx)
+	return PerformCRUDBucketTxnWithOptions(ctx, beginner, nil, f)
+}
+
+// PerformCRUDBucketTxnWithOptions calls f to execute KV operations within a transaction configured by opts.
+// It takes care of beginning a transaction, committing it, or rolling
+// it back if f returns an error. The transaction ID is set on the
+// context passed to f (see GetTxnID). If beginner does not support
+// options then the transaction is begun without them. The transaction
+// is subject to the timeout in opts, if any.
+func PerformCRUDBucketTxnWithOptions(ctx context.Context, beginner CRUDBucketTxnBeginner, opts *TxnOptions, f CRUDBucketTxnPerformer) error {
+	// note: implementation same/similar to PerformKeysPrefixTraversingBucketTxnWithOptions and PerformBucketTxnWithOptions
+	ctx, cancel := withTxnTimeout(ctx, opts)
+	defer cancel()
+	b, err := beginCRUDBucketTxn(ctx, beginner, opts)
 	if err != nil {
 		return fmt.Errorf("txn begin: %w", err)
 	}
+	ctx = withTxnID(ctx, b)
 	if err = f(ctx, b); err != nil {
 		if rbErr := b.Rollback(ctx); rbErr != nil {
 			return fmt.Errorf("txn rollback: %w; while trying to handle error: %v", rbErr, err)
@@ -36,11 +49,24 @@ type KeysPrefixTraversingBucketTxnPerformer func(ctx context.Context, txn KeysPr
 // It takes care of beginning a transaction, committing it, or rolling
 // it back if f returns an error.
 func PerformKeysPrefixTraversingBucketTxn(ctx context.Context, beginner KeysPrefixTraversingBucketTxnBeginner, f KeysPrefixTraversingBucketTxnPerformer) error {
-	// note: implementation same/similar to PerformCRUDBucketTxn and PerformBucketTxn
-	b, err := beginner.BeginKeysPrefixTraversingBucketTxn(ctx)
+	return PerformKeysPrefixTraversingBucketTxnWithOptions(ctx, beginner, nil, f)
+}
+
+// PerformKeysPrefixTraversingBucketTxnWithOptions calls f to execute KV operations within a transaction configured by opts.
+// It takes care of beginning a transaction, committing it, or rolling
+// it back if f returns an error. The transaction ID is set on the
+// context passed to f (see GetTxnID). If beginner does not support
+// options then the transaction is begun without them. The transaction
+// is subject to the timeout in opts, if any.
+func PerformKeysPrefixTraversingBucketTxnWithOptions(ctx context.Context, beginner KeysPrefixTraversingBucketTxnBeginner, opts *TxnOptions, f KeysPrefixTraversingBucketTxnPerformer) error {
+	// note: implementation same/similar to PerformCRUDBucketTxnWithOptions and PerformBucketTxnWithOptions
+	ctx, cancel := withTxnTimeout(ctx, opts)
+	defer cancel()
+	b, err := beginKeysPrefixTraversingBucketTxn(ctx, beginner, opts)
 	if err != nil {
 		return fmt.Errorf("txn begin: %w", err)
 	}
+	ctx = withTxnID(ctx, b)
 	if err = f(ctx, b); err != nil {
 		if rbErr := b.Rollback(ctx); rbErr != nil {
 			return fmt.Errorf("txn rollback: %w; while trying to handle error: %v", rbErr, err)
@@ -60,11 +86,24 @@ type BucketTxnPerformer func(ctx context.Context, txn Bucket) error
 // It takes care of beginning a transaction, committing it, or rolling
 // it back if f returns an error.
 func PerformBucketTxn(ctx context.Context, beginner BucketTxnBeginner, f BucketTxnPerformer) error {
-	// note: implementation same/similar to PerformCRUDBucketTxn and PerformKeysPrefixTraversingBucketTxn
-	b, err := beginner.BeginBucketTxn(ctx)
+	return PerformBucketTxnWithOptions(ctx, beginner, nil, f)
+}
+
+// PerformBucketTxnWithOptions calls f to execute KV operations within a transaction configured by opts.
+// It takes care of beginning a transaction, committing it, or rolling
+// it back if f returns an error. The transaction ID is set on the
+// context passed to f (see GetTxnID). If beginner does not support
+// options then the transaction is begun without them. The transaction
+// is subject to the timeout in opts, if any.
+func PerformBucketTxnWithOptions(ctx context.Context, beginner BucketTxnBeginner, opts *TxnOptions, f BucketTxnPerformer) error {
+	// note: implementation same/similar to PerformCRUDBucketTxnWithOptions and PerformKeysPrefixTraversingBucketTxnWithOptions
+	ctx, cancel := withTxnTimeout(ctx, opts)
+	defer cancel()
+	b, err := BeginBucketTxnWithOptions(ctx, beginner, opts)
 	if err != nil {
 		return fmt.Errorf("txn begin: %w", err)
 	}
+	ctx = withTxnID(ctx, b)
 	if err = f(ctx, b); err != nil {
 		if rbErr := b.Rollback(ctx); rbErr != nil {
 			return fmt.Errorf("txn rollback: %w; while trying to handle error: %v", rbErr, err)
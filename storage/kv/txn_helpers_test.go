@@ -0,0 +1,104 @@
+package kv_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanolib/log/ctxlog"
+	logtest "github.com/micromdm/nanolib/log/test"
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/kvtxn"
+)
+
+func TestPerformBucketTxnWithOptions(t *testing.T) {
+	ctx := context.Background()
+	b := kvtxn.New(kvmap.New())
+
+	err := kv.PerformBucketTxnWithOptions(ctx, b, &kv.TxnOptions{ReadOnly: true}, func(ctx context.Context, txn kv.Bucket) error {
+		return txn.Set(ctx, "hello", []byte("world"))
+	})
+	if !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("expected read-only error, have: %v", err)
+	}
+
+	err = kv.PerformBucketTxnWithOptions(ctx, b, &kv.TxnOptions{Timeout: time.Minute}, func(ctx context.Context, txn kv.Bucket) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("expected context deadline")
+		}
+		return txn.Set(ctx, "hello", []byte("world"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := b.Has(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	} else if !found {
+		t.Error("expected key to be found")
+	}
+
+	// hide the options support of kvtxn
+	plain := struct{ kv.TxnBucket }{b}
+	err = kv.PerformBucketTxnWithOptions(ctx, plain, &kv.TxnOptions{ReadOnly: true}, func(ctx context.Context, txn kv.Bucket) error {
+		t.Error("expected read-only transaction to not begin")
+		return nil
+	})
+	if !errors.Is(err, kv.ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, have: %v", err)
+	}
+	err = kv.PerformBucketTxnWithOptions(ctx, plain, &kv.TxnOptions{Label: "advisory"}, func(ctx context.Context, txn kv.Bucket) error {
+		return txn.Delete(ctx, "hello")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPerformBucketTxnTxnID(t *testing.T) {
+	ctx := context.Background()
+	logger := &logtest.Logger{KeepLastWith: true}
+
+	for _, b := range []kv.TxnBucket{kvtxn.New(kvmap.New()), kvmap.New()} {
+		var ids []string
+		err := kv.PerformBucketTxn(ctx, b, func(ctx context.Context, txn kv.Bucket) error {
+			id := kv.GetTxnID(ctx)
+			if id == "" {
+				t.Fatal("expected transaction ID")
+			}
+			if ider, ok := txn.(kv.TxnIDer); ok {
+				if have, want := id, ider.TxnID(); have != want {
+					t.Errorf("have: %q, want: %q", have, want)
+				}
+			}
+			ids = append(ids, id)
+
+			// nested transactions get their own ID
+			return kv.PerformBucketTxn(ctx, b, func(ctx context.Context, _ kv.Bucket) error {
+				id := kv.GetTxnID(ctx)
+				if id == "" || id == ids[0] {
+					t.Errorf("expected new transaction ID, have: %q", id)
+				}
+				ids = append(ids, id)
+				ctxlog.Logger(ctx, logger).Info("msg", "test")
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		logtest.TestLastLogKeyValueMatches(t, logger, "txn_id", ids[1])
+		var n int
+		for _, v := range logger.Last().Log {
+			if v == "txn_id" {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Errorf("expected txn_id to be logged once, have: %d", n)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package kv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// TxnIDer is a transaction that has an ID.
+type TxnIDer interface {
+	// TxnID returns the ID of the transaction.
+	TxnID() string
+}
+
+type ctxKeyTxnID struct{}
+
+// GetTxnID returns the transaction ID from ctx.
+// The ID is set on the context passed to transaction performers.
+func GetTxnID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeyTxnID{}).(string)
+	return id
+}
+
+// NewID generates a new random (hex-encoded, 128-bit) ID.
+// For example for transactions or lock owners.
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("generating ID: %w", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// withTxnID sets the ID of txn on ctx to be logged as "txn_id".
+// If txn does not have an ID then a new ID is generated.
+func withTxnID(ctx context.Context, txn interface{}) context.Context {
+	var id string
+	if ider, ok := txn.(TxnIDer); ok {
+		id = ider.TxnID()
+	}
+	if id == "" {
+		id = NewID()
+	}
+	if GetTxnID(ctx) == "" {
+		// only add the log func once for nested transactions
+		ctx = ctxlog.AddFunc(ctx, ctxlog.SimpleStringFunc("txn_id", ctxKeyTxnID{}))
+	}
+	return context.WithValue(ctx, ctxKeyTxnID{}, id)
+}
@@ -0,0 +1,111 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// IsolationLevel is a transaction isolation level.
+type IsolationLevel int
+
+const (
+	// IsolationDefault is the default isolation level of a store.
+	IsolationDefault IsolationLevel = iota
+	IsolationReadCommitted
+	IsolationRepeatableRead
+	IsolationSnapshot
+	IsolationSerializable
+)
+
+// TxnOptions configures a transaction.
+// Stores may ignore the advisory options they do not support.
+type TxnOptions struct {
+	// ReadOnly indicates the transaction will only read.
+	// Stores should reject writes with ErrReadOnly. Beginning a
+	// read-only transaction in a store that does not support options
+	// returns an ErrNotSupported error.
+	ReadOnly bool
+
+	// Isolation is an advisory hint for the transaction isolation level.
+	// None of the stores in this module use it.
+	Isolation IsolationLevel
+
+	// Timeout limits the duration of transactions performed with the
+	// Perform*TxnWithOptions helpers. No timeout is used if zero.
+	Timeout time.Duration
+
+	// Label identifies the transaction, e.g. for logging.
+	Label string
+}
+
+// CRUDBucketTxnOptionsBeginner can start transactions using options.
+type CRUDBucketTxnOptionsBeginner interface {
+	// BeginCRUDBucketTxnWithOptions creates a new transaction configured by opts that can later be completed.
+	BeginCRUDBucketTxnWithOptions(ctx context.Context, opts *TxnOptions) (CRUDBucketTxnCompleter, error)
+}
+
+// KeysPrefixTraversingBucketTxnOptionsBeginner can start transactions using options.
+type KeysPrefixTraversingBucketTxnOptionsBeginner interface {
+	// BeginKeysPrefixTraversingBucketTxnWithOptions creates a new transaction configured by opts that can later be completed.
+	BeginKeysPrefixTraversingBucketTxnWithOptions(ctx context.Context, opts *TxnOptions) (KeysPrefixTraversingBucketTxnCompleter, error)
+}
+
+// BucketTxnOptionsBeginner can start transactions using options.
+type BucketTxnOptionsBeginner interface {
+	// BeginBucketTxnWithOptions creates a new transaction configured by opts that can later be completed.
+	BeginBucketTxnWithOptions(ctx context.Context, opts *TxnOptions) (BucketTxnCompleter, error)
+}
+
+// checkPlainBegin returns an error if opts cannot be honoured by
+// beginning a transaction without options.
+func checkPlainBegin(opts *TxnOptions) error {
+	if opts != nil && opts.ReadOnly {
+		return fmt.Errorf("read-only transaction: %w", ErrNotSupported)
+	}
+	return nil
+}
+
+// beginCRUDBucketTxn begins a transaction using opts if supported by beginner.
+func beginCRUDBucketTxn(ctx context.Context, beginner CRUDBucketTxnBeginner, opts *TxnOptions) (CRUDBucketTxnCompleter, error) {
+	if ob, ok := beginner.(CRUDBucketTxnOptionsBeginner); ok && opts != nil {
+		return ob.BeginCRUDBucketTxnWithOptions(ctx, opts)
+	}
+	if err := checkPlainBegin(opts); err != nil {
+		return nil, err
+	}
+	return beginner.BeginCRUDBucketTxn(ctx)
+}
+
+// beginKeysPrefixTraversingBucketTxn begins a transaction using opts if supported by beginner.
+func beginKeysPrefixTraversingBucketTxn(ctx context.Context, beginner KeysPrefixTraversingBucketTxnBeginner, opts *TxnOptions) (KeysPrefixTraversingBucketTxnCompleter, error) {
+	if ob, ok := beginner.(KeysPrefixTraversingBucketTxnOptionsBeginner); ok && opts != nil {
+		return ob.BeginKeysPrefixTraversingBucketTxnWithOptions(ctx, opts)
+	}
+	if err := checkPlainBegin(opts); err != nil {
+		return nil, err
+	}
+	return beginner.BeginKeysPrefixTraversingBucketTxn(ctx)
+}
+
+// BeginBucketTxnWithOptions begins a transaction in beginner using opts
+// if beginner supports options. Otherwise the transaction is begun
+// without options. An ErrNotSupported error is returned if opts cannot
+// be honoured that way (i.e. for a read-only transaction).
+func BeginBucketTxnWithOptions(ctx context.Context, beginner BucketTxnBeginner, opts *TxnOptions) (BucketTxnCompleter, error) {
+	if ob, ok := beginner.(BucketTxnOptionsBeginner); ok && opts != nil {
+		return ob.BeginBucketTxnWithOptions(ctx, opts)
+	}
+	if err := checkPlainBegin(opts); err != nil {
+		return nil, err
+	}
+	return beginner.BeginBucketTxn(ctx)
+}
+
+// withTxnTimeout returns a context with the timeout from opts applied.
+func withTxnTimeout(ctx context.Context, opts *TxnOptions) (context.Context, context.CancelFunc) {
+	if opts != nil && opts.Timeout > 0 {
+		return context.WithTimeout(ctx, opts.Timeout)
+	}
+	return ctx, func() {}
+}
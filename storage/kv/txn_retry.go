@@ -0,0 +1,184 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// IsRetryable reports whether err is a transient transaction error.
+// That is, whether err is an ErrConflict, ErrDeadlock, or ErrLockTimeout.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrConflict) ||
+		errors.Is(err, ErrDeadlock) ||
+		errors.Is(err, ErrLockTimeout)
+}
+
+// Backoff calculates exponentially increasing delays between retries.
+type Backoff struct {
+	// Initial is the delay before the first retry.
+	Initial time.Duration
+
+	// Max is the maximum delay. No maximum is used if zero.
+	Max time.Duration
+
+	// Multiplier increases the delay for each retry.
+	// A value less than 1 is treated as 2.
+	Multiplier float64
+
+	// Jitter randomly reduces each delay by up to this fraction of it.
+	// Should be between 0 (no jitter) and 1 ("full" jitter).
+	Jitter float64
+}
+
+// DefaultBackoff is the default backoff for retries.
+var DefaultBackoff = Backoff{
+	Initial:    10 * time.Millisecond,
+	Max:        time.Second,
+	Multiplier: 2,
+	Jitter:     0.5,
+}
+
+// Delay returns the delay before retry n (starting from 1).
+func (b Backoff) Delay(n int) time.Duration {
+	mult := b.Multiplier
+	if mult < 1 {
+		mult = 2
+	}
+	delay := float64(b.Initial)
+	for i := 1; i < n; i++ {
+		delay *= mult
+		if b.Max > 0 && delay >= float64(b.Max) {
+			break
+		}
+	}
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		delay -= delay * b.Jitter * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// RetryHook is called after each attempt of a retried operation.
+// Err is the result of the attempt. Delay is how long until the next
+// attempt, or zero if there will be no further attempt.
+type RetryHook func(ctx context.Context, attempt int, err error, delay time.Duration)
+
+type retryConfig struct {
+	maxAttempts int
+	backoff     Backoff
+	retryable   func(error) bool
+	hook        RetryHook
+	txnOptions  *TxnOptions
+}
+
+// RetryOption configures retries.
+type RetryOption func(*retryConfig)
+
+// WithMaxAttempts sets the maximum number of attempts (including the first).
+func WithMaxAttempts(n int) RetryOption {
+	return func(c *retryConfig) {
+		c.maxAttempts = n
+	}
+}
+
+// WithBackoff sets the backoff used to delay retries.
+func WithBackoff(b Backoff) RetryOption {
+	return func(c *retryConfig) {
+		c.backoff = b
+	}
+}
+
+// WithRetryable sets the function that classifies errors as retryable.
+// By default IsRetryable is used.
+func WithRetryable(f func(error) bool) RetryOption {
+	return func(c *retryConfig) {
+		c.retryable = f
+	}
+}
+
+// WithRetryHook sets a hook to be called after each attempt.
+// Useful for logging.
+func WithRetryHook(hook RetryHook) RetryOption {
+	return func(c *retryConfig) {
+		c.hook = hook
+	}
+}
+
+// WithTxnOptions sets the options for each retried transaction.
+func WithTxnOptions(opts *TxnOptions) RetryOption {
+	return func(c *retryConfig) {
+		c.txnOptions = opts
+	}
+}
+
+// newRetryConfig creates a new retry configuration from opts.
+func newRetryConfig(opts []RetryOption) *retryConfig {
+	config := &retryConfig{
+		maxAttempts: 5,
+		backoff:     DefaultBackoff,
+		retryable:   IsRetryable,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
+
+// retry calls f until it succeeds, returns a non-retryable error,
+// runs out of attempts, or ctx is done.
+func retry(ctx context.Context, config *retryConfig, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= config.maxAttempts || !config.retryable(err) {
+			if config.hook != nil {
+				config.hook(ctx, attempt, err, 0)
+			}
+			return err
+		}
+		delay := config.backoff.Delay(attempt)
+		if config.hook != nil {
+			config.hook(ctx, attempt, err, delay)
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("retry: %w; after error: %v", ctx.Err(), err)
+		case <-t.C:
+		}
+	}
+}
+
+// PerformCRUDBucketTxnRetry is like PerformCRUDBucketTxn but retries
+// the whole transaction when it fails with a retryable error.
+func PerformCRUDBucketTxnRetry(ctx context.Context, beginner CRUDBucketTxnBeginner, f CRUDBucketTxnPerformer, opts ...RetryOption) error {
+	config := newRetryConfig(opts)
+	return retry(ctx, config, func() error {
+		return PerformCRUDBucketTxnWithOptions(ctx, beginner, config.txnOptions, f)
+	})
+}
+
+// PerformKeysPrefixTraversingBucketTxnRetry is like PerformKeysPrefixTraversingBucketTxn
+// but retries the whole transaction when it fails with a retryable error.
+func PerformKeysPrefixTraversingBucketTxnRetry(ctx context.Context, beginner KeysPrefixTraversingBucketTxnBeginner, f KeysPrefixTraversingBucketTxnPerformer, opts ...RetryOption) error {
+	config := newRetryConfig(opts)
+	return retry(ctx, config, func() error {
+		return PerformKeysPrefixTraversingBucketTxnWithOptions(ctx, beginner, config.txnOptions, f)
+	})
+}
+
+// PerformBucketTxnRetry is like PerformBucketTxn but retries the whole
+// transaction when it fails with a retryable error.
+// By default up to 5 attempts are made using DefaultBackoff and
+// IsRetryable to classify errors.
+func PerformBucketTxnRetry(ctx context.Context, beginner BucketTxnBeginner, f BucketTxnPerformer, opts ...RetryOption) error {
+	config := newRetryConfig(opts)
+	return retry(ctx, config, func() error {
+		return PerformBucketTxnWithOptions(ctx, beginner, config.txnOptions, f)
+	})
+}
@@ -0,0 +1,112 @@
+package kv_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/kvtxn"
+)
+
+func TestBackoff(t *testing.T) {
+	b := kv.Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	for i, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if have, want := b.Delay(i+1), want*time.Millisecond; have != want {
+			t.Errorf("retry %d: have = %v, want = %v", i+1, have, want)
+		}
+	}
+
+	b.Jitter = 1
+	for i := 1; i < 10; i++ {
+		if d := b.Delay(i); d < 0 || d > b.Max {
+			t.Errorf("retry %d: delay out of range: %v", i, d)
+		}
+	}
+}
+
+func TestPerformBucketTxnRetry(t *testing.T) {
+	ctx := context.Background()
+	b := kvtxn.New(kvmap.New())
+	noDelay := kv.WithBackoff(kv.Backoff{})
+
+	var attempts, hooks int
+	err := kv.PerformBucketTxnRetry(ctx, b, func(ctx context.Context, txn kv.Bucket) error {
+		attempts++
+		if err := txn.Set(ctx, "hello", []byte(fmt.Sprint(attempts))); err != nil {
+			return err
+		}
+		if attempts < 3 {
+			return fmt.Errorf("attempt %d: %w", attempts, kv.ErrConflict)
+		}
+		return nil
+	}, noDelay, kv.WithRetryHook(func(_ context.Context, attempt int, err error, _ time.Duration) {
+		hooks++
+		if attempt < 3 && !errors.Is(err, kv.ErrConflict) {
+			t.Errorf("attempt %d: expected conflict error, have: %v", attempt, err)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := attempts, 3; have != want {
+		t.Errorf("attempts: have = %d, want = %d", have, want)
+	}
+	if have, want := hooks, 3; have != want {
+		t.Errorf("hooks: have = %d, want = %d", have, want)
+	}
+
+	// only the successful attempt was committed
+	v, err := b.Get(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(v), "3"; have != want {
+		t.Errorf("have = %q, want = %q", have, want)
+	}
+
+	// max attempts
+	attempts = 0
+	err = kv.PerformCRUDBucketTxnRetry(ctx, b, func(context.Context, kv.CRUDBucket) error {
+		attempts++
+		return kv.ErrDeadlock
+	}, noDelay, kv.WithMaxAttempts(2))
+	if !errors.Is(err, kv.ErrDeadlock) {
+		t.Errorf("expected deadlock error, have: %v", err)
+	}
+	if have, want := attempts, 2; have != want {
+		t.Errorf("attempts: have = %d, want = %d", have, want)
+	}
+
+	// non-retryable errors are not retried
+	attempts = 0
+	errTest := errors.New("test error")
+	err = kv.PerformKeysPrefixTraversingBucketTxnRetry(ctx, b, func(context.Context, kv.KeysPrefixTraversingBucket) error {
+		attempts++
+		return errTest
+	}, noDelay)
+	if !errors.Is(err, errTest) {
+		t.Errorf("expected test error, have: %v", err)
+	}
+	if have, want := attempts, 1; have != want {
+		t.Errorf("attempts: have = %d, want = %d", have, want)
+	}
+
+	// context cancellation stops retries
+	ctx, cancel := context.WithCancel(ctx)
+	attempts = 0
+	err = kv.PerformBucketTxnRetry(ctx, b, func(context.Context, kv.Bucket) error {
+		attempts++
+		cancel()
+		return kv.ErrLockTimeout
+	}, kv.WithBackoff(kv.Backoff{Initial: time.Hour}))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled error, have: %v", err)
+	}
+	if have, want := attempts, 1; have != want {
+		t.Errorf("attempts: have = %d, want = %d", have, want)
+	}
+}